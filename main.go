@@ -1,26 +1,123 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	// Embed the time zone database so SnapshotGroups can use any IANA time zone
+	_ "time/tzdata"
 
+	"github.com/go-logr/logr/funcr"
 	"k8s.io/klog/v2"
 
+	"github.com/fairwindsops/gemini/pkg/config"
 	"github.com/fairwindsops/gemini/pkg/controller"
 	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
 )
 
-func init() {
-	klog.InitFlags(nil)
-	flag.Parse()
-}
+// maxLogVerbosity lets klog decide which messages are logged, based on -v
+const maxLogVerbosity = 127
 
 func main() {
+	klog.InitFlags(nil)
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		klog.Fatalf("Invalid configuration: %s", err.Error())
+	}
+	if conf.LogFormat == config.LogFormatJSON {
+		klog.SetLogger(funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{LogTimestamp: true, Verbosity: maxLogVerbosity}))
+	}
+	klog.Infof("Starting with configuration %s", conf)
 	klog.V(5).Infof("Running in verbose mode")
-	ctrl := controller.NewController()
 
-	stopCh := make(chan struct{})
-	kube.GetClient().InformerFactory.Start(stopCh)
-	if err := ctrl.Run(1, stopCh); err != nil {
-		klog.Fatalf("Error running controller: %s", err.Error())
+	kube.Configure(kube.Options{
+		ResyncPeriod:      conf.ResyncPeriod.Duration,
+		CreateCRD:         conf.CreateCRD,
+		Namespaces:        conf.Namespaces,
+		NamespaceSelector: conf.GetNamespaceSelector(),
+	})
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	ctrl := controller.NewController(controller.Options{
+		SnapshotReadyTimeout: conf.SnapshotReadyTimeout.Duration,
+	})
+	serveHTTP(conf, ctrl)
+	run := func(ctx context.Context) {
+		kube.GetClient().Start(ctx.Done())
+		if err := ctrl.Run(conf.Workers, ctx.Done()); err != nil {
+			klog.Fatalf("Error running controller: %s", err.Error())
+		}
+	}
+	if !conf.LeaderElection.Enabled {
+		run(ctx)
+		return
+	}
+	kube.RunWithLeaderElection(ctx, kube.LeaderElectionConfig{
+		Namespace:     conf.LeaderElection.Namespace,
+		Name:          conf.LeaderElection.Name,
+		LeaseDuration: conf.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline: conf.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:   conf.LeaderElection.RetryPeriod.Duration,
+	}, run)
+}
+
+// serveHTTP starts the metrics and health servers, sharing a server if they use the same address
+func serveHTTP(conf *config.Config, ctrl *controller.Controller) {
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(address string) *http.ServeMux {
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if config.Enabled(conf.MetricsAddress) {
+		getMux(conf.MetricsAddress).Handle("/metrics", metrics.Handler())
+	}
+	if config.Enabled(conf.HealthAddress) {
+		mux := getMux(conf.HealthAddress)
+		mux.HandleFunc("/healthz", check(func() error {
+			if err := kube.CheckLeaderLease(); err != nil {
+				return err
+			}
+			return ctrl.CheckProgress()
+		}))
+		mux.HandleFunc("/readyz", check(func() error {
+			// A standby replica is ready to take over once it sees the leader, and syncs its caches after acquiring the Lease
+			standby, err := kube.IsStandby()
+			if standby || err != nil {
+				return err
+			}
+			return ctrl.CheckReady()
+		}))
+	}
+	for address, mux := range muxes {
+		go serve(address, mux)
+	}
+}
+
+func serve(address string, handler http.Handler) {
+	klog.Infof("Serving HTTP on %s", address)
+	if err := http.ListenAndServe(address, handler); err != nil {
+		klog.Fatalf("Error serving on %s: %s", address, err.Error())
+	}
+}
+
+// check serves a health check, which fails with the error returned by checkFn
+func check(checkFn func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := checkFn(); err != nil {
+			klog.V(3).Infof("Health check failed - %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
 	}
 }
@@ -0,0 +1,263 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+)
+
+const (
+	// LogFormatText logs in klog's text format
+	LogFormatText = "text"
+	// LogFormatJSON logs one JSON object per line
+	LogFormatJSON = "json"
+
+	// disabledAddress disables a server
+	disabledAddress = "0"
+
+	// leaderElectionJitter matches the jitter applied by client-go to the leader election retry period
+	leaderElectionJitter = 1.2
+)
+
+// Config is the configuration of the operator, read from an optional YAML file and command-line flags
+type Config struct {
+	Workers              int             `json:"workers"`
+	ResyncPeriod         metav1.Duration `json:"resyncPeriod"`
+	SnapshotReadyTimeout metav1.Duration `json:"snapshotReadyTimeout"`
+	Namespaces           []string        `json:"namespaces,omitempty"`
+	NamespaceSelector    string          `json:"namespaceSelector,omitempty"`
+	LogFormat            string          `json:"logFormat"`
+	MetricsAddress       string          `json:"metricsAddress"`
+	HealthAddress        string          `json:"healthAddress"`
+	CreateCRD            bool            `json:"createCRD"`
+	LeaderElection       LeaderElection  `json:"leaderElection"`
+}
+
+// LeaderElection configures the Lease used to elect a leader among replicas
+type LeaderElection struct {
+	Enabled       bool            `json:"enabled"`
+	Namespace     string          `json:"namespace,omitempty"`
+	Name          string          `json:"name"`
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod"`
+}
+
+// Default returns the configuration used when no config file or flags are given
+func Default() *Config {
+	kubeOptions := kube.DefaultOptions()
+	return &Config{
+		Workers:              1,
+		ResyncPeriod:         metav1.Duration{Duration: kubeOptions.ResyncPeriod},
+		SnapshotReadyTimeout: metav1.Duration{Duration: 60 * time.Second},
+		LogFormat:            LogFormatText,
+		MetricsAddress:       ":8080",
+		HealthAddress:        ":8081",
+		CreateCRD:            kubeOptions.CreateCRD,
+		LeaderElection: LeaderElection{
+			Name:          "gemini-leader",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+	}
+}
+
+// AddFlags binds command-line flags to the fields of c, using their current values as defaults
+func (c *Config) AddFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Workers, "workers", c.Workers, "Number of SnapshotGroups to reconcile concurrently")
+	fs.DurationVar(&c.ResyncPeriod.Duration, "resync-period", c.ResyncPeriod.Duration, "How often every SnapshotGroup is reconciled, even if nothing changed")
+	fs.DurationVar(&c.SnapshotReadyTimeout.Duration, "snapshot-ready-timeout", c.SnapshotReadyTimeout.Duration, "How long a restore waits for the failsafe snapshot to be ready to use")
+	fs.Var((*stringList)(&c.Namespaces), "namespaces", "Comma-separated list of namespaces to watch. All namespaces are watched if empty")
+	fs.StringVar(&c.NamespaceSelector, "namespace-selector", c.NamespaceSelector, "Label selector for the namespaces to watch")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format, either text or json")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", c.MetricsAddress, "Address to serve Prometheus metrics on, or 0 to disable")
+	fs.StringVar(&c.HealthAddress, "health-address", c.HealthAddress, "Address to serve /healthz and /readyz on, or 0 to disable")
+	fs.BoolVar(&c.CreateCRD, "create-crd", c.CreateCRD, "Create the SnapshotGroup, SnapshotRestore and SnapshotPolicy CRDs on startup")
+
+	fs.BoolVar(&c.LeaderElection.Enabled, "leader-elect", c.LeaderElection.Enabled, "Elect a leader using a Lease, so that only one replica reconciles SnapshotGroups")
+	fs.StringVar(&c.LeaderElection.Namespace, "leader-election-namespace", c.LeaderElection.Namespace, "Namespace of the leader election Lease. Defaults to the namespace Gemini is running in")
+	fs.StringVar(&c.LeaderElection.Name, "leader-election-id", c.LeaderElection.Name, "Name of the leader election Lease")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration.Duration, "leader-election-lease-duration", c.LeaderElection.LeaseDuration.Duration, "How long followers wait before taking over an unrenewed Lease")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline.Duration, "leader-election-renew-deadline", c.LeaderElection.RenewDeadline.Duration, "How long the leader keeps trying to renew the Lease before giving up leadership")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod.Duration, "leader-election-retry-period", c.LeaderElection.RetryPeriod.Duration, "How long to wait between attempts to acquire or renew the Lease")
+}
+
+// Load parses args into a Config. If --config names a YAML file, it is read first, so flags
+// that are set explicitly take precedence over the file.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+	var path string
+	fs.StringVar(&path, "config", "", "Path to a YAML config file")
+	c.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+		// Parse again so that explicit flags override the file
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns an error if any setting is invalid. Repeated namespaces are removed
+func (c *Config) Validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", c.Workers)
+	}
+	if c.ResyncPeriod.Duration < 0 {
+		return fmt.Errorf("resyncPeriod must not be negative, got %s", c.ResyncPeriod.Duration)
+	}
+	if c.SnapshotReadyTimeout.Duration < time.Second {
+		return fmt.Errorf("snapshotReadyTimeout must be at least 1s, got %s", c.SnapshotReadyTimeout.Duration)
+	}
+	// Each namespace gets its own informers, so a repeated one would have every event handled twice
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, namespace := range c.Namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	if len(c.Namespaces) > 0 {
+		c.Namespaces = namespaces
+	}
+	if c.NamespaceSelector != "" {
+		if len(c.Namespaces) > 0 {
+			return errors.New("namespaces and namespaceSelector cannot both be set")
+		}
+		if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+			return fmt.Errorf("namespaceSelector: %w", err)
+		}
+	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("logFormat must be %s or %s, got %q", LogFormatText, LogFormatJSON, c.LogFormat)
+	}
+	if err := validateAddress(c.MetricsAddress); err != nil {
+		return fmt.Errorf("metricsAddress: %w", err)
+	}
+	if err := validateAddress(c.HealthAddress); err != nil {
+		return fmt.Errorf("healthAddress: %w", err)
+	}
+	if c.LeaderElection.Enabled {
+		le := c.LeaderElection
+		if le.Name == "" {
+			return errors.New("leaderElection.name must be set")
+		}
+		if le.RetryPeriod.Duration <= 0 {
+			return fmt.Errorf("leaderElection.retryPeriod must be positive, got %s", le.RetryPeriod.Duration)
+		}
+		if le.RenewDeadline.Duration <= time.Duration(leaderElectionJitter*float64(le.RetryPeriod.Duration)) {
+			return fmt.Errorf("leaderElection.renewDeadline (%s) must be greater than %.1f times retryPeriod (%s)", le.RenewDeadline.Duration, leaderElectionJitter, le.RetryPeriod.Duration)
+		}
+		if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+			return fmt.Errorf("leaderElection.leaseDuration (%s) must be greater than renewDeadline (%s)", le.LeaseDuration.Duration, le.RenewDeadline.Duration)
+		}
+	}
+	return nil
+}
+
+func validateAddress(address string) error {
+	if address == disabledAddress {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Enabled returns false if address is the value used to disable a server
+func Enabled(address string) bool {
+	return address != disabledAddress
+}
+
+// GetNamespaceSelector returns the parsed NamespaceSelector, or nil if it is not set. Validate must have succeeded
+func (c *Config) GetNamespaceSelector() labels.Selector {
+	if c.NamespaceSelector == "" {
+		return nil
+	}
+	selector, err := labels.Parse(c.NamespaceSelector)
+	if err != nil {
+		return nil
+	}
+	return selector
+}
+
+// String returns the configuration as JSON, for logging
+func (c *Config) String() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("%+v", *c)
+	}
+	return string(data)
+}
+
+// stringList is a comma-separated flag.Value
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
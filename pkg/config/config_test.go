@@ -0,0 +1,114 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func load(args ...string) (*Config, error) {
+	return Load(flag.NewFlagSet("gemini", flag.ContinueOnError), args)
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	conf, err := load()
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), conf)
+	assert.Equal(t, 1, conf.Workers)
+	assert.Equal(t, 60*time.Second, conf.SnapshotReadyTimeout.Duration)
+}
+
+func TestFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, `
+workers: 4
+resyncPeriod: 5m
+logFormat: json
+leaderElection:
+  enabled: true
+  namespace: gemini
+`)
+	conf, err := load("--config", path, "--workers", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conf.Workers)
+	assert.Equal(t, 5*time.Minute, conf.ResyncPeriod.Duration)
+	assert.Equal(t, LogFormatJSON, conf.LogFormat)
+	assert.True(t, conf.LeaderElection.Enabled)
+	assert.Equal(t, "gemini", conf.LeaderElection.Namespace)
+	assert.Equal(t, "gemini-leader", conf.LeaderElection.Name)
+	assert.Equal(t, ":8080", conf.MetricsAddress)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := load("--config", writeConfig(t, "wokers: 2\n"))
+	assert.Error(t, err, "unknown fields should be rejected")
+
+	_, err = load("--config", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+
+	invalid := [][]string{
+		{"--workers", "0"},
+		{"--resync-period", "-1s"},
+		{"--snapshot-ready-timeout", "0s"},
+		{"--log-format", "xml"},
+		{"--metrics-address", "8080"},
+		{"--leader-elect", "--leader-election-id", ""},
+		{"--leader-elect", "--leader-election-lease-duration", "5s"},
+		{"--leader-elect", "--leader-election-retry-period", "9s"},
+	}
+	for _, args := range invalid {
+		_, err := load(args...)
+		assert.Error(t, err, args)
+	}
+
+	_, err = load("--metrics-address", "0", "--health-address", "127.0.0.1:9000")
+	assert.NoError(t, err)
+}
+
+func TestNamespaces(t *testing.T) {
+	conf, err := load("--namespaces", "team-a, team-b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a", "team-b"}, conf.Namespaces)
+	assert.Nil(t, conf.GetNamespaceSelector())
+
+	conf, err = load("--namespace-selector", "gemini=enabled")
+	assert.NoError(t, err)
+	assert.Equal(t, "gemini=enabled", conf.GetNamespaceSelector().String())
+
+	conf, err = load("--namespaces", "team-a,team-b,team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a", "team-b"}, conf.Namespaces, "repeated namespaces are only watched once")
+	conf, err = load("--config", writeConfig(t, "namespaces: [team-a, team-a]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a"}, conf.Namespaces)
+
+	_, err = load("--namespaces", "team-a", "--namespace-selector", "gemini=enabled")
+	assert.Error(t, err)
+	_, err = load("--namespaces", "Team_A")
+	assert.Error(t, err)
+	_, err = load("--namespace-selector", "gemini in (")
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	"github.com/fairwindsops/gemini/pkg/snapshots"
+)
+
+const annotatedClaimTask = "annotatedclaim"
+
+// annotatedClaimHandler enqueues PVCs that have, or had, the schedule annotation, so that their SnapshotGroup
+// is created, updated or deleted. Resyncs and updates that leave the metadata of the PVC alone are ignored
+func (c *Controller) annotatedClaimHandler() cache.ResourceEventHandler {
+	enqueue := func(objs ...interface{}) {
+		for _, obj := range objs {
+			acc, ok := getObjectMeta(obj)
+			if ok && snapshots.HasScheduleAnnotation(acc) {
+				c.enqueueAnnotatedClaim(acc.GetNamespace(), acc.GetName())
+				return
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			enqueue(obj)
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			oldAcc, oldOK := getObjectMeta(old)
+			acc, ok := getObjectMeta(obj)
+			if oldOK && ok && !isResync(old, obj) && !isStatusUpdate(oldAcc, acc) {
+				enqueue(old, obj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueue(obj)
+		},
+	}
+}
+
+// enrolledGroupHandler enqueues the PVC of a SnapshotGroup generated from the schedule annotation, so that the group
+// is put back in sync with the PVC, or deleted if the annotation was removed while the controller wasn't running.
+// Status updates are ignored
+func (c *Controller) enrolledGroupHandler() cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		acc, ok := getObjectMeta(obj)
+		if !ok {
+			return
+		}
+		if claim := snapshots.GetEnrolledClaimName(acc); claim != "" {
+			c.enqueueAnnotatedClaim(acc.GetNamespace(), claim)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			oldAcc, oldOK := getObjectMeta(old)
+			acc, ok := getObjectMeta(obj)
+			if oldOK && ok && !isResync(old, obj) && !isStatusUpdate(oldAcc, acc) {
+				enqueue(obj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+func (c *Controller) enqueueAnnotatedClaim(namespace, name string) {
+	if !kube.GetClient().IsWatched(namespace) {
+		return
+	}
+	c.claimQueue.Add(namespace + "/" + name)
+}
+
+func (c *Controller) runClaimWorker() {
+	for c.processNextClaim() {
+	}
+}
+
+// processNextClaim reads a single PVC key off the claim queue and reconciles its SnapshotGroup
+func (c *Controller) processNextClaim() bool {
+	obj, shutdown := c.claimQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.recordProgress("AnnotatedClaims")
+	defer c.claimQueue.Done(obj)
+	key, ok := obj.(string)
+	if !ok {
+		c.claimQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in claim queue but got %#v", obj))
+		return true
+	}
+	if err := c.syncAnnotatedClaim(key); err != nil {
+		c.claimQueue.AddRateLimited(key)
+		utilruntime.HandleError(fmt.Errorf("%s: error syncing annotated PVC: %s, requeuing", key, err.Error()))
+		return true
+	}
+	c.claimQueue.Forget(obj)
+	return true
+}
+
+// syncAnnotatedClaim reconciles the SnapshotGroup generated from the schedule annotation of a PVC
+func (c *Controller) syncAnnotatedClaim(key string) error {
+	start := time.Now()
+	defer func() {
+		metrics.ReconcileDuration.WithLabelValues(annotatedClaimTask).Observe(time.Since(start).Seconds())
+	}()
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	klog.V(5).Infof("%s/%s: reconciling %s annotation", namespace, name, snapshots.ScheduleAnnotation)
+	return snapshots.ReconcileAnnotatedClaim(namespace, name, c.recorder)
+}
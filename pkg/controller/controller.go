@@ -16,32 +16,69 @@ package controller
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
 	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
 	"github.com/fairwindsops/gemini/pkg/snapshots"
 	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
-	listers "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1/apis/listers/snapshotgroup/v1"
 )
 
-const defaultSnapshotReadyTimeoutSeconds = 60
+const defaultSnapshotReadyTimeout = 60 * time.Second
+
+const controllerAgentName = "gemini"
 
 // Controller represents a SnapshotGroup controller
 type Controller struct {
-	sgLister listers.SnapshotGroupLister
-	sgSynced cache.InformerSynced
+	sgSynced      []cache.InformerSynced
+	restoreSynced []cache.InformerSynced
+	policySynced  []cache.InformerSynced
 
 	workqueue workqueue.RateLimitingInterface
+	// groupRestoreQueue holds restores requested with the restore annotation, which have their own workers, as they
+	// can take minutes waiting for workloads to scale down
+	groupRestoreQueue workqueue.RateLimitingInterface
+	restoreQueue      workqueue.RateLimitingInterface
+	policyQueue       workqueue.RateLimitingInterface
+	claimQueue        workqueue.RateLimitingInterface
+
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
 
 	snapshotReadyTimeoutSeconds int
+
+	// groupLocks holds a *sync.Mutex for each SnapshotGroup key, so that different workers never work on the backups,
+	// restores and SnapshotRestores of the same group at the same time
+	groupLocks sync.Map
+
+	// started is set once the informer caches have synced and the workers have started, at startTime
+	started   atomic.Bool
+	startTime time.Time
+	// progress holds the time a worker last finished an item from each queue, by queue name
+	progress sync.Map
+}
+
+// Options configures a Controller
+type Options struct {
+	// SnapshotReadyTimeout is how long a restore waits for the failsafe snapshot to be ready to use
+	SnapshotReadyTimeout time.Duration
 }
 
 type task int
@@ -54,6 +91,8 @@ const (
 
 var taskLabels = []string{"backup", "restore", "delete"}
 
+// workItem is a task to perform on a SnapshotGroup. If snapshotGroup is nil, the SnapshotGroup is read
+// from the informer cache when the task runs, so that repeated backups of the same group are deduplicated
 type workItem struct {
 	name          string
 	namespace     string
@@ -61,6 +100,12 @@ type workItem struct {
 	task          task
 }
 
+// groupBusyDelay is how long work on a SnapshotGroup is put off while another worker is working on the group
+const groupBusyDelay = 5 * time.Second
+
+// minRequeueDelay stops a group whose next snapshot is overdue from being reconciled in a tight loop
+const minRequeueDelay = time.Second
+
 func getRateLimiter() workqueue.RateLimiter {
 	return workqueue.NewMaxOfRateLimiter(
 		workqueue.NewItemExponentialFailureRateLimiter(time.Second, 1000*time.Second),
@@ -70,77 +115,206 @@ func getRateLimiter() workqueue.RateLimiter {
 }
 
 // NewController creates a new SnapshotGroup controller
-func NewController() *Controller {
+func NewController(opts Options) *Controller {
+	if opts.SnapshotReadyTimeout == 0 {
+		opts.SnapshotReadyTimeout = defaultSnapshotReadyTimeout
+	}
 	client := kube.GetClient()
+	utilruntime.Must(snapshotgroup.AddToScheme(scheme.Scheme))
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartStructuredLogging(0)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.K8s.CoreV1().Events("")})
 	controller := &Controller{
-		sgLister:                    client.Informer.Lister(),
-		sgSynced:                    client.Informer.Informer().HasSynced,
+		sgSynced:                    client.InformersSynced(),
+		restoreSynced:               client.RestoreInformersSynced(),
+		policySynced:                client.PolicyInformersSynced(),
 		workqueue:                   workqueue.NewNamedRateLimitingQueue(getRateLimiter(), "SnapshotGroups"),
-		snapshotReadyTimeoutSeconds: defaultSnapshotReadyTimeoutSeconds,
+		groupRestoreQueue:           workqueue.NewNamedRateLimitingQueue(getRateLimiter(), "SnapshotGroupRestores"),
+		restoreQueue:                workqueue.NewNamedRateLimitingQueue(getRateLimiter(), "SnapshotRestores"),
+		policyQueue:                 workqueue.NewNamedRateLimitingQueue(getRateLimiter(), "SnapshotPolicies"),
+		claimQueue:                  workqueue.NewNamedRateLimitingQueue(getRateLimiter(), "AnnotatedClaims"),
+		eventBroadcaster:            eventBroadcaster,
+		recorder:                    eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName}),
+		snapshotReadyTimeoutSeconds: int(opts.SnapshotReadyTimeout.Seconds()),
 	}
-	client.Informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(sg interface{}) {
-			controller.enqueue(sg, backupTask)
+	handler := cache.FilteringResourceEventHandler{
+		FilterFunc: func(sg interface{}) bool {
+			acc, err := meta.Accessor(sg)
+			return err == nil && client.IsWatched(acc.GetNamespace())
 		},
-		UpdateFunc: func(old, sg interface{}) {
-			oldAcc, _ := meta.Accessor(old)
-			newAcc, _ := meta.Accessor(sg)
-			oldRestore := oldAcc.GetAnnotations()[snapshots.RestoreAnnotation]
-			newRestore := newAcc.GetAnnotations()[snapshots.RestoreAnnotation]
-			if newRestore != "" && oldRestore != newRestore {
-				controller.enqueue(sg, restoreTask)
-			} else {
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(sg interface{}) {
 				controller.enqueue(sg, backupTask)
-			}
-		},
-		DeleteFunc: func(sg interface{}) {
-			controller.enqueue(sg, deleteTask)
+			},
+			UpdateFunc: func(old, sg interface{}) {
+				oldAcc, _ := meta.Accessor(old)
+				newAcc, _ := meta.Accessor(sg)
+				if isStatusUpdate(oldAcc, newAcc) {
+					return
+				}
+				oldRestore := oldAcc.GetAnnotations()[snapshots.RestoreAnnotation]
+				newRestore := newAcc.GetAnnotations()[snapshots.RestoreAnnotation]
+				oldTarget := oldAcc.GetAnnotations()[snapshots.RestoreTargetAnnotation]
+				newTarget := newAcc.GetAnnotations()[snapshots.RestoreTargetAnnotation]
+				oldSnapshotNow := oldAcc.GetAnnotations()[snapshots.SnapshotNowAnnotation]
+				newSnapshotNow := newAcc.GetAnnotations()[snapshots.SnapshotNowAnnotation]
+				// Changing only the target restores the same snapshot again, but never replaces the PVC
+				if newRestore != "" && (oldRestore != newRestore || (newTarget != "" && oldTarget != newTarget)) {
+					controller.enqueue(sg, restoreTask)
+				} else {
+					if newSnapshotNow != "" && oldSnapshotNow != newSnapshotNow {
+						klog.V(3).Infof("%s/%s: manual snapshot %s requested", newAcc.GetNamespace(), newAcc.GetName(), newSnapshotNow)
+					}
+					controller.enqueue(sg, backupTask)
+				}
+			},
+			DeleteFunc: func(sg interface{}) {
+				controller.enqueue(sg, deleteTask)
+			},
 		},
-	})
+	}
+	sgIndexers := []cache.Indexer{}
+	for _, informer := range client.Informers {
+		utilruntime.Must(informer.Informer().AddIndexers(cache.Indexers{claimNameIndex: indexByClaimName}))
+		informer.Informer().AddEventHandler(handler)
+		informer.Informer().AddEventHandler(controller.enrolledGroupHandler())
+		sgIndexers = append(sgIndexers, informer.Informer().GetIndexer())
+	}
+	// Reconcile SnapshotGroups as soon as their VolumeSnapshots or PVCs change
+	for _, informer := range client.SnapshotInformers {
+		informer.AddEventHandler(controller.snapshotHandler())
+	}
+	for _, informer := range client.PVCInformers {
+		informer.Informer().AddEventHandler(controller.pvcHandler(sgIndexers))
+		informer.Informer().AddEventHandler(controller.annotatedClaimHandler())
+	}
+	for _, informer := range client.RestoreInformers {
+		informer.Informer().AddEventHandler(controller.restoreHandler())
+	}
+	if client.HasNamespaceSelector() {
+		client.NamespaceInformer.Informer().AddEventHandler(controller.namespaceHandler())
+	}
+	if client.PolicyInformer != nil {
+		client.PolicyInformer.Informer().AddEventHandler(controller.policyHandler())
+		client.NamespaceInformer.Informer().AddEventHandler(controller.policyNamespaceHandler())
+		for _, informer := range client.Informers {
+			informer.Informer().AddEventHandler(controller.policyGroupHandler())
+		}
+		for _, informer := range client.PVCInformers {
+			informer.Informer().AddEventHandler(controller.policyClaimHandler())
+		}
+	}
 	return controller
 }
 
+// isStatusUpdate returns true if only the status of a SnapshotGroup changed, which happens
+// whenever the controller records the result of a reconcile
+func isStatusUpdate(old, sg metav1.Object) bool {
+	if old.GetResourceVersion() == sg.GetResourceVersion() {
+		// This is a periodic resync
+		return false
+	}
+	return old.GetGeneration() == sg.GetGeneration() &&
+		reflect.DeepEqual(old.GetDeletionTimestamp(), sg.GetDeletionTimestamp()) &&
+		reflect.DeepEqual(old.GetAnnotations(), sg.GetAnnotations()) &&
+		reflect.DeepEqual(old.GetLabels(), sg.GetLabels())
+}
+
 func (c *Controller) enqueue(sg interface{}, todo task) {
 	acc, _ := meta.Accessor(sg)
 	name := acc.GetName()
 	namespace := acc.GetNamespace()
 	w := workItem{
-		name:          name,
-		namespace:     namespace,
-		task:          todo,
-		snapshotGroup: sg.(*snapshotgroup.SnapshotGroup),
+		name:      name,
+		namespace: namespace,
+		task:      todo,
+	}
+	if todo != backupTask {
+		w.snapshotGroup = sg.(*snapshotgroup.SnapshotGroup)
+	}
+	if todo == restoreTask {
+		c.groupRestoreQueue.Add(w)
+		return
 	}
 	c.workqueue.Add(w)
 }
 
+// enqueueNextBackup requeues a backup for when the next snapshot is due
+func (c *Controller) enqueueNextBackup(w workItem, next time.Time) {
+	if next.IsZero() {
+		return
+	}
+	delay := time.Until(next)
+	if delay < minRequeueDelay {
+		delay = minRequeueDelay
+	}
+	klog.V(5).Infof("%s/%s: next snapshot due in %s", w.namespace, w.name, delay)
+	c.workqueue.AddAfter(workItem{name: w.name, namespace: w.namespace, task: backupTask}, delay)
+}
+
+// tryLockGroup locks a SnapshotGroup for the calling worker, and returns false if another worker holds the lock
+func (c *Controller) tryLockGroup(namespace, name string) bool {
+	lock, _ := c.groupLocks.LoadOrStore(namespace+"/"+name, &sync.Mutex{})
+	return lock.(*sync.Mutex).TryLock()
+}
+
+// unlockGroup releases a lock taken with tryLockGroup
+func (c *Controller) unlockGroup(namespace, name string) {
+	if lock, ok := c.groupLocks.Load(namespace + "/" + name); ok {
+		lock.(*sync.Mutex).Unlock()
+	}
+}
+
 func (c *Controller) runWorker() {
 	for c.processNextWorkItem() {
 	}
 }
 
-// processNextWorkItem will read a single work item off the workqueue and
-// attempt to process it, by calling the syncHandler.
+func (c *Controller) runGroupRestoreWorker() {
+	for c.processNextGroupRestore() {
+	}
+}
+
+// processNextWorkItem reads a single backup or delete work item off the workqueue and processes it
 func (c *Controller) processNextWorkItem() bool {
-	obj, shutdown := c.workqueue.Get()
+	return c.processNextGroupItem(c.workqueue, "SnapshotGroups")
+}
+
+// processNextGroupRestore reads a single restore work item off the group restore queue and processes it
+func (c *Controller) processNextGroupRestore() bool {
+	return c.processNextGroupItem(c.groupRestoreQueue, "SnapshotGroupRestores")
+}
+
+// processNextGroupItem will read a single work item off queue and
+// attempt to process it, by calling the syncHandler.
+func (c *Controller) processNextGroupItem(queue workqueue.RateLimitingInterface, queueName string) bool {
+	obj, shutdown := queue.Get()
 
 	if shutdown {
 		return false
 	}
+	defer c.recordProgress(queueName)
 
 	err := func(obj interface{}) error {
-		defer c.workqueue.Done(obj)
+		defer queue.Done(obj)
 		var item workItem
 		var ok bool
 		if item, ok = obj.(workItem); !ok {
-			c.workqueue.Forget(obj)
-			utilruntime.HandleError(fmt.Errorf("expected workItem in workqueue but got %#v", obj))
+			queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("expected workItem in %s queue but got %#v", queueName, obj))
+			return nil
+		}
+		if !c.tryLockGroup(item.namespace, item.name) {
+			klog.V(5).Infof("%s/%s: putting off %s, another worker is busy with the SnapshotGroup", item.namespace, item.name, taskLabels[item.task])
+			queue.AddAfter(item, groupBusyDelay)
 			return nil
 		}
+		defer c.unlockGroup(item.namespace, item.name)
 		if err := c.syncHandler(item); err != nil {
-			c.workqueue.AddRateLimited(item)
+			queue.AddRateLimited(item)
 			return fmt.Errorf("%s/%s: error syncing %#v: %s, requeuing", item.namespace, item.name, item, err.Error())
 		}
-		c.workqueue.Forget(obj)
+		queue.Forget(obj)
 		klog.V(5).Infof("%s/%s: successfully performed %s", item.namespace, item.name, taskLabels[item.task])
 		return nil
 	}(obj)
@@ -154,11 +328,53 @@ func (c *Controller) processNextWorkItem() bool {
 }
 
 func (c *Controller) syncHandler(w workItem) error {
+	start := time.Now()
+	defer func() {
+		metrics.ReconcileDuration.WithLabelValues(taskLabels[w.task]).Observe(time.Since(start).Seconds())
+	}()
+	if w.snapshotGroup == nil {
+		client := kube.GetClient()
+		if !client.IsWatched(w.namespace) {
+			klog.V(5).Infof("%s/%s: skipping %s in unwatched namespace", w.namespace, w.name, taskLabels[w.task])
+			return nil
+		}
+		sg, err := client.GetSnapshotGroup(w.namespace, w.name)
+		if errors.IsNotFound(err) {
+			klog.V(5).Infof("%s/%s: skipping %s of deleted SnapshotGroup", w.namespace, w.name, taskLabels[w.task])
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		w.snapshotGroup = sg.DeepCopy()
+	}
+	if w.task == backupTask && w.snapshotGroup.ObjectMeta.DeletionTimestamp == nil {
+		interrupted, err := snapshots.IsRestoreInterrupted(w.snapshotGroup)
+		if err != nil {
+			return err
+		}
+		if interrupted {
+			// The restore schedules the next backup when it finishes
+			klog.V(3).Infof("%s/%s: resuming interrupted restore", w.namespace, w.name)
+			c.enqueue(w.snapshotGroup, restoreTask)
+			return nil
+		}
+	}
 	var err error
-	if w.task == backupTask {
-		err = snapshots.ReconcileBackupsForSnapshotGroup(w.snapshotGroup)
+	if w.task == backupTask && w.snapshotGroup.ObjectMeta.DeletionTimestamp != nil {
+		err = snapshots.FinalizeSnapshotGroup(w.snapshotGroup, c.recorder)
+	} else if w.task == backupTask && w.snapshotGroup.Spec.Suspend {
+		err = snapshots.ReconcileSuspendedSnapshotGroup(w.snapshotGroup)
+	} else if w.task == backupTask {
+		var next time.Time
+		next, err = snapshots.ReconcileBackupsForSnapshotGroup(w.snapshotGroup, c.recorder)
+		if err == nil {
+			c.enqueueNextBackup(w, next)
+		}
 	} else if w.task == restoreTask {
-		err = snapshots.RestoreSnapshotGroup(w.snapshotGroup, c.snapshotReadyTimeoutSeconds)
+		err = snapshots.RestoreSnapshotGroup(w.snapshotGroup, c.snapshotReadyTimeoutSeconds, c.recorder)
+		// Backups were put off during the restore, so schedule the next one
+		c.workqueue.Add(workItem{name: w.name, namespace: w.namespace, task: backupTask})
 	} else if w.task == deleteTask {
 		err = snapshots.OnSnapshotGroupDelete(w.snapshotGroup)
 	}
@@ -175,22 +391,88 @@ func (c *Controller) syncHandler(w workItem) error {
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
+	defer c.groupRestoreQueue.ShutDown()
+	defer c.restoreQueue.ShutDown()
+	defer c.policyQueue.ShutDown()
+	defer c.claimQueue.ShutDown()
+	defer c.eventBroadcaster.Shutdown()
 
 	klog.Info("Starting SnapshotGroup controller")
 
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.sgSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.sgSynced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
 	klog.Info("Starting workers")
+	var workers sync.WaitGroup
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runWorker, time.Second, stopCh)
+		}()
 	}
+	for i := 0; i < threadiness; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runGroupRestoreWorker, time.Second, stopCh)
+		}()
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		wait.Until(c.runClaimWorker, time.Second, stopCh)
+	}()
+
+	// SnapshotRestores are waited for separately, so that backups continue if their CRD is not installed
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		if ok := cache.WaitForCacheSync(stopCh, c.restoreSynced...); !ok {
+			klog.Warning("SnapshotRestore informer caches did not sync, not reconciling SnapshotRestores")
+			return
+		}
+		for i := 0; i < threadiness; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				wait.Until(c.runRestoreWorker, time.Second, stopCh)
+			}()
+		}
+	}()
+
+	// SnapshotPolicies are cluster-scoped, and may not be listable if the controller is restricted to some namespaces
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		if len(c.policySynced) == 0 {
+			return
+		}
+		if ok := cache.WaitForCacheSync(stopCh, c.policySynced...); !ok {
+			klog.Warning("SnapshotPolicy informer cache did not sync, not reconciling SnapshotPolicies")
+			return
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runPolicyWorker, time.Second, stopCh)
+		}()
+	}()
 
+	c.startTime = time.Now()
+	c.started.Store(true)
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
+	// Let in-flight work finish, so that another replica doesn't start on it while we still are
+	c.workqueue.ShutDown()
+	c.groupRestoreQueue.ShutDown()
+	c.restoreQueue.ShutDown()
+	c.policyQueue.ShutDown()
+	c.claimQueue.ShutDown()
+	workers.Wait()
 
 	return nil
 }
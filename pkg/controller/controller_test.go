@@ -17,12 +17,20 @@ package controller
 import (
 	"context"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/fairwindsops/gemini/pkg/kube"
 	"github.com/fairwindsops/gemini/pkg/snapshots"
@@ -50,11 +58,33 @@ func newSnapshotGroup(name, namespace string) *snapshotgroup.SnapshotGroup {
 
 func newTestController() (*Controller, *kube.Client) {
 	kube.SetFakeClient()
-	ctrl := NewController()
-	ctrl.snapshotReadyTimeoutSeconds = 1
+	ctrl := NewController(Options{SnapshotReadyTimeout: time.Second})
+	ctrl.recorder = record.NewFakeRecorder(100)
 	return ctrl, kube.GetClient()
 }
 
+func getEvents(ctrl *Controller) []string {
+	events := []string{}
+	recorder := ctrl.recorder.(*record.FakeRecorder)
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func hasEventWithReason(events []string, reason string) bool {
+	for _, event := range events {
+		if strings.HasPrefix(event, reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
 func TestControllerQueue(t *testing.T) {
 	ctrl, _ := newTestController()
 	sg := newSnapshotGroup("foo", "default")
@@ -63,6 +93,276 @@ func TestControllerQueue(t *testing.T) {
 	assert.Equal(t, true, processed)
 }
 
+func TestHealthChecks(t *testing.T) {
+	ctrl, _ := newTestController()
+	assert.Error(t, ctrl.CheckReady(), "not ready until the caches have synced")
+	assert.NoError(t, ctrl.CheckProgress())
+
+	ctrl.startTime = time.Now().Add(-stalledWorkerTimeout - time.Minute)
+	ctrl.started.Store(true)
+	assert.NoError(t, ctrl.CheckReady())
+	assert.NoError(t, ctrl.CheckProgress(), "an empty queue is not stalled")
+
+	ctrl.enqueue(newSnapshotGroup("foo", "default"), deleteTask)
+	ctrl.enqueue(newSnapshotGroup("bar", "default"), deleteTask)
+	assert.Error(t, ctrl.CheckProgress(), "no worker has finished an item")
+	ctrl.processNextWorkItem()
+	assert.NoError(t, ctrl.CheckProgress())
+}
+
+func TestBackupIsRequeuedWhenDue(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(sg))
+
+	ctrl.enqueue(sg, backupTask)
+	ctrl.enqueue(sg, backupTask)
+	assert.Equal(t, 1, ctrl.workqueue.Len(), "backups of the same group should be deduplicated")
+	assert.True(t, ctrl.processNextWorkItem())
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+
+	assert.Equal(t, 0, ctrl.workqueue.Len())
+	assert.Eventually(t, func() bool {
+		return ctrl.workqueue.Len() == 1
+	}, 3*time.Second, 100*time.Millisecond, "backup should be requeued when the next snapshot is due")
+	assert.True(t, ctrl.processNextWorkItem())
+	snaps, err = snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snaps))
+}
+
+func TestGroupLocks(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(sg))
+	sr := newSnapshotRestore("replace", "default", "foo")
+	_, err = client.SnapshotGroupClient.SnapshotRestores("default").Create(context.TODO(), sr, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Add(sr))
+
+	// Another worker is busy with the group
+	assert.True(t, ctrl.tryLockGroup("default", "foo"))
+	assert.False(t, ctrl.tryLockGroup("default", "foo"))
+	ctrl.enqueue(sg, backupTask)
+	assert.True(t, ctrl.processNextWorkItem())
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Empty(t, snaps, "backups wait for the other worker")
+	requeue, err := ctrl.syncRestore("default/replace")
+	assert.NoError(t, err)
+	assert.Equal(t, groupBusyDelay, requeue)
+	updated, err := client.SnapshotGroupClient.SnapshotRestores("default").Get(context.TODO(), "replace", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, updated.Status.Phase, "SnapshotRestores wait for the other worker")
+
+	ctrl.unlockGroup("default", "foo")
+	assert.Eventually(t, func() bool {
+		return ctrl.workqueue.Len() == 1
+	}, 2*groupBusyDelay, 100*time.Millisecond, "the backup is put off, not dropped")
+	assert.True(t, ctrl.processNextWorkItem())
+	snaps, err = snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+	assert.True(t, ctrl.tryLockGroup("default", "foo"), "the lock is released")
+}
+
+func TestDependentChangesAreEnqueued(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	sg.Spec.Claim.Name = "data"
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(sg))
+	expected := workItem{name: "foo", namespace: "default", task: backupTask}
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", ResourceVersion: "1"}}
+	handler := ctrl.pvcHandler([]cache.Indexer{client.Informers[0].Informer().GetIndexer()})
+	handler.OnUpdate(pvc, pvc)
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "resyncs should be ignored")
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "default/data", Obj: pvc})
+	assert.Equal(t, 1, ctrl.workqueue.Len())
+	item, _ := ctrl.workqueue.Get()
+	assert.Equal(t, expected, item)
+	ctrl.workqueue.Done(item)
+
+	other := pvc.DeepCopy()
+	other.ObjectMeta.Name = "other"
+	handler.OnAdd(other, false)
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "unrelated PVCs should be ignored")
+
+	// Groups with multiple claims are enqueued for the PVCs they match
+	selected := newSnapshotGroup("selected", "default")
+	selected.Spec.Claim.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(selected))
+	sts := newSnapshotGroup("sts", "default")
+	sts.Spec.Claim.StatefulSet = "db"
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(sts))
+	labelled := other.DeepCopy()
+	labelled.ObjectMeta.Labels = map[string]string{"app": "db"}
+	handler.OnAdd(labelled, false)
+	assert.Equal(t, 1, ctrl.workqueue.Len())
+	item, _ = ctrl.workqueue.Get()
+	assert.Equal(t, workItem{name: "selected", namespace: "default", task: backupTask}, item)
+	ctrl.workqueue.Done(item)
+	ordinal := other.DeepCopy()
+	ordinal.ObjectMeta.Name = "data-db-0"
+	handler.OnAdd(ordinal, false)
+	assert.Equal(t, 1, ctrl.workqueue.Len())
+	item, _ = ctrl.workqueue.Get()
+	assert.Equal(t, workItem{name: "sts", namespace: "default", task: backupTask}, item)
+	ctrl.workqueue.Done(item)
+	ordinal.ObjectMeta.Name = "data-dbx-0"
+	handler.OnAdd(ordinal, false)
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "PVCs of other StatefulSets should be ignored")
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetName("foo-1")
+	snapshot.SetNamespace("default")
+	snapshot.SetResourceVersion("1")
+	ctrl.snapshotHandler().OnAdd(snapshot, false)
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "snapshots not managed by Gemini should be ignored")
+	snapshot.SetAnnotations(map[string]string{
+		"app.kubernetes.io/managed-by": "gemini",
+		snapshots.GroupNameAnnotation:  "foo",
+	})
+	ready := snapshot.DeepCopy()
+	ready.SetResourceVersion("2")
+	ctrl.snapshotHandler().OnUpdate(snapshot, ready)
+	assert.Equal(t, 1, ctrl.workqueue.Len())
+	item, _ = ctrl.workqueue.Get()
+	assert.Equal(t, expected, item)
+	ctrl.workqueue.Done(item)
+}
+
+func TestNamespaceStartsMatching(t *testing.T) {
+	kube.Configure(kube.Options{NamespaceSelector: labels.SelectorFromSet(labels.Set{"gemini": "enabled"})})
+	defer kube.Configure(kube.DefaultOptions())
+	ctrl, client := newTestController()
+	assert.NotNil(t, client.NamespaceInformer)
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(newSnapshotGroup("foo", "team-a")))
+
+	old := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", ResourceVersion: "1"}}
+	ns := old.DeepCopy()
+	ns.ObjectMeta.ResourceVersion = "2"
+	ns.ObjectMeta.Labels = map[string]string{"gemini": "enabled"}
+	assert.NoError(t, client.NamespaceInformer.Informer().GetIndexer().Add(ns))
+	handler := ctrl.namespaceHandler()
+	handler.OnUpdate(ns, ns)
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "namespaces that already matched are ignored")
+	handler.OnUpdate(old, ns)
+	assert.Equal(t, 1, ctrl.workqueue.Len())
+	item, _ := ctrl.workqueue.Get()
+	assert.Equal(t, workItem{name: "foo", namespace: "team-a", task: backupTask}, item)
+}
+
+func TestPolicyHandlers(t *testing.T) {
+	ctrl, client := newTestController()
+	isController := true
+	old := newSnapshotGroup("hourly-data", "default")
+	old.ObjectMeta.ResourceVersion = "1"
+	old.ObjectMeta.OwnerReferences = []metav1.OwnerReference{{Kind: snapshotgroup.SnapshotPolicyKind, Name: "hourly", Controller: &isController}}
+	sg := old.DeepCopy()
+	sg.ObjectMeta.ResourceVersion = "2"
+	sg.Status.ObservedGeneration = 1
+	handler := ctrl.policyGroupHandler()
+	handler.OnUpdate(old, sg)
+	assert.Equal(t, 0, ctrl.policyQueue.Len(), "status updates are ignored")
+	sg.ObjectMeta.Generation = 1
+	handler.OnUpdate(old, sg)
+	assert.Equal(t, 1, ctrl.policyQueue.Len())
+	item, _ := ctrl.policyQueue.Get()
+	assert.Equal(t, "hourly", item)
+	ctrl.policyQueue.Done(item)
+
+	policy := &snapshotgroup.SnapshotPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "hourly"},
+		Spec:       snapshotgroup.SnapshotPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}}},
+	}
+	assert.NoError(t, client.PolicyInformer.Informer().GetIndexer().Add(policy))
+	oldNs := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", ResourceVersion: "1", Labels: map[string]string{"env": "staging"}}}
+	ns := oldNs.DeepCopy()
+	ns.ObjectMeta.ResourceVersion = "2"
+	nsHandler := ctrl.policyNamespaceHandler()
+	nsHandler.OnUpdate(oldNs, ns)
+	assert.Equal(t, 0, ctrl.policyQueue.Len(), "namespaces whose labels didn't change are ignored")
+	ns.ObjectMeta.Labels["env"] = "prod"
+	nsHandler.OnUpdate(oldNs, ns)
+	assert.Equal(t, 1, ctrl.policyQueue.Len())
+}
+
+func TestEnrolledGroupHandler(t *testing.T) {
+	ctrl, _ := newTestController()
+	old := newSnapshotGroup("data", "default")
+	old.ObjectMeta.ResourceVersion = "1"
+	old.ObjectMeta.Annotations[snapshots.EnrolledClaimAnnotation] = "data"
+	sg := old.DeepCopy()
+	sg.ObjectMeta.ResourceVersion = "2"
+	sg.Status.ObservedGeneration = 1
+	handler := ctrl.enrolledGroupHandler()
+	handler.OnUpdate(old, old)
+	handler.OnUpdate(old, sg)
+	assert.Equal(t, 0, ctrl.claimQueue.Len(), "resyncs and status updates are ignored")
+	sg.ObjectMeta.Generation = 1
+	handler.OnUpdate(old, sg)
+	assert.Equal(t, 1, ctrl.claimQueue.Len())
+	item, _ := ctrl.claimQueue.Get()
+	assert.Equal(t, "default/data", item)
+}
+
+func TestAnnotatedClaimHandler(t *testing.T) {
+	ctrl, _ := newTestController()
+	old := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "data",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{snapshots.ScheduleAnnotation: "hour:24"},
+		},
+	}
+	pvc := old.DeepCopy()
+	pvc.ObjectMeta.ResourceVersion = "2"
+	pvc.Status.Phase = corev1.ClaimBound
+	handler := ctrl.annotatedClaimHandler()
+	handler.OnUpdate(old, old)
+	handler.OnUpdate(old, pvc)
+	assert.Equal(t, 0, ctrl.claimQueue.Len(), "resyncs and status updates are ignored")
+	pvc.ObjectMeta.Annotations[snapshots.ScheduleAnnotation] = "day:7"
+	handler.OnUpdate(old, pvc)
+	assert.Equal(t, 1, ctrl.claimQueue.Len())
+	item, _ := ctrl.claimQueue.Get()
+	assert.Equal(t, "default/data", item)
+}
+
+func TestPoliciesNotWatched(t *testing.T) {
+	kube.SetFakeClient().PolicyInformer = nil
+	ctrl := NewController(Options{SnapshotReadyTimeout: time.Second})
+	assert.Empty(t, ctrl.policySynced)
+	assert.NoError(t, ctrl.syncPolicy("hourly"))
+	assert.Empty(t, snapshots.GetPoliciesForClaim(map[string]string{"tier": "prod"}))
+}
+
+func TestStatusUpdatesAreIgnored(t *testing.T) {
+	old := newSnapshotGroup("foo", "default")
+	old.ObjectMeta.ResourceVersion = "1"
+	sg := old.DeepCopy()
+	sg.ObjectMeta.ResourceVersion = "2"
+	sg.Status.ObservedGeneration = 1
+	assert.True(t, isStatusUpdate(old, sg))
+	assert.False(t, isStatusUpdate(old, old))
+
+	deleting := sg.DeepCopy()
+	now := metav1.Now()
+	deleting.ObjectMeta.DeletionTimestamp = &now
+	assert.False(t, isStatusUpdate(old, deleting))
+
+	sg.ObjectMeta.Generation = 1
+	assert.False(t, isStatusUpdate(old, sg))
+}
+
 func TestBackupHandler(t *testing.T) {
 	ctrl, client := newTestController()
 
@@ -93,6 +393,22 @@ func TestBackupHandler(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "gemini", pvc.ObjectMeta.Annotations["app.kubernetes.io/managed-by"])
 
+	events := getEvents(ctrl)
+	assert.Equal(t, 2, len(events))
+	assert.Contains(t, events[0], "Normal SnapshotCreated Created snapshot "+snaps[0].Name)
+
+	updated, err := client.SnapshotGroupClient.SnapshotGroups("foo").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(updated.Status.Snapshots))
+	assert.Equal(t, snaps[0].Name, updated.Status.Snapshots[0].Name)
+	assert.Equal(t, 1, len(updated.Status.NextSnapshots))
+	assert.Equal(t, "1 second", updated.Status.NextSnapshots[0].Interval)
+	ready := apimeta.FindStatusCondition(updated.Status.Conditions, snapshotgroup.ConditionReady)
+	assert.NotNil(t, ready)
+	assert.Equal(t, metav1.ConditionFalse, ready.Status)
+	assert.Equal(t, "SnapshotNotReady", ready.Reason)
+	assert.True(t, apimeta.IsStatusConditionFalse(updated.Status.Conditions, snapshotgroup.ConditionSnapshotFailing))
+
 	time.Sleep(time.Second)
 	err = ctrl.syncHandler(event)
 	assert.NoError(t, err)
@@ -117,6 +433,9 @@ func TestBackupHandler(t *testing.T) {
 	assert.Equal(t, []string{"1 second"}, snaps[1].Intervals)
 	assert.Equal(t, secondTS, snaps[1].Timestamp)
 	assert.NotEqual(t, firstTS, snaps[0].Timestamp)
+
+	events = getEvents(ctrl)
+	assert.Contains(t, events, "Normal SnapshotDeleted Deleted expired snapshot foo-"+strconv.Itoa(int(firstTS.Unix())))
 }
 
 func TestRestoreHandler(t *testing.T) {
@@ -163,6 +482,11 @@ func TestRestoreHandler(t *testing.T) {
 	assert.Equal(t, "gemini", pvc.ObjectMeta.Annotations["app.kubernetes.io/managed-by"])
 	assert.Equal(t, timestamp, pvc.ObjectMeta.Annotations["gemini.fairwinds.com/restore"])
 
+	events := getEvents(ctrl)
+	assert.Contains(t, events, "Normal RestoreStarted Restoring PVC foo to "+timestamp)
+	assert.True(t, hasEventWithReason(events, "Warning FailsafeSnapshotTimedOut"))
+	assert.Contains(t, events, "Normal RestoreCompleted Restored PVC foo to "+timestamp)
+
 	snaps, err = snapshots.ListSnapshots(sg)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(snaps))
@@ -170,6 +494,362 @@ func TestRestoreHandler(t *testing.T) {
 	assert.Equal(t, []string{}, snaps[0].Intervals)
 }
 
+func TestInterruptedRestore(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	sg.Spec.Schedule[0].Every = "1 day"
+	sgClient := client.SnapshotGroupClient.SnapshotGroups("default")
+	_, err := sgClient.Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+	sg.ObjectMeta.Annotations[snapshots.RestoreAnnotation] = strconv.Itoa(int(snaps[0].Timestamp.Unix()))
+	sg, err = sgClient.Update(context.TODO(), sg, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: restoreTask}))
+	restored, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	restored.ObjectMeta.UID = "restored"
+	restored, err = client.K8s.CoreV1().PersistentVolumeClaims("default").Update(context.TODO(), restored, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	// The cache still says the restore is in progress, but it has finished
+	stale, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	apimeta.SetStatusCondition(&stale.Status.Conditions, metav1.Condition{Type: snapshotgroup.ConditionRestoring, Status: metav1.ConditionTrue, Reason: "RestoreInProgress"})
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: stale, task: backupTask}))
+	assert.Equal(t, 0, ctrl.groupRestoreQueue.Len(), "finished restores are not resumed")
+
+	// The controller stopped after restoring the PVC, but before recording it
+	_, err = sgClient.UpdateStatus(context.TODO(), stale, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: stale, task: backupTask}))
+	assert.Equal(t, 1, ctrl.groupRestoreQueue.Len(), "interrupted restores are resumed by the restore workers")
+	assert.True(t, ctrl.processNextGroupRestore())
+	pvc, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, restored.ObjectMeta.UID, pvc.ObjectMeta.UID, "the restored PVC is not restored again")
+	updated, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, apimeta.IsStatusConditionFalse(updated.Status.Conditions, snapshotgroup.ConditionRestoring))
+	assert.Equal(t, 1, ctrl.workqueue.Len(), "backups are scheduled once the restore finishes")
+}
+
+func TestRestoreToNewPVC(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	sg.Spec.Schedule[0].Every = "1 day"
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	event := workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}
+	assert.NoError(t, ctrl.syncHandler(event))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+	original, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	timestamp := strconv.Itoa(int(snaps[0].Timestamp.Unix()))
+	sg.ObjectMeta.Annotations[snapshots.RestoreAnnotation] = timestamp
+	sg.ObjectMeta.Annotations[snapshots.RestoreTargetAnnotation] = "foo-copy"
+	event.task = restoreTask
+	assert.NoError(t, ctrl.syncHandler(event))
+
+	restored, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo-copy", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snaps[0].Name, restored.Spec.DataSource.Name)
+	assert.Equal(t, "default/"+snaps[0].Name, restored.ObjectMeta.Annotations[snapshots.RestoredFromAnnotation])
+	unchanged, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, original, unchanged, "the original PVC is untouched")
+	after, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(after), "no failsafe snapshot is needed")
+	assert.Contains(t, getEvents(ctrl), "Normal RestoreCompleted Restored "+timestamp+" into new PVC default/foo-copy")
+	assert.NoError(t, ctrl.syncHandler(event), "restoring again is a no-op")
+
+	sg.ObjectMeta.Annotations[snapshots.RestoreTargetAnnotation] = "foo"
+	assert.Error(t, ctrl.syncHandler(event), "the PVC being backed up is never replaced")
+
+	sg.ObjectMeta.Annotations[snapshots.RestoreTargetAnnotation] = "other/foo-copy"
+	assert.Error(t, ctrl.syncHandler(event), "snapshots must be ready to copy to another namespace")
+
+	snapshot, err := client.SnapshotClient.Namespace("default").Get(context.TODO(), snaps[0].Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse"))
+	assert.NoError(t, unstructured.SetNestedField(snapshot.Object, "content-1", "status", "boundVolumeSnapshotContentName"))
+	_, err = client.SnapshotClient.Namespace("default").Update(context.TODO(), snapshot, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshotContent",
+		"metadata":   map[string]interface{}{"name": "content-1"},
+		"spec":       map[string]interface{}{"driver": "csi.example.com", "deletionPolicy": "Delete"},
+		"status":     map[string]interface{}{"snapshotHandle": "handle-1"},
+	}}
+	_, err = client.SnapshotContentClient.Create(context.TODO(), content, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, ctrl.syncHandler(event), "the target namespace doesn't exist")
+	other, err := client.K8s.CoreV1().Namespaces().Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, ctrl.syncHandler(event), "the target namespace must allow restores")
+	other.ObjectMeta.Annotations = map[string]string{snapshots.AllowRestoreFromAnnotation: "kube-system, default"}
+	_, err = client.K8s.CoreV1().Namespaces().Update(context.TODO(), other, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(event))
+	assert.NoError(t, ctrl.syncHandler(event), "restoring again is a no-op")
+
+	restored, err = client.K8s.CoreV1().PersistentVolumeClaims("other").Get(context.TODO(), "foo-copy", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snaps[0].Name, restored.Spec.DataSource.Name)
+	assert.Equal(t, "default/foo", restored.ObjectMeta.Annotations[snapshots.RestoredForAnnotation])
+	snapshotCopy, err := client.SnapshotClient.Namespace("other").Get(context.TODO(), snaps[0].Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	contentName, _, _ := unstructured.NestedString(snapshotCopy.Object, "spec", "source", "volumeSnapshotContentName")
+	contentCopy, err := client.SnapshotContentClient.Get(context.TODO(), contentName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	handle, _, _ := unstructured.NestedString(contentCopy.Object, "spec", "source", "snapshotHandle")
+	assert.Equal(t, "handle-1", handle)
+	policy, _, _ := unstructured.NestedString(contentCopy.Object, "spec", "deletionPolicy")
+	assert.Equal(t, "Retain", policy)
+	ref, _, _ := unstructured.NestedString(contentCopy.Object, "spec", "volumeSnapshotRef", "namespace")
+	assert.Equal(t, "other", ref)
+
+	// The copy is deleted once the restored PVC is bound
+	assert.NoError(t, client.GetSnapshotInformer("other").GetIndexer().Add(snapshotCopy))
+	assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Add(restored))
+	event.task = backupTask
+	assert.NoError(t, ctrl.syncHandler(event))
+	_, err = client.SnapshotClient.Namespace("other").Get(context.TODO(), snaps[0].Name, metav1.GetOptions{})
+	assert.NoError(t, err, "the copy is kept until the PVC is bound")
+	restored.Status.Phase = corev1.ClaimBound
+	assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Update(restored))
+	assert.NoError(t, ctrl.syncHandler(event))
+	_, err = client.SnapshotClient.Namespace("other").Get(context.TODO(), snaps[0].Name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	_, err = client.SnapshotContentClient.Get(context.TODO(), contentName, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	_, err = client.SnapshotContentClient.Get(context.TODO(), "content-1", metav1.GetOptions{})
+	assert.NoError(t, err, "the original content is kept")
+}
+
+func newSnapshotRestore(name, namespace, group string) *snapshotgroup.SnapshotRestore {
+	return &snapshotgroup.SnapshotRestore{
+		TypeMeta: metav1.TypeMeta{APIVersion: snapshotgroup.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: snapshotgroup.SnapshotRestoreSpec{
+			SnapshotGroup: group,
+		},
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctrl, client := newTestController()
+	ctrl.snapshotReadyTimeoutSeconds = 0
+	sg := newSnapshotGroup("foo", "default")
+	sg.Spec.Schedule[0].Every = "1 day"
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+	snapshot, err := client.SnapshotClient.Namespace("default").Get(context.TODO(), snaps[0].Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse"))
+	_, err = client.SnapshotClient.Namespace("default").Update(context.TODO(), snapshot, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	srClient := client.SnapshotGroupClient.SnapshotRestores("default")
+	create := func(sr *snapshotgroup.SnapshotRestore) {
+		_, err := srClient.Create(context.TODO(), sr, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Add(sr))
+	}
+	get := func(name string) *snapshotgroup.SnapshotRestore {
+		sr, err := srClient.Get(context.TODO(), name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		return sr
+	}
+	// syncRestore reconciles a SnapshotRestore, then updates the cache as the informer would
+	syncRestore := func(name string) (time.Duration, error) {
+		requeue, err := ctrl.syncRestore("default/" + name)
+		assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Update(get(name)))
+		return requeue, err
+	}
+
+	create(newSnapshotRestore("replace", "default", "foo"))
+	requeue, err := syncRestore("replace")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, requeue, "waits for the PVC to be deleted")
+	sr := get("replace")
+	assert.Equal(t, snapshotgroup.RestorePhaseDeletingPVC, sr.Status.Phase)
+	assert.Equal(t, snaps[0].Name, sr.Status.Snapshot, "the newest ready snapshot is restored")
+	assert.NotEmpty(t, sr.Status.FailsafeSnapshot)
+	assert.NotNil(t, sr.Status.StartTime)
+	_, err = client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Error(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}), "the PVC is not recreated while it is restored")
+	assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Update(newSnapshotRestore("replace", "default", "foo")))
+	assert.Error(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}), "the phase of the restore is read from the API, not the cache")
+
+	requeue, err = syncRestore("replace")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), requeue)
+	sr = get("replace")
+	assert.Equal(t, snapshotgroup.RestorePhaseCompleted, sr.Status.Phase)
+	assert.NotNil(t, sr.Status.CompletionTime)
+	assert.Equal(t, "default/foo", sr.Status.PersistentVolumeClaim)
+	phases := []string{}
+	for _, transition := range sr.Status.History {
+		phases = append(phases, transition.Phase)
+	}
+	assert.Equal(t, []string{"Pending", "FailsafeSnapshotting", "DeletingPVC", "Restoring", "Completed"}, phases)
+	restored, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snaps[0].Name, restored.Spec.DataSource.Name)
+	events := getEvents(ctrl)
+	assert.Contains(t, events, "Warning FailsafeSnapshotTimedOut Failsafe snapshot "+sr.Status.FailsafeSnapshot+" was not ready after 0s, proceeding with restore anyway")
+	assert.Contains(t, events, "Normal RestoreCompleted Restored "+snaps[0].Name+" into PVC default/foo")
+	assert.Contains(t, events, "Normal RestoreCompleted SnapshotRestore replace: Restored "+snaps[0].Name+" into PVC default/foo")
+
+	requeue, err = syncRestore("replace")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), requeue)
+	assert.Equal(t, sr, get("replace"), "finished restores are never reprocessed")
+
+	copyRestore := newSnapshotRestore("copy", "default", "foo")
+	copyRestore.Spec.Strategy = snapshotgroup.RestoreStrategyNewPVC
+	copyRestore.Spec.Target = "foo-copy"
+	copyRestore.Spec.Snapshot.RestorePoint = strings.TrimPrefix(snaps[0].Name, "foo-")
+	create(copyRestore)
+	_, err = syncRestore("copy")
+	assert.NoError(t, err)
+	sr = get("copy")
+	assert.Equal(t, snapshotgroup.RestorePhaseCompleted, sr.Status.Phase)
+	assert.Equal(t, "default/foo-copy", sr.Status.PersistentVolumeClaim)
+	assert.Empty(t, sr.Status.FailsafeSnapshot)
+	restored, err = client.K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo-copy", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snaps[0].Name, restored.Spec.DataSource.Name)
+
+	create(newSnapshotRestore("missing", "default", "bar"))
+	_, err = syncRestore("missing")
+	assert.NoError(t, err)
+	sr = get("missing")
+	assert.Equal(t, snapshotgroup.RestorePhaseFailed, sr.Status.Phase)
+	assert.Equal(t, "SnapshotGroup bar not found", sr.Status.Message)
+	assert.Contains(t, getEvents(ctrl), "Warning RestoreFailed Restore failed: SnapshotGroup bar not found")
+
+	badSnapshot := newSnapshotRestore("bad-snapshot", "default", "foo")
+	badSnapshot.Spec.Snapshot.Name = "foo-0"
+	create(badSnapshot)
+	_, err = syncRestore("bad-snapshot")
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotgroup.RestorePhaseFailed, get("bad-snapshot").Status.Phase)
+}
+
+func TestSnapshotRestoresRunOneAtATime(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "default")
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+
+	first := newSnapshotRestore("first", "default", "foo")
+	first.ObjectMeta.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute))
+	first.Status.Phase = snapshotgroup.RestorePhaseDeletingPVC
+	second := newSnapshotRestore("second", "default", "foo")
+	second.ObjectMeta.CreationTimestamp = metav1.Now()
+	second.Spec.Snapshot.Name = snaps[0].Name
+	for _, sr := range []*snapshotgroup.SnapshotRestore{first, second} {
+		_, err := client.SnapshotGroupClient.SnapshotRestores("default").Create(context.TODO(), sr, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Add(sr))
+	}
+	requeue, err := ctrl.syncRestore("default/second")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, requeue)
+	sr, err := client.SnapshotGroupClient.SnapshotRestores("default").Get(context.TODO(), "second", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotgroup.RestorePhasePending, sr.Status.Phase)
+}
+
+func TestSnapshotRestoreQuiescesWorkloads(t *testing.T) {
+	ctrl, client := newTestController()
+	ctrl.snapshotReadyTimeoutSeconds = 0
+	sg := newSnapshotGroup("foo", "default")
+	sg.Spec.Schedule[0].Every = "1 day"
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, ctrl.syncHandler(workItem{name: "foo", namespace: "default", snapshotGroup: sg, task: backupTask}))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+
+	replicas := int32(2)
+	_, err = client.K8s.AppsV1().StatefulSets("default").Create(context.TODO(), &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	isController := true
+	_, err = client.K8s.CoreV1().Pods("default").Create(context.TODO(), &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "db-0",
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &isController}},
+		},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name:         "data",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "foo"}},
+		}}},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	sr := newSnapshotRestore("replace", "default", "foo")
+	sr.Spec.Snapshot.Name = snaps[0].Name
+	_, err = client.SnapshotGroupClient.SnapshotRestores("default").Create(context.TODO(), sr, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.RestoreInformers[0].Informer().GetIndexer().Add(sr))
+	getStatefulSet := func() *appsv1.StatefulSet {
+		statefulSet, err := client.K8s.AppsV1().StatefulSets("default").Get(context.TODO(), "db", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return statefulSet
+	}
+
+	requeue, err := ctrl.syncRestore("default/replace")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, requeue, "waits for pods to terminate")
+	assert.Equal(t, int32(0), *getStatefulSet().Spec.Replicas)
+	assert.Equal(t, "2", getStatefulSet().ObjectMeta.Annotations[snapshots.OriginalReplicasAnnotation])
+	restore, err := client.SnapshotGroupClient.SnapshotRestores("default").Get(context.TODO(), "replace", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotgroup.RestorePhaseFailsafeSnapshotting, restore.Status.Phase)
+	assert.Empty(t, restore.Status.FailsafeSnapshot, "the failsafe snapshot waits for the PVC to be unused")
+
+	assert.NoError(t, client.K8s.CoreV1().Pods("default").Delete(context.TODO(), "db-0", metav1.DeleteOptions{}))
+	_, err = ctrl.syncRestore("default/replace")
+	assert.NoError(t, err)
+	_, err = ctrl.syncRestore("default/replace")
+	assert.NoError(t, err)
+	restore, err = client.SnapshotGroupClient.SnapshotRestores("default").Get(context.TODO(), "replace", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotgroup.RestorePhaseCompleted, restore.Status.Phase)
+	assert.Equal(t, int32(2), *getStatefulSet().Spec.Replicas, "the original replica count is restored")
+	assert.NotContains(t, getStatefulSet().ObjectMeta.Annotations, snapshots.QuiescedByAnnotation)
+	events := getEvents(ctrl)
+	assert.Contains(t, events, "Normal WorkloadScaledDown Scaled down StatefulSet db from 2 replicas to restore PVC foo")
+	assert.Contains(t, events, "Normal WorkloadScaledUp Scaled StatefulSet db back up to 2 replicas")
+}
+
 func TestDeleteHandler(t *testing.T) {
 	ctrl, _ := newTestController()
 
@@ -183,10 +863,172 @@ func TestDeleteHandler(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestManualSnapshot(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "foo")
+	sg.Spec.Schedule[0].Every = "1 day"
+	sg.Spec.KeepManual = 1
+	sgClient := client.SnapshotGroupClient.SnapshotGroups("foo")
+	_, err := sgClient.Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	getManualSnapshots := func() []*snapshots.GeminiSnapshot {
+		snaps, err := snapshots.ListSnapshots(sg)
+		assert.NoError(t, err)
+		manual := []*snapshots.GeminiSnapshot{}
+		for _, snap := range snaps {
+			if snap.Manual != "" {
+				manual = append(manual, snap)
+			}
+		}
+		return manual
+	}
+
+	event := workItem{name: "foo", namespace: "foo", snapshotGroup: sg, task: backupTask}
+	assert.NoError(t, ctrl.syncHandler(event))
+	assert.Equal(t, 0, len(getManualSnapshots()))
+
+	sg.ObjectMeta.Annotations[snapshots.SnapshotNowAnnotation] = "first"
+	assert.NoError(t, ctrl.syncHandler(event))
+	manual := getManualSnapshots()
+	assert.Equal(t, 1, len(manual))
+	assert.Equal(t, "first", manual[0].Manual)
+	assert.True(t, strings.HasSuffix(manual[0].Name, "-manual"))
+	assert.Contains(t, getEvents(ctrl), "Normal SnapshotCreated Created manual snapshot "+manual[0].Name+" for first")
+	updated, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", updated.Status.LastManualSnapshot)
+
+	// The status in the work item is out of date, but the token was already handled
+	assert.NoError(t, ctrl.syncHandler(event))
+	assert.Equal(t, 1, len(getManualSnapshots()))
+	event.snapshotGroup = updated
+	assert.NoError(t, ctrl.syncHandler(event))
+	assert.Equal(t, 1, len(getManualSnapshots()))
+
+	time.Sleep(time.Second)
+	updated.ObjectMeta.Annotations[snapshots.SnapshotNowAnnotation] = "second"
+	// Make creating the manual snapshot fail, by taking its name
+	blockers := []string{}
+	for offset := int64(0); offset < 3; offset++ {
+		name := "foo-" + strconv.FormatInt(time.Now().Unix()+offset, 10) + "-manual"
+		blocker := &unstructured.Unstructured{}
+		blocker.SetName(name)
+		blocker.SetNamespace("foo")
+		_, err := client.SnapshotClient.Namespace("foo").Create(context.TODO(), blocker, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		blockers = append(blockers, name)
+	}
+	assert.Error(t, ctrl.syncHandler(event))
+	manual = getManualSnapshots()
+	assert.Equal(t, 1, len(manual), "manual snapshots are only pruned once the new one is created")
+	assert.Equal(t, "first", manual[0].Manual)
+	for _, name := range blockers {
+		assert.NoError(t, client.SnapshotClient.Namespace("foo").Delete(context.TODO(), name, metav1.DeleteOptions{}))
+	}
+
+	assert.NoError(t, ctrl.syncHandler(event))
+	manual = getManualSnapshots()
+	assert.Equal(t, 1, len(manual), "older manual snapshots expire")
+	assert.Equal(t, "second", manual[0].Manual)
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snaps), "scheduled snapshots are unaffected")
+}
+
+func TestSuspendedSnapshotGroup(t *testing.T) {
+	ctrl, client := newTestController()
+	sg := newSnapshotGroup("foo", "foo")
+	sg.Spec.Suspend = true
+	sgClient := client.SnapshotGroupClient.SnapshotGroups("foo")
+	_, err := sgClient.Create(context.Background(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	event := workItem{name: "foo", namespace: "foo", snapshotGroup: sg, task: backupTask}
+	assert.NoError(t, ctrl.syncHandler(event))
+	snaps, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snaps))
+	assert.Equal(t, 0, ctrl.workqueue.Len(), "suspended groups are not requeued")
+	updated, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, apimeta.IsStatusConditionTrue(updated.Status.Conditions, snapshotgroup.ConditionSuspended))
+	assert.Empty(t, updated.Status.NextSnapshots)
+
+	sg.Spec.Suspend = false
+	assert.NoError(t, ctrl.syncHandler(event))
+	snaps, err = snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snaps))
+	updated, err = sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, apimeta.IsStatusConditionFalse(updated.Status.Conditions, snapshotgroup.ConditionSuspended))
+
+	sg.Spec.Suspend = true
+	sg.Spec.Schedule[0].Keep = 0
+	time.Sleep(time.Second)
+	assert.NoError(t, ctrl.syncHandler(event))
+	remaining, err := snapshots.ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(remaining), "existing snapshots are kept while suspended")
+	assert.Equal(t, snaps[0].Name, remaining[0].Name)
+}
+
+func TestDeletionPolicy(t *testing.T) {
+	policies := map[string]struct {
+		finalizer bool
+		snapshots int
+		pvc       bool
+	}{
+		snapshotgroup.DeletionPolicyRetain:       {finalizer: false, snapshots: 2, pvc: true},
+		snapshotgroup.DeletionPolicyDelete:       {finalizer: true, snapshots: 0, pvc: false},
+		snapshotgroup.DeletionPolicyRetainLatest: {finalizer: true, snapshots: 1, pvc: true},
+	}
+	for policy, expected := range policies {
+		t.Run(policy, func(t *testing.T) {
+			ctrl, client := newTestController()
+			sg := newSnapshotGroup("foo", "foo")
+			sg.Spec.DeletionPolicy = policy
+			sgClient := client.SnapshotGroupClient.SnapshotGroups("foo")
+			_, err := sgClient.Create(context.Background(), sg, metav1.CreateOptions{})
+			assert.NoError(t, err)
+
+			event := workItem{name: "foo", namespace: "foo", snapshotGroup: sg, task: backupTask}
+			assert.NoError(t, ctrl.syncHandler(event))
+			time.Sleep(time.Second)
+			assert.NoError(t, ctrl.syncHandler(event))
+			snaps, err := snapshots.ListSnapshots(sg)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(snaps))
+
+			deleting, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, expected.finalizer, len(deleting.ObjectMeta.Finalizers) == 1)
+			now := metav1.Now()
+			deleting.ObjectMeta.DeletionTimestamp = &now
+			event.snapshotGroup = deleting
+			assert.NoError(t, ctrl.syncHandler(event))
+
+			remaining, err := snapshots.ListSnapshots(sg)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.snapshots, len(remaining))
+			if expected.snapshots == 1 {
+				assert.Equal(t, snaps[0].Name, remaining[0].Name)
+			}
+			_, err = client.K8s.CoreV1().PersistentVolumeClaims("foo").Get(context.TODO(), "foo", metav1.GetOptions{})
+			assert.Equal(t, expected.pvc, err == nil)
+			updated, err := sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Empty(t, updated.ObjectMeta.Finalizers)
+		})
+	}
+}
+
 func TestPreexistingPVC(t *testing.T) {
 	ctrl, client := newTestController()
 
 	namespace := "default"
+	storageClass := "fast"
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "pre-existing",
@@ -195,6 +1037,10 @@ func TestPreexistingPVC(t *testing.T) {
 				"app.kubernetes.io/managed-by": "me",
 			},
 		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			VolumeName:       "pv-1",
+		},
 	}
 	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(namespace)
 	_, err := pvcClient.Create(context.TODO(), pvc, metav1.CreateOptions{})
@@ -239,6 +1085,13 @@ func TestPreexistingPVC(t *testing.T) {
 	assert.Equal(t, "me", existingPVC.ObjectMeta.Annotations["app.kubernetes.io/managed-by"])
 	assert.Equal(t, "", existingPVC.ObjectMeta.Annotations["gemini.fairwinds.com/restore"])
 
+	updated, err := client.SnapshotGroupClient.SnapshotGroups(namespace).Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.PersistentVolumeClaimSpec{}, updated.Spec.Claim.Spec, "spec should not be modified")
+	assert.NotNil(t, updated.Status.ClaimSpec)
+	assert.Equal(t, "fast", *updated.Status.ClaimSpec.StorageClassName)
+	assert.Equal(t, "", updated.Status.ClaimSpec.VolumeName)
+
 	time.Sleep(time.Second)
 	timestamp := strconv.Itoa(int(snaps[0].Timestamp.Unix()))
 	sg.ObjectMeta.Annotations["gemini.fairwinds.com/restore"] = timestamp
@@ -253,4 +1106,7 @@ func TestPreexistingPVC(t *testing.T) {
 	assert.Equal(t, "pre-existing", newPVC.ObjectMeta.Name)
 	assert.Equal(t, "gemini", newPVC.ObjectMeta.Annotations["app.kubernetes.io/managed-by"])
 	assert.Equal(t, timestamp, newPVC.ObjectMeta.Annotations["gemini.fairwinds.com/restore"])
+	assert.Equal(t, "fast", *newPVC.Spec.StorageClassName, "restore should use the recorded spec")
+	assert.Equal(t, "", newPVC.Spec.VolumeName)
+	assert.Equal(t, "foo-"+timestamp, newPVC.Spec.DataSource.Name)
 }
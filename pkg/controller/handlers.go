@@ -0,0 +1,168 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/snapshots"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// claimNameIndex indexes SnapshotGroups by the namespace and name of the PVC they back up
+const claimNameIndex = "claimName"
+
+// multipleClaimsKey is the name SnapshotGroups with multiple claims are indexed under, since their PVCs can't be known
+// from the SnapshotGroup alone. It isn't a valid PVC name
+const multipleClaimsKey = "*"
+
+func indexByClaimName(obj interface{}) ([]string, error) {
+	sg, ok := obj.(*snapshotgroup.SnapshotGroup)
+	if !ok {
+		return nil, nil
+	}
+	if snapshots.HasMultipleClaims(sg) {
+		return []string{sg.ObjectMeta.Namespace + "/" + multipleClaimsKey}, nil
+	}
+	return []string{sg.ObjectMeta.Namespace + "/" + snapshots.GetPVCName(sg)}, nil
+}
+
+// getObjectMeta returns the metadata of an object from an event handler, which may be a tombstone
+func getObjectMeta(obj interface{}) (metav1.Object, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	acc, err := meta.Accessor(obj)
+	return acc, err == nil
+}
+
+// isResync returns true if an update event is a periodic resync, rather than a change
+func isResync(old, obj interface{}) bool {
+	oldAcc, oldOK := getObjectMeta(old)
+	acc, ok := getObjectMeta(obj)
+	return oldOK && ok && oldAcc.GetResourceVersion() == acc.GetResourceVersion()
+}
+
+// enqueueBackup reconciles a SnapshotGroup after something it depends on changed
+func (c *Controller) enqueueBackup(namespace, name, reason string) {
+	if !kube.GetClient().IsWatched(namespace) {
+		return
+	}
+	klog.V(5).Infof("%s/%s: %s", namespace, name, reason)
+	c.workqueue.Add(workItem{name: name, namespace: namespace, task: backupTask})
+}
+
+// snapshotHandler enqueues the SnapshotGroup that a VolumeSnapshot belongs to when it changes
+func (c *Controller) snapshotHandler() cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		acc, ok := getObjectMeta(obj)
+		if !ok {
+			return
+		}
+		if group := snapshots.GetSnapshotGroupName(acc); group != "" {
+			c.enqueueBackup(acc.GetNamespace(), group, "snapshot "+acc.GetName()+" changed")
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			if !isResync(old, obj) {
+				enqueue(obj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+// pvcHandler enqueues the SnapshotGroups that back up a PVC, or restored it into another namespace, when it changes
+func (c *Controller) pvcHandler(sgIndexers []cache.Indexer) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		acc, ok := getObjectMeta(obj)
+		if !ok {
+			return
+		}
+		for _, indexer := range sgIndexers {
+			sgs, err := indexer.ByIndex(claimNameIndex, acc.GetNamespace()+"/"+acc.GetName())
+			if err != nil {
+				klog.Warningf("%s/%s: could not find SnapshotGroups for PVC - %v", acc.GetNamespace(), acc.GetName(), err)
+				continue
+			}
+			for _, sg := range sgs {
+				if sgAcc, ok := getObjectMeta(sg); ok {
+					c.enqueueBackup(sgAcc.GetNamespace(), sgAcc.GetName(), "PVC "+acc.GetName()+" changed")
+				}
+			}
+			sgs, err = indexer.ByIndex(claimNameIndex, acc.GetNamespace()+"/"+multipleClaimsKey)
+			if err != nil {
+				klog.Warningf("%s/%s: could not find SnapshotGroups for PVC - %v", acc.GetNamespace(), acc.GetName(), err)
+				continue
+			}
+			for _, obj := range sgs {
+				if sg, ok := obj.(*snapshotgroup.SnapshotGroup); ok && snapshots.MatchesClaim(sg, acc) {
+					c.enqueueBackup(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "PVC "+acc.GetName()+" changed")
+				}
+			}
+		}
+		// PVCs restored into another namespace are cleaned up after by the SnapshotGroup that restored them
+		if group := acc.GetAnnotations()[snapshots.RestoredForAnnotation]; group != "" {
+			if namespace, name, err := cache.SplitMetaNamespaceKey(group); err == nil {
+				c.enqueueBackup(namespace, name, "restored PVC "+acc.GetNamespace()+"/"+acc.GetName()+" changed")
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			if !isResync(old, obj) {
+				enqueue(obj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+// namespaceHandler enqueues the SnapshotGroups in a namespace when it starts matching the namespace selector,
+// rather than leaving them until the next resync
+func (c *Controller) namespaceHandler() cache.ResourceEventHandler {
+	client := kube.GetClient()
+	enqueue := func(obj interface{}) {
+		ns, ok := obj.(*corev1.Namespace)
+		if !ok || !client.MatchesNamespaceSelector(ns) {
+			return
+		}
+		sgs, err := client.ListSnapshotGroups(ns.ObjectMeta.Name)
+		if err != nil {
+			klog.Warningf("%s: could not list SnapshotGroups - %v", ns.ObjectMeta.Name, err)
+			return
+		}
+		for _, sg := range sgs {
+			c.enqueueBackup(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "namespace matches the namespace selector")
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		// SnapshotGroups seen before the namespace was are ignored, so they are enqueued when it's added
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			if oldNs, ok := old.(*corev1.Namespace); ok && !client.MatchesNamespaceSelector(oldNs) {
+				enqueue(obj)
+			}
+		},
+	}
+}
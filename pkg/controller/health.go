@@ -0,0 +1,71 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// stalledWorkerTimeout is how long work can wait in a queue without any worker finishing an item before the
+// controller is considered unhealthy. It allows for a restore waiting for workloads to scale down and PVCs to be deleted
+const stalledWorkerTimeout = 15 * time.Minute
+
+// queues returns the controller's workqueues by name
+func (c *Controller) queues() map[string]workqueue.RateLimitingInterface {
+	return map[string]workqueue.RateLimitingInterface{
+		"SnapshotGroups":        c.workqueue,
+		"SnapshotGroupRestores": c.groupRestoreQueue,
+		"SnapshotRestores":      c.restoreQueue,
+		"SnapshotPolicies":      c.policyQueue,
+		"AnnotatedClaims":       c.claimQueue,
+	}
+}
+
+// recordProgress records that a worker finished an item from the named queue
+func (c *Controller) recordProgress(queue string) {
+	c.progress.Store(queue, time.Now())
+}
+
+// CheckReady returns an error until the informer caches have synced and the workers have started
+func (c *Controller) CheckReady() error {
+	if !c.started.Load() {
+		return fmt.Errorf("informer caches have not synced")
+	}
+	return nil
+}
+
+// CheckProgress returns an error if a queue has had work waiting for longer than stalledWorkerTimeout,
+// without a worker finishing any item from it
+func (c *Controller) CheckProgress() error {
+	if !c.started.Load() {
+		return nil
+	}
+	for name, queue := range c.queues() {
+		if queue.Len() == 0 {
+			continue
+		}
+		last, ok := c.progress.Load(name)
+		if !ok {
+			last = c.startTime
+		}
+		if stalled := time.Since(last.(time.Time)); stalled > stalledWorkerTimeout {
+			return fmt.Errorf("%d items are waiting in the %s queue, and no worker has finished one for %s", queue.Len(), name, stalled.Round(time.Second))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	"github.com/fairwindsops/gemini/pkg/snapshots"
+)
+
+const snapshotPolicyTask = "snapshotpolicy"
+
+// policyHandler enqueues SnapshotPolicies when they are created or changed, and on every resync,
+// so that PVCs are enrolled even if an event was missed
+func (c *Controller) policyHandler() cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		c.policyQueue.Add(key)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			enqueue(obj)
+		},
+	}
+}
+
+// policyGroupHandler enqueues the SnapshotPolicy that generated a SnapshotGroup when the group's spec or labels are
+// changed, or it is deleted, so that it is put back in sync with the policy. Status updates are ignored
+func (c *Controller) policyGroupHandler() cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		acc, ok := getObjectMeta(obj)
+		if !ok {
+			return
+		}
+		if policy := snapshots.GetPolicyName(acc); policy != "" {
+			klog.V(5).Infof("%s: SnapshotGroup %s/%s changed", policy, acc.GetNamespace(), acc.GetName())
+			c.policyQueue.Add(policy)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			oldAcc, oldOK := getObjectMeta(old)
+			acc, ok := getObjectMeta(obj)
+			if !oldOK || !ok {
+				return
+			}
+			if oldAcc.GetGeneration() != acc.GetGeneration() ||
+				!reflect.DeepEqual(oldAcc.GetLabels(), acc.GetLabels()) ||
+				!reflect.DeepEqual(oldAcc.GetDeletionTimestamp(), acc.GetDeletionTimestamp()) {
+				enqueue(obj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+// policyNamespaceHandler enqueues the SnapshotPolicies that may select PVCs in a namespace when its labels change,
+// as that can change whether its PVCs are enrolled
+func (c *Controller) policyNamespaceHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			oldAcc, oldOK := getObjectMeta(old)
+			acc, ok := getObjectMeta(obj)
+			if !oldOK || !ok || reflect.DeepEqual(oldAcc.GetLabels(), acc.GetLabels()) {
+				return
+			}
+			for _, nsLabels := range []map[string]string{oldAcc.GetLabels(), acc.GetLabels()} {
+				for _, policy := range snapshots.GetPoliciesForNamespace(nsLabels) {
+					klog.V(5).Infof("%s: labels of namespace %s changed", policy, acc.GetName())
+					c.policyQueue.Add(policy)
+				}
+			}
+		},
+	}
+}
+
+// policyClaimHandler enqueues the SnapshotPolicies whose selector matches a PVC when it is created or deleted,
+// or when its labels change
+func (c *Controller) policyClaimHandler() cache.ResourceEventHandler {
+	enqueue := func(labelSets ...map[string]string) {
+		for _, pvcLabels := range labelSets {
+			for _, policy := range snapshots.GetPoliciesForClaim(pvcLabels) {
+				c.policyQueue.Add(policy)
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if acc, ok := getObjectMeta(obj); ok {
+				enqueue(acc.GetLabels())
+			}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			oldAcc, oldOK := getObjectMeta(old)
+			acc, ok := getObjectMeta(obj)
+			if oldOK && ok && !reflect.DeepEqual(oldAcc.GetLabels(), acc.GetLabels()) {
+				enqueue(oldAcc.GetLabels(), acc.GetLabels())
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if acc, ok := getObjectMeta(obj); ok {
+				enqueue(acc.GetLabels())
+			}
+		},
+	}
+}
+
+func (c *Controller) runPolicyWorker() {
+	for c.processNextPolicy() {
+	}
+}
+
+// processNextPolicy reads a single SnapshotPolicy name off the policy queue and reconciles it
+func (c *Controller) processNextPolicy() bool {
+	obj, shutdown := c.policyQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.recordProgress("SnapshotPolicies")
+	defer c.policyQueue.Done(obj)
+	name, ok := obj.(string)
+	if !ok {
+		c.policyQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in policy queue but got %#v", obj))
+		return true
+	}
+	if err := c.syncPolicy(name); err != nil {
+		c.policyQueue.AddRateLimited(name)
+		utilruntime.HandleError(fmt.Errorf("%s: error syncing SnapshotPolicy: %s, requeuing", name, err.Error()))
+		return true
+	}
+	c.policyQueue.Forget(obj)
+	return true
+}
+
+// syncPolicy reconciles the SnapshotGroups generated from a SnapshotPolicy
+func (c *Controller) syncPolicy(name string) error {
+	start := time.Now()
+	defer func() {
+		metrics.ReconcileDuration.WithLabelValues(snapshotPolicyTask).Observe(time.Since(start).Seconds())
+	}()
+	policy, err := kube.GetClient().GetSnapshotPolicy(name)
+	if errors.IsNotFound(err) {
+		// The SnapshotGroups it generated are garbage collected, as the policy owns them
+		klog.V(5).Infof("%s: skipping deleted SnapshotPolicy", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return snapshots.ReconcileSnapshotPolicy(policy, c.recorder)
+}
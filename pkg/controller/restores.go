@@ -0,0 +1,121 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	"github.com/fairwindsops/gemini/pkg/snapshots"
+)
+
+const snapshotRestoreTask = "snapshotrestore"
+
+// restoreHandler enqueues SnapshotRestores when they are created or changed
+func (c *Controller) restoreHandler() cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		acc, ok := getObjectMeta(obj)
+		if !ok || !kube.GetClient().IsWatched(acc.GetNamespace()) {
+			return
+		}
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		c.restoreQueue.Add(key)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			enqueue(obj)
+		},
+	}
+}
+
+func (c *Controller) runRestoreWorker() {
+	for c.processNextRestore() {
+	}
+}
+
+// processNextRestore reads a single SnapshotRestore key off the restore queue and reconciles it
+func (c *Controller) processNextRestore() bool {
+	obj, shutdown := c.restoreQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.recordProgress("SnapshotRestores")
+	defer c.restoreQueue.Done(obj)
+	key, ok := obj.(string)
+	if !ok {
+		c.restoreQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in restore queue but got %#v", obj))
+		return true
+	}
+	requeue, err := c.syncRestore(key)
+	if err != nil {
+		c.restoreQueue.AddRateLimited(key)
+		utilruntime.HandleError(fmt.Errorf("%s: error syncing SnapshotRestore: %s, requeuing", key, err.Error()))
+		return true
+	}
+	c.restoreQueue.Forget(obj)
+	if requeue > 0 {
+		c.restoreQueue.AddAfter(key, requeue)
+	}
+	return true
+}
+
+// syncRestore reconciles a SnapshotRestore, and returns how long to wait before reconciling it again
+func (c *Controller) syncRestore(key string) (time.Duration, error) {
+	start := time.Now()
+	defer func() {
+		metrics.ReconcileDuration.WithLabelValues(snapshotRestoreTask).Observe(time.Since(start).Seconds())
+	}()
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return 0, nil
+	}
+	client := kube.GetClient()
+	if !client.IsWatched(namespace) {
+		klog.V(5).Infof("%s/%s: skipping SnapshotRestore in unwatched namespace", namespace, name)
+		return 0, nil
+	}
+	sr, err := client.GetSnapshotRestore(namespace, name)
+	if errors.IsNotFound(err) {
+		klog.V(5).Infof("%s/%s: skipping deleted SnapshotRestore", namespace, name)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !c.tryLockGroup(namespace, sr.Spec.SnapshotGroup) {
+		klog.V(5).Infof("%s/%s: putting off SnapshotRestore, another worker is busy with SnapshotGroup %s", namespace, name, sr.Spec.SnapshotGroup)
+		return groupBusyDelay, nil
+	}
+	defer c.unlockGroup(namespace, sr.Spec.SnapshotGroup)
+	requeue, err := snapshots.ReconcileSnapshotRestore(sr, c.snapshotReadyTimeoutSeconds, c.recorder)
+	if err != nil {
+		klog.Errorf("%s/%s: failed to reconcile SnapshotRestore - %v", namespace, name, err)
+	}
+	return requeue, err
+}
@@ -22,10 +22,19 @@ import (
 
 	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 
 	// Import known auth providers
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -44,20 +53,76 @@ const (
 	VolumeSnapshotGroupName = "snapshot.storage.k8s.io"
 	// VolumeSnapshotKind is the kind for VolumeSnapshots
 	VolumeSnapshotKind = "VolumeSnapshot"
+	// VolumeSnapshotContentKind is the kind for VolumeSnapshotContents
+	VolumeSnapshotContentKind = "VolumeSnapshotContent"
+	// volumeSnapshotContentResource is the resource name for VolumeSnapshotContents
+	volumeSnapshotContentResource = "volumesnapshotcontents"
+	// VolumeGroupSnapshotGroupName is the group name for the VolumeGroupSnapshot CRD
+	VolumeGroupSnapshotGroupName = "groupsnapshot.storage.k8s.io"
+	// VolumeGroupSnapshotKind is the kind for VolumeGroupSnapshots
+	VolumeGroupSnapshotKind = "VolumeGroupSnapshot"
 )
 
 // Client provides access to k8s resources
 type Client struct {
 	K8s                   kubernetes.Interface
-	Informer              informers.SnapshotGroupInformer
-	InformerFactory       externalversions.SharedInformerFactory
+	Informers             []informers.SnapshotGroupInformer
+	RestoreInformers      []informers.SnapshotRestoreInformer
+	InformerFactories     []externalversions.SharedInformerFactory
+	SnapshotInformers     map[string]cache.SharedIndexInformer
+	PVCInformers          []coreinformers.PersistentVolumeClaimInformer
 	SnapshotClient        dynamic.NamespaceableResourceInterface
+	SnapshotContentClient dynamic.NamespaceableResourceInterface
 	SnapshotGroupClient   snapshotgroupInterface.SnapshotgroupV1Interface
 	VolumeSnapshotVersion string
+	// GroupSnapshotClient is nil if the cluster doesn't serve the VolumeGroupSnapshot API
+	GroupSnapshotClient        dynamic.NamespaceableResourceInterface
+	VolumeGroupSnapshotVersion string
+	// Executor runs snapshot hooks in Pods
+	Executor PodExecutor
+	// NamespaceInformer is nil unless namespaces are selected by label, or SnapshotPolicies are watched
+	NamespaceInformer coreinformers.NamespaceInformer
+	// PolicyInformer is nil if SnapshotPolicies can't be listed cluster-wide
+	PolicyInformer informers.SnapshotPolicyInformer
+	// StatefulSetInformers are used to find the PVCs of SnapshotGroups that back up a StatefulSet
+	StatefulSetInformers []appsinformers.StatefulSetInformer
+
+	snapshotInformerFactories []dynamicinformer.DynamicSharedInformerFactory
+	pvcInformerFactories      []kubeinformers.SharedInformerFactory
+	kubeInformerFactory       kubeinformers.SharedInformerFactory
+	namespaceSelector         labels.Selector
+}
+
+// Options configures the Client created by GetClient
+type Options struct {
+	// ResyncPeriod is how often the SnapshotGroup informer resyncs. Backups are scheduled for when they are due,
+	// so this only acts as a safety net
+	ResyncPeriod time.Duration
+	// CreateCRD creates the SnapshotGroup, SnapshotRestore and SnapshotPolicy CRDs if they are missing
+	CreateCRD bool
+	// Namespaces restricts the controller to SnapshotGroups in these namespaces. All namespaces are watched if empty
+	Namespaces []string
+	// NamespaceSelector restricts the controller to SnapshotGroups in namespaces with matching labels
+	NamespaceSelector labels.Selector
+}
+
+// DefaultOptions returns the Options used if Configure is never called
+func DefaultOptions() Options {
+	return Options{
+		ResyncPeriod: time.Minute * 10,
+		CreateCRD:    os.Getenv("GEMINI_CREATE_CRD") != "",
+	}
 }
 
 var singleton *Client
 
+var options = DefaultOptions()
+
+// Configure sets the Options used to create the Client singleton. It must be called before GetClient
+func Configure(opts Options) {
+	options = opts
+}
+
 // GetClient creates a new Client singleton
 func GetClient() *Client {
 	if singleton == nil {
@@ -84,23 +149,11 @@ func createClient() *Client {
 		panic(err)
 	}
 
-	informerFactory := externalversions.NewSharedInformerFactory(sgClientSet, time.Second*30)
-	informer := informerFactory.Snapshotgroup().V1().SnapshotGroups()
-
 	resources, err := restmapper.GetAPIGroupResources(k8s.Discovery())
 	if err != nil {
 		panic(err)
 	}
 	restMapper := restmapper.NewDiscoveryRESTMapper(resources)
-	snapshotCRD, err := extClientSet.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), "volumesnapshots."+VolumeSnapshotGroupName, metav1.GetOptions{})
-	if err != nil {
-		panic(err)
-	}
-	volumeSnapshotVersion, err := getVolumeSnapshotVersion(snapshotCRD.Spec.Versions)
-	if err != nil {
-		panic(err)
-	}
-
 	vsMapping, err := restMapper.RESTMapping(schema.GroupKind{
 		Group: VolumeSnapshotGroupName,
 		Kind:  VolumeSnapshotKind,
@@ -108,32 +161,67 @@ func createClient() *Client {
 	if err != nil {
 		panic(err)
 	}
+	var volumeSnapshotVersion string
+	snapshotCRD, err := extClientSet.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), "volumesnapshots."+VolumeSnapshotGroupName, metav1.GetOptions{})
+	if apierrors.IsForbidden(err) {
+		// Without cluster-wide permissions, use the preferred version from discovery
+		klog.V(3).Infof("Could not get the VolumeSnapshot CRD, using version %s from discovery - %v", vsMapping.Resource.Version, err)
+		volumeSnapshotVersion = vsMapping.Resource.Version
+	} else if err != nil {
+		panic(err)
+	} else {
+		volumeSnapshotVersion, err = getServedVersion(snapshotCRD.Spec.Versions, VolumeSnapshotGroupName)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	dynamicInterface, err := dynamic.NewForConfig(kubeConf)
 	if err != nil {
 		panic(err)
 	}
 	snapshotClient := dynamicInterface.Resource(vsMapping.Resource)
 
-	if os.Getenv("GEMINI_CREATE_CRD") != "" {
+	if options.CreateCRD {
 		if _, err = snapshotgroupv1.CreateCustomResourceDefinition("crd-ns", extClientSet); err != nil {
 			panic(err)
 		}
 	}
-	return &Client{
+	client := &Client{
 		K8s:                   k8s,
-		Informer:              informer,
-		InformerFactory:       informerFactory,
 		SnapshotClient:        snapshotClient,
+		SnapshotContentClient: dynamicInterface.Resource(vsMapping.Resource.GroupVersion().WithResource(volumeSnapshotContentResource)),
 		SnapshotGroupClient:   sgClientSet.SnapshotgroupV1(),
 		VolumeSnapshotVersion: VolumeSnapshotGroupName + "/" + volumeSnapshotVersion,
+		Executor:              NewPodExecutor(kubeConf, k8s),
+	}
+	if groupSnapshotResource := getGroupSnapshotResource(restMapper); groupSnapshotResource != nil {
+		client.GroupSnapshotClient = dynamicInterface.Resource(*groupSnapshotResource)
+		client.VolumeGroupSnapshotVersion = groupSnapshotResource.GroupVersion().String()
+	}
+	client.setupInformers(k8s, sgClientSet, dynamicInterface, vsMapping.Resource, canWatchPolicies(k8s, sgClientSet))
+	return client
+}
+
+// getGroupSnapshotResource returns the VolumeGroupSnapshot resource to use, or nil if the API isn't available.
+// Discovery only lists served versions, and the RESTMapper picks the one the API server prefers
+func getGroupSnapshotResource(restMapper meta.RESTMapper) *schema.GroupVersionResource {
+	mapping, err := restMapper.RESTMapping(schema.GroupKind{
+		Group: VolumeGroupSnapshotGroupName,
+		Kind:  VolumeGroupSnapshotKind,
+	})
+	if err != nil {
+		klog.V(3).Infof("VolumeGroupSnapshots are not available, snapshotting PVCs one at a time - %v", err)
+		return nil
 	}
+	return &mapping.Resource
 }
 
-func getVolumeSnapshotVersion(v []v1.CustomResourceDefinitionVersion) (string, error) {
+func getServedVersion(v []v1.CustomResourceDefinitionVersion, group string) (string, error) {
 	for _, crd := range v {
 		if crd.Served {
 			return crd.Name, nil
 		}
 	}
-	return "", errors.New("no " + VolumeSnapshotGroupName + " served API found")
+	return "", errors.New("no " + group + " served API found")
 }
@@ -15,8 +15,6 @@
 package kube
 
 import (
-	"time"
-
 	snapshotsFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -24,11 +22,8 @@ import (
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 
 	snapshotGroupsFake "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1/apis/clientset/versioned/fake"
-	snapshotGroupExternalVersions "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1/apis/informers/externalversions"
 )
 
-var noResync = func() time.Duration { return 0 }
-
 // SetFakeClient sets the singleton to a dummy client
 func SetFakeClient() *Client {
 	singleton = createFakeClient()
@@ -41,24 +36,35 @@ func createFakeClient() *Client {
 	_ = snapshotsFake.NewSimpleClientset(objects...)
 
 	snapshotGroupClientSet := snapshotGroupsFake.NewSimpleClientset(objects...)
-	informerFactory := snapshotGroupExternalVersions.NewSharedInformerFactory(snapshotGroupClientSet, noResync())
-	informer := informerFactory.Snapshotgroup().V1().SnapshotGroups()
 
 	volumeSnapshotVersionResource := schema.GroupVersionResource{
 		Group:    VolumeSnapshotGroupName,
 		Version:  "v1",
 		Resource: VolumeSnapshotKind,
 	}
+	volumeGroupSnapshotResource := schema.GroupVersionResource{
+		Group:    VolumeGroupSnapshotGroupName,
+		Version:  "v1beta1",
+		Resource: "volumegroupsnapshots",
+	}
+	volumeSnapshotContentVersionResource := volumeSnapshotVersionResource.GroupVersion().WithResource(volumeSnapshotContentResource)
 	dynamic := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(k8sruntime.NewScheme(), map[schema.GroupVersionResource]string{
-		volumeSnapshotVersionResource: "VolumeSnapshotList",
+		volumeSnapshotVersionResource:        "VolumeSnapshotList",
+		volumeSnapshotContentVersionResource: "VolumeSnapshotContentList",
+		volumeGroupSnapshotResource:          "VolumeGroupSnapshotList",
 	})
 	snapshotClient := dynamic.Resource(volumeSnapshotVersionResource)
 
-	return &Client{
-		K8s:                 k8s,
-		Informer:            informer,
-		InformerFactory:     informerFactory,
-		SnapshotClient:      snapshotClient,
-		SnapshotGroupClient: snapshotGroupClientSet.SnapshotgroupV1(),
+	client := &Client{
+		K8s:                   k8s,
+		SnapshotClient:        snapshotClient,
+		SnapshotContentClient: dynamic.Resource(volumeSnapshotContentVersionResource),
+		SnapshotGroupClient:   snapshotGroupClientSet.SnapshotgroupV1(),
+		VolumeSnapshotVersion: VolumeSnapshotGroupName + "/" + volumeSnapshotVersionResource.Version,
+
+		GroupSnapshotClient:        dynamic.Resource(volumeGroupSnapshotResource),
+		VolumeGroupSnapshotVersion: volumeGroupSnapshotResource.GroupVersion().String(),
 	}
+	client.setupInformers(k8s, snapshotGroupClientSet, dynamic, volumeSnapshotVersionResource, true)
+	return client
 }
@@ -0,0 +1,156 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaderElectionHealthTimeout is how long the leader can go without renewing the Lease, after its renew deadline,
+// before it fails health checks
+const leaderElectionHealthTimeout = 20 * time.Second
+
+var leaderElector struct {
+	sync.Mutex
+	elector  *leaderelection.LeaderElector
+	watchdog *leaderelection.HealthzAdaptor
+}
+
+// LeaderElectionConfig configures the Lease used to elect a leader among controller replicas
+type LeaderElectionConfig struct {
+	Namespace     string
+	Name          string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunWithLeaderElection blocks until this replica holds the Lease, then calls run.
+// The context passed to run is cancelled if leadership is lost. When ctx is cancelled, the Lease
+// is released so that another replica can take over immediately.
+func RunWithLeaderElection(ctx context.Context, conf LeaderElectionConfig, run func(ctx context.Context)) {
+	namespace := conf.Namespace
+	if namespace == "" {
+		namespace = getCurrentNamespace()
+	}
+	identity := getLeaderElectionIdentity()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      conf.Name,
+			Namespace: namespace,
+		},
+		Client: GetClient().K8s.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	watchdog := leaderelection.NewLeaderHealthzAdaptor(leaderElectionHealthTimeout)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		WatchDog:        watchdog,
+		ReleaseOnCancel: true,
+		LeaseDuration:   conf.LeaseDuration,
+		RenewDeadline:   conf.RenewDeadline,
+		RetryPeriod:     conf.RetryPeriod,
+		Name:            conf.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Acquired lease %s/%s", namespace, conf.Name)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-ctx.Done():
+					klog.Infof("Released lease %s/%s", namespace, conf.Name)
+				default:
+					klog.Fatalf("Lost lease %s/%s", namespace, conf.Name)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("Current leader is %s", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		klog.Fatalf("Invalid leader election configuration: %v", err)
+	}
+	leaderElector.Lock()
+	leaderElector.elector = elector
+	leaderElector.watchdog = watchdog
+	leaderElector.Unlock()
+	klog.Infof("Waiting to acquire lease %s/%s as %s", namespace, conf.Name, identity)
+	elector.Run(ctx)
+}
+
+// CheckLeaderLease returns an error if this replica holds the Lease but has stopped renewing it
+func CheckLeaderLease() error {
+	leaderElector.Lock()
+	defer leaderElector.Unlock()
+	if leaderElector.watchdog == nil {
+		return nil
+	}
+	return leaderElector.watchdog.Check(nil)
+}
+
+// IsStandby returns true if leader election is running and this replica doesn't hold the Lease.
+// It returns an error if no leader has been observed yet
+func IsStandby() (bool, error) {
+	leaderElector.Lock()
+	defer leaderElector.Unlock()
+	if leaderElector.elector == nil || leaderElector.elector.IsLeader() {
+		return false, nil
+	}
+	if leaderElector.elector.GetLeader() == "" {
+		return true, fmt.Errorf("no leader has been observed")
+	}
+	return true, nil
+}
+
+func getLeaderElectionIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Warningf("Could not determine hostname for leader election - %v", err)
+		hostname = "gemini"
+	}
+	return hostname + "_" + string(uuid.NewUUID())
+}
+
+// getCurrentNamespace returns the namespace Gemini is running in, or default when running outside a cluster
+func getCurrentNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
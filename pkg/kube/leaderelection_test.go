@@ -0,0 +1,51 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRunWithLeaderElection(t *testing.T) {
+	client := SetFakeClient()
+	conf := LeaderElectionConfig{
+		Namespace:     "gemini",
+		Name:          "gemini-leader",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var holder string
+	RunWithLeaderElection(ctx, conf, func(leaderCtx context.Context) {
+		lease, err := client.K8s.CoordinationV1().Leases("gemini").Get(leaderCtx, "gemini-leader", metav1.GetOptions{})
+		assert.NoError(t, err)
+		holder = *lease.Spec.HolderIdentity
+		cancel()
+		<-leaderCtx.Done()
+	})
+	assert.NotEmpty(t, holder, "run should be called once the lease is acquired")
+
+	lease, err := client.K8s.CoordinationV1().Leases("gemini").Get(context.TODO(), "gemini-leader", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, *lease.Spec.HolderIdentity, "lease should be released on shutdown")
+}
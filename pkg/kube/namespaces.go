@@ -0,0 +1,323 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	snapshotgroupv1 "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+	snapshotGroupClientset "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1/apis/clientset/versioned"
+	"github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1/apis/informers/externalversions"
+)
+
+// getWatchedNamespaces returns the namespaces to create informers for
+func getWatchedNamespaces() []string {
+	if len(options.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return options.Namespaces
+}
+
+var snapshotIndexers = cache.Indexers{}
+
+// AddSnapshotIndexers adds indexers to the VolumeSnapshot informers. It must be called before the Client is created
+func AddSnapshotIndexers(indexers cache.Indexers) {
+	for name, indexFunc := range indexers {
+		snapshotIndexers[name] = indexFunc
+	}
+}
+
+// WatchedNamespaces returns the namespaces the controller has informers for. It is a single empty string if all
+// namespaces are watched
+func (c *Client) WatchedNamespaces() []string {
+	return getWatchedNamespaces()
+}
+
+// setupInformers creates SnapshotGroup, VolumeSnapshot, PVC and StatefulSet informers for each watched namespace, and a Namespace
+// informer if namespaces are selected by label. The cluster-wide SnapshotPolicy informer is only created if
+// watchPolicies is set, along with the Namespace informer that policies need to select namespaces
+func (c *Client) setupInformers(k8s kubernetes.Interface, sgClientSet snapshotGroupClientset.Interface, dynamicClient dynamic.Interface, snapshotResource schema.GroupVersionResource, watchPolicies bool) {
+	c.SnapshotInformers = map[string]cache.SharedIndexInformer{}
+	for _, namespace := range getWatchedNamespaces() {
+		factory := externalversions.NewSharedInformerFactoryWithOptions(sgClientSet, options.ResyncPeriod, externalversions.WithNamespace(namespace))
+		informer := factory.Snapshotgroup().V1().SnapshotGroups()
+		// Register the informer with the factory, so that Start runs it
+		informer.Informer()
+		restoreInformer := factory.Snapshotgroup().V1().SnapshotRestores()
+		restoreInformer.Informer()
+		c.InformerFactories = append(c.InformerFactories, factory)
+		c.Informers = append(c.Informers, informer)
+		c.RestoreInformers = append(c.RestoreInformers, restoreInformer)
+
+		snapshotFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, options.ResyncPeriod, namespace, nil)
+		snapshotInformer := snapshotFactory.ForResource(snapshotResource).Informer()
+		if err := snapshotInformer.AddIndexers(snapshotIndexers); err != nil {
+			panic(err)
+		}
+		c.snapshotInformerFactories = append(c.snapshotInformerFactories, snapshotFactory)
+		c.SnapshotInformers[namespace] = snapshotInformer
+
+		pvcFactory := kubeinformers.NewSharedInformerFactoryWithOptions(k8s, options.ResyncPeriod, kubeinformers.WithNamespace(namespace))
+		pvcInformer := pvcFactory.Core().V1().PersistentVolumeClaims()
+		pvcInformer.Informer()
+		statefulSetInformer := pvcFactory.Apps().V1().StatefulSets()
+		statefulSetInformer.Informer()
+		c.pvcInformerFactories = append(c.pvcInformerFactories, pvcFactory)
+		c.PVCInformers = append(c.PVCInformers, pvcInformer)
+		c.StatefulSetInformers = append(c.StatefulSetInformers, statefulSetInformer)
+	}
+	if options.NamespaceSelector != nil && !options.NamespaceSelector.Empty() {
+		c.namespaceSelector = options.NamespaceSelector
+	}
+	if c.namespaceSelector != nil || watchPolicies {
+		c.kubeInformerFactory = kubeinformers.NewSharedInformerFactory(k8s, options.ResyncPeriod)
+		c.NamespaceInformer = c.kubeInformerFactory.Core().V1().Namespaces()
+		c.NamespaceInformer.Informer()
+	}
+	if watchPolicies {
+		// SnapshotPolicies are cluster-scoped, so they are watched by a single informer whichever namespaces are watched
+		policyFactory := externalversions.NewSharedInformerFactory(sgClientSet, options.ResyncPeriod)
+		c.PolicyInformer = policyFactory.Snapshotgroup().V1().SnapshotPolicies()
+		c.PolicyInformer.Informer()
+		c.InformerFactories = append(c.InformerFactories, policyFactory)
+	}
+}
+
+// canWatchPolicies returns false if the SnapshotPolicy CRD is missing, or if SnapshotPolicies or Namespaces can't be
+// listed cluster-wide. Other errors are assumed to be temporary, and are left to the informer to retry
+func canWatchPolicies(k8s kubernetes.Interface, sgClientSet snapshotGroupClientset.Interface) bool {
+	_, err := sgClientSet.SnapshotgroupV1().SnapshotPolicies().List(context.TODO(), metav1.ListOptions{Limit: 1})
+	if err == nil {
+		_, err = k8s.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{Limit: 1})
+	}
+	if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+		klog.Warningf("Not reconciling SnapshotPolicies - %v", err)
+		return false
+	}
+	return true
+}
+
+// Start starts all informers
+func (c *Client) Start(stopCh <-chan struct{}) {
+	for _, factory := range c.InformerFactories {
+		factory.Start(stopCh)
+	}
+	for _, factory := range c.snapshotInformerFactories {
+		factory.Start(stopCh)
+	}
+	for _, factory := range c.pvcInformerFactories {
+		factory.Start(stopCh)
+	}
+	if c.kubeInformerFactory != nil {
+		c.kubeInformerFactory.Start(stopCh)
+	}
+}
+
+// InformersSynced returns a function for each informer that reports whether it has synced
+func (c *Client) InformersSynced() []cache.InformerSynced {
+	synced := []cache.InformerSynced{}
+	for _, informer := range c.Informers {
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	for _, informer := range c.SnapshotInformers {
+		synced = append(synced, informer.HasSynced)
+	}
+	for _, informer := range c.PVCInformers {
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	for _, informer := range c.StatefulSetInformers {
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	if c.namespaceSelector != nil {
+		synced = append(synced, c.NamespaceInformer.Informer().HasSynced)
+	}
+	return synced
+}
+
+// RestoreInformersSynced returns a function for each SnapshotRestore informer that reports whether it has synced.
+// These are waited for separately, so that SnapshotGroups are still reconciled if the SnapshotRestore CRD is missing
+func (c *Client) RestoreInformersSynced() []cache.InformerSynced {
+	synced := []cache.InformerSynced{}
+	for _, informer := range c.RestoreInformers {
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	return synced
+}
+
+// PolicyInformersSynced returns a function for the SnapshotPolicy and Namespace informers that reports whether they
+// have synced, or nil if SnapshotPolicies aren't watched. They are waited for separately, so that SnapshotGroups are
+// still reconciled if the SnapshotPolicy CRD is missing or can't be listed cluster-wide
+func (c *Client) PolicyInformersSynced() []cache.InformerSynced {
+	if c.PolicyInformer == nil {
+		return nil
+	}
+	return []cache.InformerSynced{c.PolicyInformer.Informer().HasSynced, c.NamespaceInformer.Informer().HasSynced}
+}
+
+// IsWatched returns true if objects in namespace should be reconciled
+func (c *Client) IsWatched(namespace string) bool {
+	if c.namespaceSelector == nil {
+		return true
+	}
+	ns, err := c.NamespaceInformer.Lister().Get(namespace)
+	if err != nil {
+		klog.V(5).Infof("%s: not watching namespace - %v", namespace, err)
+		return false
+	}
+	return c.MatchesNamespaceSelector(ns)
+}
+
+// HasNamespaceSelector returns true if the controller only watches namespaces with matching labels
+func (c *Client) HasNamespaceSelector() bool {
+	return c.namespaceSelector != nil
+}
+
+// MatchesNamespaceSelector returns true if the labels of ns match the namespace selector, or no selector is set
+func (c *Client) MatchesNamespaceSelector(ns *corev1.Namespace) bool {
+	return c.namespaceSelector == nil || c.namespaceSelector.Matches(labels.Set(ns.ObjectMeta.Labels))
+}
+
+// GetSnapshotGroup returns a SnapshotGroup from the informer cache
+func (c *Client) GetSnapshotGroup(namespace, name string) (*snapshotgroupv1.SnapshotGroup, error) {
+	for _, informer := range c.Informers {
+		sg, err := informer.Lister().SnapshotGroups(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		return sg, err
+	}
+	return nil, apierrors.NewNotFound(snapshotgroupv1.Resource("snapshotgroups"), name)
+}
+
+// ListSnapshotGroups returns the SnapshotGroups in namespace from the informer cache. All watched namespaces are
+// listed if namespace is empty
+func (c *Client) ListSnapshotGroups(namespace string) ([]*snapshotgroupv1.SnapshotGroup, error) {
+	return c.SelectSnapshotGroups(namespace, labels.Everything())
+}
+
+// SelectSnapshotGroups returns the SnapshotGroups in namespace whose labels match selector from the informer cache.
+// All watched namespaces are listed if namespace is empty
+func (c *Client) SelectSnapshotGroups(namespace string, selector labels.Selector) ([]*snapshotgroupv1.SnapshotGroup, error) {
+	groups := []*snapshotgroupv1.SnapshotGroup{}
+	for _, informer := range c.Informers {
+		found, err := informer.Lister().SnapshotGroups(namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, found...)
+	}
+	return groups, nil
+}
+
+// GetPVC returns a PersistentVolumeClaim from the informer cache
+func (c *Client) GetPVC(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	for _, informer := range c.PVCInformers {
+		pvc, err := informer.Lister().PersistentVolumeClaims(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		return pvc, err
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("persistentvolumeclaims"), name)
+}
+
+// SelectPVCs returns the PersistentVolumeClaims in namespace whose labels match selector from the informer cache.
+// All watched namespaces are listed if namespace is empty
+func (c *Client) SelectPVCs(namespace string, selector labels.Selector) ([]*corev1.PersistentVolumeClaim, error) {
+	pvcs := []*corev1.PersistentVolumeClaim{}
+	for _, informer := range c.PVCInformers {
+		found, err := informer.Lister().PersistentVolumeClaims(namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		pvcs = append(pvcs, found...)
+	}
+	return pvcs, nil
+}
+
+// GetStatefulSet returns a StatefulSet from the informer cache
+func (c *Client) GetStatefulSet(namespace, name string) (*appsv1.StatefulSet, error) {
+	for _, informer := range c.StatefulSetInformers {
+		sts, err := informer.Lister().StatefulSets(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		return sts, err
+	}
+	return nil, apierrors.NewNotFound(appsv1.Resource("statefulsets"), name)
+}
+
+// SelectNamespaces returns the Namespaces whose labels match selector from the informer cache
+func (c *Client) SelectNamespaces(selector labels.Selector) ([]*corev1.Namespace, error) {
+	if c.NamespaceInformer == nil {
+		return nil, fmt.Errorf("namespaces are not watched")
+	}
+	return c.NamespaceInformer.Lister().List(selector)
+}
+
+// GetSnapshotRestore returns a SnapshotRestore from the informer cache
+func (c *Client) GetSnapshotRestore(namespace, name string) (*snapshotgroupv1.SnapshotRestore, error) {
+	for _, informer := range c.RestoreInformers {
+		sr, err := informer.Lister().SnapshotRestores(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		return sr, err
+	}
+	return nil, apierrors.NewNotFound(snapshotgroupv1.Resource(snapshotgroupv1.SnapshotRestorePlural), name)
+}
+
+// ListSnapshotRestores returns the SnapshotRestores in namespace from the informer cache
+func (c *Client) ListSnapshotRestores(namespace string) ([]*snapshotgroupv1.SnapshotRestore, error) {
+	restores := []*snapshotgroupv1.SnapshotRestore{}
+	for _, informer := range c.RestoreInformers {
+		found, err := informer.Lister().SnapshotRestores(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		restores = append(restores, found...)
+	}
+	return restores, nil
+}
+
+// GetSnapshotPolicy returns a SnapshotPolicy from the informer cache. It is never found if SnapshotPolicies aren't watched
+func (c *Client) GetSnapshotPolicy(name string) (*snapshotgroupv1.SnapshotPolicy, error) {
+	if c.PolicyInformer == nil {
+		return nil, apierrors.NewNotFound(snapshotgroupv1.Resource(snapshotgroupv1.SnapshotPolicyPlural), name)
+	}
+	return c.PolicyInformer.Lister().Get(name)
+}
+
+// GetSnapshotInformer returns the VolumeSnapshot informer for namespace, or nil if it isn't watched
+func (c *Client) GetSnapshotInformer(namespace string) cache.SharedIndexInformer {
+	if informer, ok := c.SnapshotInformers[namespace]; ok {
+		return informer
+	}
+	return c.SnapshotInformers[metav1.NamespaceAll]
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+func withOptions(t *testing.T, opts Options) {
+	previous := options
+	Configure(opts)
+	t.Cleanup(func() {
+		Configure(previous)
+	})
+}
+
+func TestWatchedNamespaces(t *testing.T) {
+	withOptions(t, Options{Namespaces: []string{"team-a", "team-b"}})
+	client := SetFakeClient()
+	assert.Len(t, client.Informers, 2)
+	assert.Len(t, client.InformersSynced(), 8)
+	assert.True(t, client.IsWatched("team-a"))
+	assert.NotNil(t, client.GetSnapshotInformer("team-a"))
+	assert.Nil(t, client.GetSnapshotInformer("team-c"))
+}
+
+func TestNamespaceSelector(t *testing.T) {
+	withOptions(t, Options{NamespaceSelector: labels.SelectorFromSet(labels.Set{"gemini": "enabled"})})
+	client := SetFakeClient()
+	assert.Len(t, client.Informers, 1)
+	assert.Len(t, client.InformersSynced(), 5)
+	assert.NotNil(t, client.GetSnapshotInformer("team-a"))
+
+	for name, value := range map[string]string{"team-a": "enabled", "team-b": "disabled"} {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"gemini": value}}}
+		_, err := client.K8s.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client.kubeInformerFactory.Start(stopCh)
+	assert.True(t, cache.WaitForCacheSync(stopCh, client.NamespaceInformer.Informer().HasSynced))
+
+	assert.True(t, client.IsWatched("team-a"))
+	assert.False(t, client.IsWatched("team-b"))
+	assert.False(t, client.IsWatched("missing"))
+}
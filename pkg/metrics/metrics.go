@@ -0,0 +1,162 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gemini"
+
+// Registry contains all metrics exported by Gemini
+var Registry = prometheus.NewRegistry()
+
+var (
+	// SnapshotsCreated counts VolumeSnapshots created by Gemini
+	SnapshotsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshots_created_total",
+		Help:      "Number of VolumeSnapshots created",
+	}, []string{"namespace", "group"})
+
+	// SnapshotsDeleted counts VolumeSnapshots deleted by Gemini
+	SnapshotsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshots_deleted_total",
+		Help:      "Number of VolumeSnapshots deleted",
+	}, []string{"namespace", "group"})
+
+	// SnapshotsFailed counts VolumeSnapshots that Gemini could not create
+	SnapshotsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshots_failed_total",
+		Help:      "Number of VolumeSnapshots that could not be created",
+	}, []string{"namespace", "group"})
+
+	// Restores counts restores, labelled by result
+	Restores = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "restores_total",
+		Help:      "Number of PVC restores, by result",
+	}, []string{"namespace", "group", "result"})
+
+	// ReconcileDuration observes how long each task takes
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time taken to process a SnapshotGroup, by task",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"task"})
+)
+
+var groups = &groupCollector{
+	snapshots: prometheus.NewDesc(prometheus.BuildFQName(namespace, "snapshotgroup", "snapshots"),
+		"Number of VolumeSnapshots managed by the SnapshotGroup",
+		[]string{"namespace", "group"}, nil),
+	newestReadyAge: prometheus.NewDesc(prometheus.BuildFQName(namespace, "snapshotgroup", "newest_ready_snapshot_age_seconds"),
+		"Age of the newest VolumeSnapshot that is ready to use, excluding failsafe snapshots taken before restores",
+		[]string{"namespace", "group"}, nil),
+	nextSnapshot: prometheus.NewDesc(prometheus.BuildFQName(namespace, "snapshotgroup", "next_snapshot_seconds"),
+		"Seconds until the next snapshot is due for each schedule. Negative values are overdue",
+		[]string{"namespace", "group", "interval"}, nil),
+	states: map[groupKey]GroupState{},
+}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		SnapshotsCreated,
+		SnapshotsDeleted,
+		SnapshotsFailed,
+		Restores,
+		ReconcileDuration,
+		groups,
+	)
+}
+
+// Handler serves the metrics in Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// GroupState is the most recently observed state of a SnapshotGroup
+type GroupState struct {
+	Snapshots           int
+	NewestReadySnapshot time.Time
+	NextSnapshots       map[string]time.Time
+}
+
+type groupKey struct {
+	namespace string
+	name      string
+}
+
+// groupCollector reports per-SnapshotGroup gauges, which are relative to the time they are scraped
+type groupCollector struct {
+	snapshots      *prometheus.Desc
+	newestReadyAge *prometheus.Desc
+	nextSnapshot   *prometheus.Desc
+
+	lock   sync.Mutex
+	states map[groupKey]GroupState
+}
+
+// SetGroupState records the state of a SnapshotGroup
+func SetGroupState(namespace, name string, state GroupState) {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+	groups.states[groupKey{namespace: namespace, name: name}] = state
+}
+
+// DeleteGroup stops reporting metrics for a SnapshotGroup
+func DeleteGroup(namespace, name string) {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+	delete(groups.states, groupKey{namespace: namespace, name: name})
+	SnapshotsCreated.DeleteLabelValues(namespace, name)
+	SnapshotsDeleted.DeleteLabelValues(namespace, name)
+	SnapshotsFailed.DeleteLabelValues(namespace, name)
+	Restores.DeletePartialMatch(prometheus.Labels{"namespace": namespace, "group": name})
+}
+
+// Describe implements prometheus.Collector
+func (c *groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.snapshots
+	ch <- c.newestReadyAge
+	ch <- c.nextSnapshot
+}
+
+// Collect implements prometheus.Collector
+func (c *groupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for key, state := range c.states {
+		ch <- prometheus.MustNewConstMetric(c.snapshots, prometheus.GaugeValue, float64(state.Snapshots), key.namespace, key.name)
+		if !state.NewestReadySnapshot.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.newestReadyAge, prometheus.GaugeValue, now.Sub(state.NewestReadySnapshot).Seconds(), key.namespace, key.name)
+		}
+		for interval, next := range state.NextSnapshots {
+			ch <- prometheus.MustNewConstMetric(c.nextSnapshot, prometheus.GaugeValue, next.Sub(now).Seconds(), key.namespace, key.name, interval)
+		}
+	}
+}
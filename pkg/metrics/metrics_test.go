@@ -0,0 +1,49 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupMetrics(t *testing.T) {
+	SetGroupState("default", "foo", GroupState{
+		Snapshots:           3,
+		NewestReadySnapshot: time.Now().Add(-time.Hour),
+		NextSnapshots: map[string]time.Time{
+			"hour": time.Now().Add(time.Hour),
+			"day":  time.Now().Add(time.Hour * 24),
+		},
+	})
+	SetGroupState("default", "bar", GroupState{})
+	assert.Equal(t, 5, testutil.CollectAndCount(groups))
+
+	expected := `
+# HELP gemini_snapshotgroup_snapshots Number of VolumeSnapshots managed by the SnapshotGroup
+# TYPE gemini_snapshotgroup_snapshots gauge
+gemini_snapshotgroup_snapshots{group="bar",namespace="default"} 0
+gemini_snapshotgroup_snapshots{group="foo",namespace="default"} 3
+`
+	assert.NoError(t, testutil.CollectAndCompare(groups, strings.NewReader(expected), "gemini_snapshotgroup_snapshots"))
+
+	DeleteGroup("default", "foo")
+	DeleteGroup("default", "bar")
+	assert.Equal(t, 0, testutil.CollectAndCount(groups))
+}
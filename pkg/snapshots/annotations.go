@@ -0,0 +1,183 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// ParseScheduleAnnotation parses the compact schedule syntax of the schedule annotation, a comma-separated list of
+// <interval>:<keep>, e.g. "10 minutes:3, day:14". Each interval can only be listed once
+func ParseScheduleAnnotation(value string) ([]snapshotgroup.SnapshotSchedule, error) {
+	schedules := []snapshotgroup.SnapshotSchedule{}
+	seen := map[time.Duration]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		sep := strings.LastIndex(entry, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("schedule %q must be <interval>:<keep>", entry)
+		}
+		every := strings.Join(strings.Fields(entry[:sep]), " ")
+		interval, err := ParseInterval(every)
+		if err != nil {
+			return nil, err
+		}
+		if seen[interval] {
+			return nil, fmt.Errorf("schedule %q is repeated", every)
+		}
+		seen[interval] = true
+		keep, err := strconv.Atoi(strings.TrimSpace(entry[sep+1:]))
+		if err != nil || keep < 1 {
+			return nil, fmt.Errorf("schedule %q must keep at least one snapshot", entry)
+		}
+		schedules = append(schedules, snapshotgroup.SnapshotSchedule{Every: every, Keep: keep})
+	}
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("schedule is empty")
+	}
+	return schedules, nil
+}
+
+// HasScheduleAnnotation returns true if the PVC asks to be backed up with the schedule annotation
+func HasScheduleAnnotation(pvc metav1.Object) bool {
+	return pvc.GetAnnotations()[ScheduleAnnotation] != ""
+}
+
+// GetEnrolledClaimName returns the name of the PVC whose schedule annotation generated the SnapshotGroup, or an empty string
+func GetEnrolledClaimName(sg metav1.Object) string {
+	return sg.GetAnnotations()[EnrolledClaimAnnotation]
+}
+
+// getEnrolledClaimAnnotations returns the annotations that enrolled the PVC of a SnapshotGroup generated from the
+// schedule annotation, rebuilt from its spec so that they can be set on a restored PVC. It returns nil for other groups
+func getEnrolledClaimAnnotations(sg *snapshotgroup.SnapshotGroup) map[string]string {
+	if GetEnrolledClaimName(sg) == "" {
+		return nil
+	}
+	schedules := []string{}
+	for _, schedule := range sg.Spec.Schedule {
+		schedules = append(schedules, fmt.Sprintf("%s:%d", schedule.Every, schedule.Keep))
+	}
+	annotations := map[string]string{ScheduleAnnotation: strings.Join(schedules, intervalsSeparator)}
+	if class := sg.Spec.Template.Spec.VolumeSnapshotClassName; class != nil {
+		annotations[SnapshotClassAnnotation] = *class
+	}
+	return annotations
+}
+
+// ReconcileAnnotatedClaim creates or updates the SnapshotGroup of a PVC with the schedule annotation, and deletes it
+// once the annotation is removed or the PVC is deleted
+func ReconcileAnnotatedClaim(namespace, name string, recorder record.EventRecorder) error {
+	client := kube.GetClient()
+	pvc, err := client.GetPVC(namespace, name)
+	if errors.IsNotFound(err) {
+		pvc = nil
+	} else if err != nil {
+		return err
+	}
+	existing, err := client.GetSnapshotGroup(namespace, name)
+	if errors.IsNotFound(err) {
+		existing = nil
+	} else if err != nil {
+		return err
+	}
+	if existing != nil && GetEnrolledClaimName(existing) != name {
+		if pvc != nil && HasScheduleAnnotation(pvc) {
+			recorder.Eventf(pvc, corev1.EventTypeWarning, ReasonInvalidSchedule, "SnapshotGroup %s already exists and is not managed by the %s annotation", name, ScheduleAnnotation)
+		}
+		return nil
+	}
+
+	if pvc == nil || pvc.ObjectMeta.DeletionTimestamp != nil || !HasScheduleAnnotation(pvc) {
+		if existing == nil || existing.ObjectMeta.DeletionTimestamp != nil {
+			return nil
+		}
+		if pvc == nil || pvc.ObjectMeta.DeletionTimestamp != nil {
+			// The restored PVC gets the annotations back, so keep the SnapshotGroup while the PVC is being replaced
+			restore, err := getReplacingRestore(existing)
+			if err != nil {
+				return err
+			}
+			if isRestoring(existing) || restore != "" {
+				klog.V(5).Infof("%s/%s: not deleting SnapshotGroup, PVC is being restored", namespace, name)
+				return nil
+			}
+		}
+		klog.V(3).Infof("%s/%s: deleting SnapshotGroup, PVC is no longer annotated", namespace, name)
+		err := client.SnapshotGroupClient.SnapshotGroups(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err == nil && pvc != nil {
+			recorder.Eventf(pvc, corev1.EventTypeNormal, ReasonSnapshotGroupDeleted, "Deleted SnapshotGroup %s, the %s annotation was removed", name, ScheduleAnnotation)
+		}
+		return err
+	}
+
+	schedules, err := ParseScheduleAnnotation(pvc.ObjectMeta.Annotations[ScheduleAnnotation])
+	if err != nil {
+		// Retrying won't help until the annotation is fixed, which triggers another reconcile
+		klog.Warningf("%s/%s: invalid %s annotation - %v", namespace, name, ScheduleAnnotation, err)
+		recorder.Eventf(pvc, corev1.EventTypeWarning, ReasonInvalidSchedule, "Invalid %s annotation: %v", ScheduleAnnotation, err)
+		return nil
+	}
+	desired := newAnnotatedSnapshotGroup(pvc, schedules)
+	isManaged := func(sg *snapshotgroup.SnapshotGroup) bool {
+		return GetEnrolledClaimName(sg) == name
+	}
+	created, err := applyGeneratedSnapshotGroup(desired, existing, "the "+ScheduleAnnotation+" annotation", isManaged)
+	if created {
+		klog.V(3).Infof("%s/%s: created SnapshotGroup from the %s annotation", namespace, name, ScheduleAnnotation)
+		recorder.Eventf(pvc, corev1.EventTypeNormal, ReasonSnapshotGroupCreated, "Created SnapshotGroup %s from the %s annotation", name, ScheduleAnnotation)
+	}
+	return err
+}
+
+// newAnnotatedSnapshotGroup returns the SnapshotGroup generated from the annotations of a PVC. It has the same name
+// as the PVC, and isn't owned by it, so that it survives the PVC being replaced by a restore
+func newAnnotatedSnapshotGroup(pvc *corev1.PersistentVolumeClaim, schedules []snapshotgroup.SnapshotSchedule) *snapshotgroup.SnapshotGroup {
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvc.ObjectMeta.Name,
+			Namespace:   pvc.ObjectMeta.Namespace,
+			Labels:      map[string]string{managedByLabel: managerName},
+			Annotations: map[string]string{EnrolledClaimAnnotation: pvc.ObjectMeta.Name},
+		},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim:    snapshotgroup.SnapshotClaim{Name: pvc.ObjectMeta.Name},
+			Schedule: schedules,
+		},
+	}
+	if class := pvc.ObjectMeta.Annotations[SnapshotClassAnnotation]; class != "" {
+		sg.Spec.Template.Spec.VolumeSnapshotClassName = &class
+	}
+	return sg
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestParseScheduleAnnotation(t *testing.T) {
+	schedules, err := ParseScheduleAnnotation("10 minutes:3, day:14")
+	assert.NoError(t, err)
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "10 minutes", Keep: 3}, {Every: "day", Keep: 14}}, schedules)
+
+	schedules, err = ParseScheduleAnnotation(" hour : 24 ,")
+	assert.NoError(t, err)
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "hour", Keep: 24}}, schedules)
+
+	for _, value := range []string{"", ",", "hour", "hour:0", "hour:many", "fortnight:2", ":3", "day:3, day:14", "day:3, 24 hours:14"} {
+		_, err := ParseScheduleAnnotation(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestReconcileAnnotatedClaim(t *testing.T) {
+	client := kube.SetFakeClient()
+	recorder := record.NewFakeRecorder(100)
+	pvcs := client.K8s.CoreV1().PersistentVolumeClaims("default")
+	pvc, err := pvcs.Create(context.TODO(), &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "data",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ScheduleAnnotation:      "10 minutes:3, day:14",
+				SnapshotClassAnnotation: "csi",
+			},
+		},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	// The informers aren't running, so the PVC and SnapshotGroup are copied from the API into their caches
+	reconcile := func() error {
+		pvcIndexer := client.PVCInformers[0].Informer().GetIndexer()
+		if latest, err := pvcs.Get(context.TODO(), "data", metav1.GetOptions{}); err == nil {
+			assert.NoError(t, pvcIndexer.Update(latest))
+		} else {
+			assert.NoError(t, pvcIndexer.Delete(pvc))
+		}
+		sgIndexer := client.Informers[0].Informer().GetIndexer()
+		if latest, err := client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{}); err == nil {
+			assert.NoError(t, sgIndexer.Update(latest))
+		} else {
+			for _, obj := range sgIndexer.List() {
+				assert.NoError(t, sgIndexer.Delete(obj))
+			}
+		}
+		return ReconcileAnnotatedClaim("default", "data", recorder)
+	}
+
+	assert.NoError(t, reconcile())
+	sg, err := client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "data", sg.Spec.Claim.Name)
+	assert.Equal(t, "data", GetEnrolledClaimName(sg))
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "10 minutes", Keep: 3}, {Every: "day", Keep: 14}}, sg.Spec.Schedule)
+	assert.Equal(t, "csi", *sg.Spec.Template.Spec.VolumeSnapshotClassName)
+	assert.Empty(t, sg.ObjectMeta.OwnerReferences, "the SnapshotGroup must survive the PVC being replaced by a restore")
+	assert.Equal(t, "Normal SnapshotGroupCreated Created SnapshotGroup data from the gemini.fairwinds.com/schedule annotation", <-recorder.Events)
+
+	// Changing the annotation updates the SnapshotGroup
+	pvc.ObjectMeta.Annotations[ScheduleAnnotation] = "hour:24"
+	pvc, err = pvcs.Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, reconcile())
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "hour", Keep: 24}}, sg.Spec.Schedule)
+
+	// An invalid annotation is reported, and leaves the SnapshotGroup alone
+	pvc.ObjectMeta.Annotations[ScheduleAnnotation] = "hour"
+	pvc, err = pvcs.Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, reconcile())
+	assert.Contains(t, <-recorder.Events, "Warning InvalidSchedule")
+	pvc.ObjectMeta.Annotations[ScheduleAnnotation] = "day:3, day:14"
+	pvc, err = pvcs.Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, reconcile())
+	assert.Equal(t, `Warning InvalidSchedule Invalid gemini.fairwinds.com/schedule annotation: schedule "day" is repeated`, <-recorder.Events)
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "hour", Keep: 24}}, sg.Spec.Schedule)
+
+	// The SnapshotGroup is kept while the PVC is replaced by a restore
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err)
+	sg.ObjectMeta.Annotations[RestoreAnnotation] = "1234"
+	meta.SetStatusCondition(&sg.Status.Conditions, metav1.Condition{Type: snapshotgroup.ConditionRestoring, Status: metav1.ConditionTrue, Reason: "Restoring"})
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("default").Update(context.TODO(), sg, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, pvcs.Delete(context.TODO(), "data", metav1.DeleteOptions{}))
+	assert.NoError(t, reconcile())
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err, "the SnapshotGroup of a PVC being restored is kept")
+
+	// The restored PVC gets the annotations back, so it is still backed up
+	restored, err := createPVCFromSnapshot(sg, "1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "hour:24", restored.ObjectMeta.Annotations[ScheduleAnnotation])
+	assert.Equal(t, "csi", restored.ObjectMeta.Annotations[SnapshotClassAnnotation])
+	assert.Equal(t, "1234", restored.ObjectMeta.Annotations[RestoreAnnotation])
+	assert.NoError(t, reconcile())
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err, "the SnapshotGroup of a restored PVC is kept")
+	assert.Equal(t, []snapshotgroup.SnapshotSchedule{{Every: "hour", Keep: 24}}, sg.Spec.Schedule)
+
+	// Removing the annotation from the restored PVC deletes the SnapshotGroup
+	delete(restored.ObjectMeta.Annotations, ScheduleAnnotation)
+	_, err = pvcs.Update(context.TODO(), restored, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, reconcile())
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Equal(t, "Normal SnapshotGroupDeleted Deleted SnapshotGroup data, the gemini.fairwinds.com/schedule annotation was removed", <-recorder.Events)
+
+	// SnapshotGroups created by hand are never taken over or deleted
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").Create(context.TODO(), &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+		Spec:       snapshotgroup.SnapshotGroupSpec{Claim: snapshotgroup.SnapshotClaim{Name: "data"}},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, reconcile())
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "data", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// errMultipleClaimsRestore is returned when restoring a SnapshotGroup that backs up more than one PVC
+var errMultipleClaimsRestore = errors.New("restoring a SnapshotGroup with a PVC selector or StatefulSet is not supported")
+
+// HasMultipleClaims returns true if the SnapshotGroup backs up every PVC matching a selector or StatefulSet,
+// rather than a single claim
+func HasMultipleClaims(sg *snapshotgroup.SnapshotGroup) bool {
+	return sg.Spec.Claim.Selector != nil || sg.Spec.Claim.StatefulSet != ""
+}
+
+// listClaims returns the PVCs backed up by a SnapshotGroup with multiple claims, sorted by name
+func listClaims(sg *snapshotgroup.SnapshotGroup) ([]corev1.PersistentVolumeClaim, error) {
+	if sg.Spec.Claim.Selector != nil && sg.Spec.Claim.StatefulSet != "" {
+		return nil, fmt.Errorf("%s/%s: only one of selector and statefulSet can be set", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	}
+	client := kube.GetClient()
+	selector := labels.Everything()
+	var prefixes []string
+	if sg.Spec.Claim.Selector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(sg.Spec.Claim.Selector)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sts, err := client.GetStatefulSet(sg.ObjectMeta.Namespace, sg.Spec.Claim.StatefulSet)
+		if err != nil {
+			return nil, err
+		}
+		for _, template := range sts.Spec.VolumeClaimTemplates {
+			prefixes = append(prefixes, template.ObjectMeta.Name+"-"+sts.ObjectMeta.Name+"-")
+		}
+	}
+	pvcs, err := client.SelectPVCs(sg.ObjectMeta.Namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	claims := []corev1.PersistentVolumeClaim{}
+	for _, pvc := range pvcs {
+		if pvc.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if prefixes != nil && !isStatefulSetClaim(pvc.ObjectMeta.Name, prefixes) {
+			continue
+		}
+		claims = append(claims, *pvc)
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		return claims[i].ObjectMeta.Name < claims[j].ObjectMeta.Name
+	})
+	return claims, nil
+}
+
+// isStatefulSetClaim returns true if name is <template>-<statefulset>-<ordinal> for one of the prefixes
+func isStatefulSetClaim(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		ordinal := strings.TrimPrefix(name, prefix)
+		if ordinal == name || ordinal == "" {
+			continue
+		}
+		if strings.Trim(ordinal, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesClaim returns true if a SnapshotGroup with multiple claims could back up the PVC. PVCs of a StatefulSet
+// are matched by name, without looking up its volumeClaimTemplates, so this can match PVCs that listClaims won't
+func MatchesClaim(sg *snapshotgroup.SnapshotGroup, pvc metav1.Object) bool {
+	if pvc.GetNamespace() != sg.ObjectMeta.Namespace {
+		return false
+	}
+	if sg.Spec.Claim.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(sg.Spec.Claim.Selector)
+		return err == nil && selector.Matches(labels.Set(pvc.GetLabels()))
+	}
+	if sg.Spec.Claim.StatefulSet != "" {
+		name := pvc.GetName()
+		sep := strings.LastIndex(name, "-")
+		return sep > 0 && isStatefulSetClaim(name, []string{name[:sep+1]}) && strings.HasSuffix(name[:sep], "-"+sg.Spec.Claim.StatefulSet)
+	}
+	return false
+}
+
+// getClaimNames returns the names of the PVCs backed up by the SnapshotGroup
+func getClaimNames(sg *snapshotgroup.SnapshotGroup) ([]string, error) {
+	if !HasMultipleClaims(sg) {
+		return []string{GetPVCName(sg)}, nil
+	}
+	claims, err := listClaims(sg)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, pvc := range claims {
+		names = append(names, pvc.ObjectMeta.Name)
+	}
+	return names, nil
+}
+
+// createSnapshotSet snapshots every PVC of a SnapshotGroup with multiple claims at the same timestamp.
+// If any snapshot can't be created, the rest of the set is deleted, so that sets are always complete
+func createSnapshotSet(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) ([]*GeminiSnapshot, error) {
+	claims, err := getClaimNames(sg)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims) == 0 {
+		return nil, fmt.Errorf("no PVCs match the SnapshotGroup")
+	}
+	annotations = setSnapshotAnnotations(sg, annotations)
+	set := getSnapshotName(sg, annotations)
+	if useGroupSnapshot(sg) {
+		return createGroupSnapshot(sg, set, len(claims), annotations)
+	}
+	klog.V(3).Infof("%s/%s: creating snapshot set %s of %d PVCs", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, set, len(claims))
+	created := []*GeminiSnapshot{}
+	for _, claim := range claims {
+		memberAnnotations := map[string]string{
+			SnapshotSetAnnotation: set,
+			ClaimAnnotation:       claim,
+		}
+		for key, value := range annotations {
+			memberAnnotations[key] = value
+		}
+		snapshot, err := createVolumeSnapshot(sg, set+"-"+claim, claim, memberAnnotations)
+		if err != nil {
+			if deleteErr := deleteSnapshots(created); deleteErr != nil {
+				klog.Warningf("%s/%s: failed to delete incomplete snapshot set %s - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, set, deleteErr)
+			}
+			return nil, fmt.Errorf("could not snapshot PVC %s: %w", claim, err)
+		}
+		created = append(created, snapshot)
+	}
+	return created, nil
+}
+
+// getSetKey returns the ID of the set a snapshot belongs to. Snapshots of a single PVC are a set of their own
+func getSetKey(snapshot *GeminiSnapshot) string {
+	if snapshot.Set != "" {
+		return snapshot.Set
+	}
+	return snapshot.Name
+}
+
+// getSnapshotSets returns the newest snapshot of each set, so that schedules and retention treat a set as one
+// snapshot. Snapshots are sorted newest first
+func getSnapshotSets(snapshots []*GeminiSnapshot) []*GeminiSnapshot {
+	seen := map[string]bool{}
+	sets := []*GeminiSnapshot{}
+	for _, snapshot := range snapshots {
+		key := getSetKey(snapshot)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sets = append(sets, snapshot)
+	}
+	return sets
+}
+
+// isSetReady returns true if every snapshot in the same set as snapshot is ready to use
+func isSetReady(snapshot *GeminiSnapshot, snapshots []*GeminiSnapshot) bool {
+	for _, member := range getSetMembers([]*GeminiSnapshot{snapshot}, snapshots) {
+		if !getSnapshotStatus(member).ReadyToUse {
+			return false
+		}
+	}
+	return true
+}
+
+// getSetMembers returns every snapshot in the same sets as the given snapshots
+func getSetMembers(sets, snapshots []*GeminiSnapshot) []*GeminiSnapshot {
+	keys := map[string]bool{}
+	for _, snapshot := range sets {
+		keys[getSetKey(snapshot)] = true
+	}
+	members := []*GeminiSnapshot{}
+	for _, snapshot := range snapshots {
+		if keys[getSetKey(snapshot)] {
+			members = append(members, snapshot)
+		}
+	}
+	return members
+}
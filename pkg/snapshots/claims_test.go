@@ -0,0 +1,226 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	snapshotsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestCreateSnapshotSet(t *testing.T) {
+	client := kube.SetFakeClient()
+	// Claims are read from the informer cache
+	assert.NoError(t, client.StatefulSetInformers[0].Informer().GetIndexer().Add(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}},
+		},
+	}))
+	for _, name := range []string{"data-db-1", "data-db-0", "data-db-backup", "data-dbx-0", "other"} {
+		pvc, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Create(context.TODO(), &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": name}},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Add(pvc))
+	}
+	assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Add(&corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-db-2", Namespace: "other"},
+	}))
+
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim: snapshotgroup.SnapshotClaim{StatefulSet: "db"},
+		},
+	}
+	assert.True(t, HasMultipleClaims(sg))
+	names, err := getClaimNames(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data-db-0", "data-db-1"}, names)
+
+	created, err := createSnapshotForIntervals(sg, []string{"hour"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(created))
+	set := created[0].Set
+	assert.Equal(t, set+"-data-db-0", created[0].Name)
+	assert.Equal(t, set+"-data-db-1", created[1].Name)
+	assert.Equal(t, "data-db-1", created[1].Claim)
+	assert.Equal(t, set, created[1].Set)
+	assert.Equal(t, created[0].Timestamp, created[1].Timestamp, "snapshots in a set share a timestamp")
+	assert.Equal(t, "data-db-1", *created[1].VolumeSnapshot.Spec.Source.PersistentVolumeClaimName)
+
+	sg.Spec.Claim = snapshotgroup.SnapshotClaim{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+	}
+	names, err = getClaimNames(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other"}, names)
+
+	sg.Spec.Claim.Selector.MatchLabels["app"] = "missing"
+	_, err = createSnapshotForIntervals(sg, []string{"hour"})
+	assert.EqualError(t, err, "no PVCs match the SnapshotGroup")
+}
+
+func TestSnapshotSetRetention(t *testing.T) {
+	now := time.Now()
+	newSet := func(name string, timestamp time.Time, ready ...bool) []*GeminiSnapshot {
+		snapshots := []*GeminiSnapshot{}
+		for idx, claim := range []string{"data-0", "data-1"} {
+			snapshots = append(snapshots, &GeminiSnapshot{
+				Name:           name + "-" + claim,
+				Set:            name,
+				Claim:          claim,
+				Intervals:      []string{"hour"},
+				Timestamp:      timestamp,
+				VolumeSnapshot: &snapshotsv1.VolumeSnapshot{Status: &snapshotsv1.VolumeSnapshotStatus{ReadyToUse: &ready[idx]}},
+			})
+		}
+		return snapshots
+	}
+	snapshots := append(newSet("foo-3", now, true, false), newSet("foo-2", now.Add(-time.Hour), true, true)...)
+	snapshots = append(snapshots, newSet("foo-1", now.Add(-2*time.Hour), true, true)...)
+
+	sets := getSnapshotSets(snapshots)
+	assert.Equal(t, []*GeminiSnapshot{snapshots[0], snapshots[2], snapshots[4]}, sets)
+	assert.False(t, isSetReady(sets[0], snapshots), "a set is only ready once all of its snapshots are")
+	assert.True(t, isSetReady(sets[1], snapshots))
+
+	schedule := snapshotgroup.SnapshotSchedule{Every: "hour", Keep: 1}
+	_, toDelete, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, sets, time.UTC, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, snapshots[4:], getSetMembers(toDelete, snapshots), "the whole set is deleted")
+
+	toDelete = getSnapshotsToFinalize(snapshotgroup.DeletionPolicyRetainLatest, snapshots)
+	assert.Equal(t, append(snapshots[:2:2], snapshots[4:]...), toDelete, "the latest complete set is retained")
+}
+
+func TestCreateGroupSnapshot(t *testing.T) {
+	client := kube.SetFakeClient()
+	for _, name := range []string{"data", "wal"} {
+		pvc, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Create(context.TODO(), &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "db"}},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Add(pvc))
+	}
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim:    snapshotgroup.SnapshotClaim{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+			Template: snapshotgroup.SnapshotTemplate{VolumeGroupSnapshotClassName: "csi-group"},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(100)
+	key := getSnapshotGroupKey("default", "foo")
+
+	created, err := createSnapshotForIntervals(sg, []string{"hour"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(created), "the VolumeSnapshots are adopted once they are created")
+	groupClient := client.GroupSnapshotClient.Namespace("default")
+	list, err := groupClient.List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list.Items))
+	group := list.Items[0]
+	className, _, _ := unstructured.NestedString(group.Object, "spec", "volumeGroupSnapshotClassName")
+	assert.Equal(t, "csi-group", className)
+	assert.Equal(t, "2", group.GetAnnotations()[ClaimCountAnnotation])
+
+	waiting, err := reconcileGroupSnapshots(sg, nil, recorder)
+	assert.NoError(t, err)
+	assert.True(t, waiting, "no snapshots are created while the VolumeSnapshots are missing")
+	_, pending := pendingGroupSnapshots.Load(key)
+	assert.True(t, pending)
+
+	// Stand in for the snapshot controller, which creates a VolumeSnapshot of each PVC in the group
+	for _, claim := range []string{"data", "wal"} {
+		member := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": client.VolumeSnapshotVersion,
+			"kind":       "VolumeSnapshot",
+			"spec": map[string]interface{}{
+				"source": map[string]interface{}{"persistentVolumeClaimName": claim},
+			},
+		}}
+		member.SetName("snapshot-" + claim)
+		member.SetNamespace("default")
+		member.SetOwnerReferences([]metav1.OwnerReference{{Kind: kube.VolumeGroupSnapshotKind, Name: group.GetName()}})
+		_, err := client.SnapshotClient.Namespace("default").Create(context.TODO(), member, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	waiting, err = reconcileGroupSnapshots(sg, nil, recorder)
+	assert.NoError(t, err)
+	assert.True(t, waiting, "no snapshots are created until the adopted VolumeSnapshots are listed")
+	assert.Equal(t, "Normal SnapshotCreated Created snapshot set "+group.GetName()+" of 2 PVCs with a VolumeGroupSnapshot", <-recorder.Events)
+	waiting, err = reconcileGroupSnapshots(sg, nil, recorder)
+	assert.NoError(t, err)
+	assert.False(t, waiting)
+	_, pending = pendingGroupSnapshots.Load(key)
+	assert.False(t, pending)
+
+	snapshots, err := ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snapshots), "the VolumeSnapshots are adopted into the SnapshotGroup")
+	assert.ElementsMatch(t, []string{"data", "wal"}, []string{snapshots[0].Claim, snapshots[1].Claim})
+	assert.Equal(t, group.GetName(), snapshots[1].GroupSnapshot)
+	assert.Equal(t, group.GetName(), snapshots[1].Set)
+	assert.Equal(t, []string{"hour"}, snapshots[1].Intervals)
+	assert.Equal(t, "", snapshots[1].VolumeSnapshot.ObjectMeta.Annotations[ClaimCountAnnotation])
+
+	assert.NoError(t, deleteSnapshots(snapshots))
+	_, err = client.GroupSnapshotClient.Namespace("default").Get(context.TODO(), group.GetName(), metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "the VolumeGroupSnapshot is deleted instead of its VolumeSnapshots")
+
+	// VolumeGroupSnapshots whose VolumeSnapshots aren't created in time are deleted
+	for _, snapshot := range snapshots {
+		// The fake client doesn't garbage collect the VolumeSnapshots of the deleted VolumeGroupSnapshot
+		assert.NoError(t, client.SnapshotClient.Namespace("default").Delete(context.TODO(), snapshot.Name, metav1.DeleteOptions{}))
+	}
+	_, err = createSnapshotForIntervals(sg, []string{"day"})
+	assert.NoError(t, err)
+	list, err = groupClient.List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list.Items))
+	stuck := list.Items[0]
+	annotations := stuck.GetAnnotations()
+	annotations[TimestampAnnotation] = strconv.FormatInt(time.Now().Add(-groupSnapshotTimeout-time.Minute).Unix(), 10)
+	stuck.SetAnnotations(annotations)
+	_, err = groupClient.Update(context.TODO(), &stuck, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, err = reconcileGroupSnapshots(sg, nil, recorder)
+	assert.EqualError(t, err, "VolumeGroupSnapshot "+stuck.GetName()+" failed: only 0 of 2 VolumeSnapshots were created after 2m0s")
+	assert.Contains(t, <-recorder.Events, "Warning SnapshotFailed")
+	_, err = groupClient.Get(context.TODO(), stuck.GetName(), metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	client.GroupSnapshotClient = nil
+	created, err = createSnapshotForIntervals(sg, []string{"hour"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(created), "PVCs are snapshotted one at a time without the VolumeGroupSnapshot API")
+	assert.Equal(t, "", created[0].GroupSnapshot)
+}
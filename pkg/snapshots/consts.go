@@ -17,15 +17,107 @@ package snapshots
 // GroupNameAnnotation contains the name of the SnapshotGroup associated with this VolumeSnapshot
 const GroupNameAnnotation = "gemini.fairwinds.com/group"
 
+// GroupNameLabel contains the name of the SnapshotGroup, so VolumeSnapshots can be selected by group.
+// It is only set if the name is a valid label value
+const GroupNameLabel = "gemini.fairwinds.com/group"
+
+// PolicyLabel contains the name of the SnapshotPolicy that generated a SnapshotGroup. It is only set if the name is a valid label value
+const PolicyLabel = "gemini.fairwinds.com/policy"
+
+// ScheduleAnnotation on a PVC asks Gemini to back it up with a SnapshotGroup of the same name, using the compact
+// schedule syntax, e.g. "10 minutes:3, day:14"
+const ScheduleAnnotation = "gemini.fairwinds.com/schedule"
+
+// SnapshotClassAnnotation on a PVC with the schedule annotation sets the VolumeSnapshotClass of its snapshots
+const SnapshotClassAnnotation = "gemini.fairwinds.com/snapshot-class"
+
+// EnrolledClaimAnnotation contains the name of the PVC whose schedule annotation generated a SnapshotGroup
+const EnrolledClaimAnnotation = "gemini.fairwinds.com/enrolled-claim"
+
+// GroupUIDAnnotation contains the UID of the SnapshotGroup that created a VolumeSnapshot or PVC, so that a group
+// recreated with the same name doesn't adopt them
+const GroupUIDAnnotation = "gemini.fairwinds.com/group-uid"
+
 // IntervalsAnnotation contains the intervals that the VolumeSnapshot represents
 const IntervalsAnnotation = "gemini.fairwinds.com/intervals"
 
 // TimestampAnnotation contains the timestamp of the VolumeSnapshot
 const TimestampAnnotation = "gemini.fairwinds.com/timestamp"
 
+// SnapshotNowAnnotation requests a manual snapshot of the SnapshotGroup. A snapshot is taken each time its value changes
+const SnapshotNowAnnotation = "gemini.fairwinds.com/snapshot-now"
+
+// ManualAnnotation contains the snapshot-now token of a manual VolumeSnapshot
+const ManualAnnotation = "gemini.fairwinds.com/manual"
+
 // RestoreAnnotation contains the restore point of the SnapshotGroup
 const RestoreAnnotation = "gemini.fairwinds.com/restore"
 
+// RestoreTargetAnnotation contains the name, or namespace/name, of a new PVC to restore into, instead of replacing the PVC
+const RestoreTargetAnnotation = "gemini.fairwinds.com/restore-target"
+
+// RestoredFromAnnotation contains the namespace/name of the VolumeSnapshot that a PVC or VolumeSnapshot copy was restored from
+const RestoredFromAnnotation = "gemini.fairwinds.com/restored-from"
+
+// RestoredForAnnotation contains the namespace/name of the SnapshotGroup that restored a PVC into another namespace.
+// It is set on the PVC and on the copy of the VolumeSnapshot it was restored from, so the copy can be cleaned up
+const RestoredForAnnotation = "gemini.fairwinds.com/restored-for"
+
+// AllowRestoreFromAnnotation on a namespace allows SnapshotGroups in other namespaces to restore into it. It contains
+// a comma-separated list of namespaces, or * for any namespace
+const AllowRestoreFromAnnotation = "gemini.fairwinds.com/allow-restore-from"
+
+// SnapshotSetAnnotation contains the ID of the set of VolumeSnapshots taken together, when a SnapshotGroup backs up several PVCs
+const SnapshotSetAnnotation = "gemini.fairwinds.com/snapshot-set"
+
+// ClaimAnnotation contains the name of the PVC a VolumeSnapshot in a snapshot set was taken of
+const ClaimAnnotation = "gemini.fairwinds.com/claim"
+
+// GroupSnapshotAnnotation contains the name of the VolumeGroupSnapshot that a VolumeSnapshot in a snapshot set was created by
+const GroupSnapshotAnnotation = "gemini.fairwinds.com/volume-group-snapshot"
+
+// ClaimCountAnnotation contains the number of PVCs a VolumeGroupSnapshot was created for, which is how many
+// VolumeSnapshots the snapshot controller creates for it
+const ClaimCountAnnotation = "gemini.fairwinds.com/claim-count"
+
+// ReportedErrorAnnotation contains the error of a VolumeSnapshot that a Warning Event was recorded for, so that each error is only reported once
+const ReportedErrorAnnotation = "gemini.fairwinds.com/reported-error"
+
+// HookResultsAnnotation contains the JSON encoded results of the hooks run around the VolumeSnapshot
+const HookResultsAnnotation = "gemini.fairwinds.com/hook-results"
+
+// AllowHooksAnnotation set to "true" on a Pod allows the hooks of SnapshotGroups to run in it, when it is selected
+// by a hook's podSelector without mounting one of the group's PVCs
+const AllowHooksAnnotation = "gemini.fairwinds.com/allow-hooks"
+
+// QuiescedByAnnotation is set on a workload that Gemini scaled down to restore a PVC, to the name of the SnapshotGroup
+const QuiescedByAnnotation = "gemini.fairwinds.com/quiesced-by"
+
+// QuiescedByLabel is set alongside QuiescedByAnnotation, so that the workloads scaled down for a SnapshotGroup can
+// be listed with a label selector. It's left off if the name of the SnapshotGroup isn't a valid label value
+const QuiescedByLabel = "gemini.fairwinds.com/quiesced-by"
+
+// OriginalReplicasAnnotation records the replica count of a workload before Gemini scaled it down
+const OriginalReplicasAnnotation = "gemini.fairwinds.com/original-replicas"
+
+// Finalizer is added to SnapshotGroups whose deletion policy requires cleanup when they are deleted
+const Finalizer = "gemini.fairwinds.com/finalizer"
+
 const managedByAnnotation = "app.kubernetes.io/managed-by"
+const managedByLabel = "app.kubernetes.io/managed-by"
 const managerName = "gemini"
 const intervalsSeparator = ", "
+const manualSuffix = "-manual"
+const failsafeSuffix = "-failsafe"
+const defaultKeepManual = 3
+const policyNameHashLength = 8
+
+// snapshotGroupIndex indexes VolumeSnapshots by the namespace and name of their SnapshotGroup
+const snapshotGroupIndex = "snapshotGroup"
+
+// snapshotCopyIndex indexes copies of VolumeSnapshots in other namespaces by the namespace and name of the SnapshotGroup
+// that made them
+const snapshotCopyIndex = "snapshotCopy"
+
+// groupSnapshotIndex indexes VolumeSnapshots by the namespace and name of the VolumeGroupSnapshot that created them
+const groupSnapshotIndex = "groupSnapshot"
@@ -0,0 +1,52 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// Reasons for the Events recorded on SnapshotGroups and their PVCs
+const (
+	ReasonSnapshotCreated          = "SnapshotCreated"
+	ReasonSnapshotDeleted          = "SnapshotDeleted"
+	ReasonSnapshotFailed           = "SnapshotFailed"
+	ReasonRestoreStarted           = "RestoreStarted"
+	ReasonFailsafeSnapshotTimedOut = "FailsafeSnapshotTimedOut"
+	ReasonRestoreCompleted         = "RestoreCompleted"
+	ReasonRestoreFailed            = "RestoreFailed"
+	ReasonPVCDeleted               = "PVCDeleted"
+	ReasonWorkloadScaledDown       = "WorkloadScaledDown"
+	ReasonWorkloadScaledUp         = "WorkloadScaledUp"
+	ReasonHookFailed               = "HookFailed"
+)
+
+// Reasons for the Events recorded on SnapshotPolicies, and on PVCs with the schedule annotation
+const (
+	ReasonSnapshotGroupCreated = "SnapshotGroupCreated"
+	ReasonSnapshotGroupDeleted = "SnapshotGroupDeleted"
+	ReasonInvalidSchedule      = "InvalidSchedule"
+)
+
+// recordEvent records an Event on the SnapshotGroup, and on its PVC if there is one
+func recordEvent(recorder record.EventRecorder, sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim, eventType, reason, messageFmt string, args ...interface{}) {
+	recorder.Eventf(sg, eventType, reason, messageFmt, args...)
+	if pvc != nil {
+		recorder.Eventf(pvc, eventType, reason, messageFmt, args...)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// getDeletionPolicy returns the deletion policy of the SnapshotGroup, defaulting to Retain
+func getDeletionPolicy(sg *snapshotgroup.SnapshotGroup) (string, error) {
+	switch sg.Spec.DeletionPolicy {
+	case "", snapshotgroup.DeletionPolicyRetain:
+		return snapshotgroup.DeletionPolicyRetain, nil
+	case snapshotgroup.DeletionPolicyDelete, snapshotgroup.DeletionPolicyRetainLatest:
+		return sg.Spec.DeletionPolicy, nil
+	}
+	return "", fmt.Errorf("unknown deletion policy %q", sg.Spec.DeletionPolicy)
+}
+
+// hasFinalizer returns true if the SnapshotGroup has Gemini's finalizer
+func hasFinalizer(sg *snapshotgroup.SnapshotGroup) bool {
+	for _, finalizer := range sg.ObjectMeta.Finalizers {
+		if finalizer == Finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureFinalizer adds Gemini's finalizer if the deletion policy requires cleanup, and removes it otherwise.
+// Retain needs no cleanup, so the SnapshotGroup can still be deleted if Gemini is uninstalled.
+func ensureFinalizer(sg *snapshotgroup.SnapshotGroup) error {
+	policy, err := getDeletionPolicy(sg)
+	if err != nil {
+		return err
+	}
+	return setFinalizer(sg, policy != snapshotgroup.DeletionPolicyRetain)
+}
+
+// setFinalizer adds or removes Gemini's finalizer on the latest version of the SnapshotGroup
+func setFinalizer(sg *snapshotgroup.SnapshotGroup, present bool) error {
+	if hasFinalizer(sg) == present {
+		return nil
+	}
+	client := kube.GetClient()
+	sgClient := client.SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := sgClient.Get(context.TODO(), sg.ObjectMeta.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hasFinalizer(latest) == present {
+			return nil
+		}
+		if present {
+			klog.V(5).Infof("%s/%s: adding finalizer", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+			latest.ObjectMeta.Finalizers = append(latest.ObjectMeta.Finalizers, Finalizer)
+		} else {
+			klog.V(5).Infof("%s/%s: removing finalizer", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+			finalizers := []string{}
+			for _, finalizer := range latest.ObjectMeta.Finalizers {
+				if finalizer != Finalizer {
+					finalizers = append(finalizers, finalizer)
+				}
+			}
+			latest.ObjectMeta.Finalizers = finalizers
+		}
+		_, err = sgClient.Update(context.TODO(), latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// FinalizeSnapshotGroup applies the deletion policy of a SnapshotGroup that is being deleted,
+// then removes the finalizer so that the deletion can complete
+func FinalizeSnapshotGroup(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	if !hasFinalizer(sg) {
+		klog.V(5).Infof("%s/%s: waiting for deletion to complete", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		return nil
+	}
+	policy, err := getDeletionPolicy(sg)
+	if err != nil {
+		// The policy can't be changed once deletion has started, so fall back to the safest one
+		klog.Warningf("%s/%s: %v, retaining snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		policy = snapshotgroup.DeletionPolicyRetain
+	}
+	klog.V(3).Infof("%s/%s: applying deletion policy %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, policy)
+	snapshots, err := ListSnapshots(sg)
+	if err != nil {
+		return err
+	}
+	toDelete := getSnapshotsToFinalize(policy, snapshots)
+	if err := deleteSnapshots(toDelete); err != nil {
+		recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonSnapshotFailed, "Failed to delete snapshots: %v", err)
+		return err
+	}
+	for _, snapshot := range toDelete {
+		recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonSnapshotDeleted, "Deleted snapshot %s because the SnapshotGroup was deleted", snapshot.Name)
+	}
+	klog.V(3).Infof("%s/%s: deleted %d of %d snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(toDelete), len(snapshots))
+
+	if policy == snapshotgroup.DeletionPolicyDelete {
+		if err := deleteCreatedPVC(sg, recorder); err != nil {
+			return err
+		}
+	}
+	return setFinalizer(sg, false)
+}
+
+// getSnapshotsToFinalize returns the snapshots to delete under the given policy.
+// Snapshots are sorted newest first. RetainLatest keeps the newest snapshot that is ready to use,
+// or the newest snapshot if none are ready yet.
+func getSnapshotsToFinalize(policy string, snapshots []*GeminiSnapshot) []*GeminiSnapshot {
+	switch policy {
+	case snapshotgroup.DeletionPolicyDelete:
+		return snapshots
+	case snapshotgroup.DeletionPolicyRetainLatest:
+		sets := getSnapshotSets(snapshots)
+		if len(sets) == 0 {
+			return snapshots
+		}
+		latest := 0
+		for idx, set := range sets {
+			if isSetReady(set, snapshots) {
+				latest = idx
+				break
+			}
+		}
+		toDelete := append([]*GeminiSnapshot{}, sets[:latest]...)
+		return getSetMembers(append(toDelete, sets[latest+1:]...), snapshots)
+	}
+	return []*GeminiSnapshot{}
+}
+
+// deleteCreatedPVC deletes the PVC of the SnapshotGroup, but only if Gemini created it
+func deleteCreatedPVC(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	if HasMultipleClaims(sg) {
+		return nil
+	}
+	if sg.Spec.Claim.Name != "" {
+		klog.V(5).Infof("%s/%s: retaining existing PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, sg.Spec.Claim.Name)
+		return nil
+	}
+	pvc, err := getPVC(sg)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isCreatedPVC(sg, pvc) {
+		klog.V(5).Infof("%s/%s: retaining PVC %s, which was not created by Gemini", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, pvc.ObjectMeta.Name)
+		return nil
+	}
+	if err := deletePVC(sg); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonPVCDeleted, "Deleted PVC %s because the SnapshotGroup was deleted", pvc.ObjectMeta.Name)
+	return nil
+}
+
+// OnSnapshotGroupDelete is called when a SnapshotGroup is removed
+func OnSnapshotGroupDelete(sg *snapshotgroup.SnapshotGroup) error {
+	name := sg.ObjectMeta.Name
+	namespace := sg.ObjectMeta.Namespace
+	metrics.DeleteGroup(namespace, name)
+	klog.V(3).Infof("%s/%s: was deleted", namespace, name)
+	return nil
+}
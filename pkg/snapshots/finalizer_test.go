@@ -0,0 +1,41 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"testing"
+
+	snapshotsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/stretchr/testify/assert"
+
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestGetSnapshotsToFinalize(t *testing.T) {
+	ready := true
+	existing := []*GeminiSnapshot{
+		&GeminiSnapshot{Name: "pending"},
+		&GeminiSnapshot{Name: "ready", VolumeSnapshot: &snapshotsv1.VolumeSnapshot{Status: &snapshotsv1.VolumeSnapshotStatus{ReadyToUse: &ready}}},
+		&GeminiSnapshot{Name: "old"},
+	}
+	assert.Equal(t, []*GeminiSnapshot{}, getSnapshotsToFinalize(snapshotgroup.DeletionPolicyRetain, existing))
+	assert.Equal(t, existing, getSnapshotsToFinalize(snapshotgroup.DeletionPolicyDelete, existing))
+	assert.Equal(t, []*GeminiSnapshot{existing[0], existing[2]}, getSnapshotsToFinalize(snapshotgroup.DeletionPolicyRetainLatest, existing))
+	assert.Equal(t, []*GeminiSnapshot{existing[2]}, getSnapshotsToFinalize(snapshotgroup.DeletionPolicyRetainLatest, []*GeminiSnapshot{existing[0], existing[2]}))
+	assert.Equal(t, []*GeminiSnapshot{}, getSnapshotsToFinalize(snapshotgroup.DeletionPolicyRetainLatest, []*GeminiSnapshot{}))
+
+	_, err := getDeletionPolicy(&snapshotgroup.SnapshotGroup{Spec: snapshotgroup.SnapshotGroupSpec{DeletionPolicy: "Archive"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// isClaimRestored returns true if the PVC of a generated SnapshotGroup is being, or has been, replaced by a restore.
+// Restored PVCs don't have the labels of the original, so they must not be mistaken for PVCs that stopped matching
+func isClaimRestored(sg *snapshotgroup.SnapshotGroup) bool {
+	restoring := meta.FindStatusCondition(sg.Status.Conditions, snapshotgroup.ConditionRestoring)
+	if restoring != nil && restoring.Status == metav1.ConditionTrue {
+		return true
+	}
+	pvc, err := getPVC(sg)
+	if err != nil {
+		return false
+	}
+	return pvc.ObjectMeta.Annotations[managedByAnnotation] == managerName && pvc.ObjectMeta.Annotations[RestoreAnnotation] != ""
+}
+
+// applyGeneratedSnapshotGroup creates the desired SnapshotGroup, or updates the spec and labels of the existing one if
+// they have drifted. existing may be nil or stale, as it comes from the informer cache. A SnapshotGroup with the same
+// name that isManaged doesn't recognize is left alone. It returns true if the SnapshotGroup was created
+func applyGeneratedSnapshotGroup(desired, existing *snapshotgroup.SnapshotGroup, manager string, isManaged func(*snapshotgroup.SnapshotGroup) bool) (bool, error) {
+	client := kube.GetClient()
+	sgClient := client.SnapshotGroupClient.SnapshotGroups(desired.ObjectMeta.Namespace)
+	inSync := func(sg *snapshotgroup.SnapshotGroup) bool {
+		return equality.Semantic.DeepEqual(sg.Spec, desired.Spec) && equality.Semantic.DeepEqual(sg.ObjectMeta.Labels, desired.ObjectMeta.Labels)
+	}
+	if existing == nil {
+		_, err := sgClient.Create(context.TODO(), desired, metav1.CreateOptions{})
+		if err == nil {
+			return true, nil
+		}
+		if !errors.IsAlreadyExists(err) {
+			return false, fmt.Errorf("could not create SnapshotGroup %s/%s: %w", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, err)
+		}
+		// The informer cache may not have seen the SnapshotGroup yet
+	} else if inSync(existing) {
+		return false, nil
+	}
+	return false, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := sgClient.Get(context.TODO(), desired.ObjectMeta.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !isManaged(latest) {
+			return fmt.Errorf("SnapshotGroup %s/%s already exists and is not managed by %s", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, manager)
+		}
+		if inSync(latest) {
+			return nil
+		}
+		klog.V(3).Infof("%s/%s: updating SnapshotGroup to match %s", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, manager)
+		latest.ObjectMeta.Labels = desired.ObjectMeta.Labels
+		latest.Spec = desired.Spec
+		_, err = sgClient.Update(context.TODO(), latest, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -15,95 +15,311 @@
 package snapshots
 
 import (
-	"context"
 	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
-	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
 	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
 )
 
-func updateSnapshotGroup(sg *snapshotgroup.SnapshotGroup) error {
-	klog.V(5).Infof("%s/%s: updating PVC spec", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
-	client := kube.GetClient()
-	sg.Spec.Claim.Spec.VolumeName = ""
-	_, err := client.SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace).Update(context.Background(), sg, metav1.UpdateOptions{})
-	return err
+// ReconcileBackupsForSnapshotGroup handles any changes to SnapshotGroups.
+// It returns the time the next snapshot is due, which is zero if it could not be determined.
+func ReconcileBackupsForSnapshotGroup(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) (time.Time, error) {
+	klog.V(5).Infof("%s/%s: reconciling", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	pvc, snapshots, err := reconcileBackups(sg, recorder)
+	hookFailed := isPreHookFailure(err)
+	if hookFailed {
+		// Retrying straight away would run the hooks again, so the snapshot is put off until its schedule is next due
+		klog.Warningf("%s/%s: %v, retrying on the schedule", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		sg = sg.DeepCopy()
+		now := metav1.Now()
+		sg.Status.LastHookFailureTime = &now
+	}
+	nextSnapshots, statusErr := updateBackupStatus(sg, pvc, snapshots, err)
+	if err != nil && !hookFailed {
+		if statusErr != nil {
+			klog.Warningf("%s/%s: failed to update status - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, statusErr)
+		}
+		return time.Time{}, err
+	}
+	next := getNextSnapshotTime(nextSnapshots)
+	if _, ok := pendingGroupSnapshots.Load(getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)); ok {
+		// The VolumeSnapshots of a VolumeGroupSnapshot don't trigger a reconcile until they are adopted
+		retry := time.Now().Add(groupSnapshotRequeueDelay)
+		if next.IsZero() || retry.Before(next) {
+			next = retry
+		}
+	}
+	return next, statusErr
 }
 
-// ReconcileBackupsForSnapshotGroup handles any changes to SnapshotGroups
-func ReconcileBackupsForSnapshotGroup(sg *snapshotgroup.SnapshotGroup) error {
-	klog.V(5).Infof("%s/%s: reconciling", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
-	pvc, err := maybeCreatePVC(sg)
+// ReconcileSuspendedSnapshotGroup updates the status of a suspended SnapshotGroup, without creating or deleting snapshots
+func ReconcileSuspendedSnapshotGroup(sg *snapshotgroup.SnapshotGroup) error {
+	klog.V(3).Infof("%s/%s: suspended, not creating or deleting snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	err := ensureFinalizer(sg)
+	_, statusErr := updateBackupStatus(sg, nil, nil, err)
 	if err != nil {
 		return err
 	}
-	sg.Spec.Claim.Spec = pvc.Spec
-	err = updateSnapshotGroup(sg)
-	if err != nil {
-		return err
+	return statusErr
+}
+
+// getNextSnapshotTime returns the earliest of the scheduled snapshots
+func getNextSnapshotTime(nextSnapshots []snapshotgroup.ScheduledSnapshot) time.Time {
+	next := time.Time{}
+	for _, scheduled := range nextSnapshots {
+		if next.IsZero() || scheduled.Time.Time.Before(next) {
+			next = scheduled.Time.Time
+		}
 	}
+	return next
+}
 
+// reconcileBackups creates and deletes snapshots as required by the schedule, and returns the PVC being backed up.
+// If it succeeds, it also returns the snapshots of the group after the changes it made
+func reconcileBackups(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) (*corev1.PersistentVolumeClaim, []*GeminiSnapshot, error) {
+	if err := ensureFinalizer(sg); err != nil {
+		return nil, nil, err
+	}
+	var pvc *corev1.PersistentVolumeClaim
+	if !HasMultipleClaims(sg) {
+		var err error
+		pvc, err = maybeCreatePVC(sg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := resumeInterruptedRestore(sg, recorder); err != nil {
+			klog.Warningf("%s/%s: failed to scale workloads back up after restore - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		}
+	}
+
+	waitingForGroupSnapshot, err := reconcileGroupSnapshots(sg, pvc, recorder)
+	if err != nil {
+		return pvc, nil, err
+	}
 	snapshots, err := ListSnapshots(sg)
 	if err != nil {
-		return err
+		return pvc, nil, err
 	}
 	klog.V(5).Infof("%s/%s: found %d existing snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(snapshots))
+	if err := updateSnapshotMetadata(sg, snapshots); err != nil {
+		klog.Warningf("%s/%s: failed to update snapshot metadata - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	if err := reportSnapshotErrors(sg, pvc, snapshots, recorder); err != nil {
+		klog.Warningf("%s/%s: failed to report snapshot errors - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	if err := cleanupSnapshotCopies(sg); err != nil {
+		klog.Warningf("%s/%s: failed to clean up copies of snapshots in other namespaces - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
 
-	toCreate, toDelete, err := getSnapshotChanges(sg.Spec.Schedule, snapshots)
+	location, err := getLocation(sg)
 	if err != nil {
-		return err
+		return pvc, nil, err
+	}
+	// Snapshot sets are scheduled and retained as one snapshot
+	sets := getSnapshotSets(snapshots)
+	toCreate, toDelete, err := getSnapshotChanges(sg.Spec.Schedule, sets, location, sg.ObjectMeta.CreationTimestamp.Time)
+	if err != nil {
+		return pvc, nil, err
+	}
+	toCreate, err = deferFailedHooks(sg, toCreate, location)
+	if err != nil {
+		return pvc, nil, err
+	}
+	manualToken := getManualSnapshotToken(sg)
+	needsManual := manualToken != "" && findManualSnapshot(sets, manualToken) == nil
+	if waitingForGroupSnapshot && (len(toCreate) > 0 || needsManual) {
+		// The snapshots of the VolumeGroupSnapshot may be the ones that are due
+		klog.V(3).Infof("%s/%s: waiting for a VolumeGroupSnapshot before creating snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		toCreate, manualToken, needsManual = nil, "", false
 	}
+	toDelete = getSetMembers(toDelete, snapshots)
 	klog.V(3).Infof("%s/%s: going to create %d, delete %d snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(toCreate), len(toDelete))
 
-	err = deleteSnapshots(toDelete)
-	if err != nil {
+	if err := deleteExpiredSnapshots(sg, toDelete, recorder); err != nil {
+		return pvc, nil, err
+	}
+
+	created := []*GeminiSnapshot{}
+	if len(toCreate) > 0 || needsManual {
+		created, err = takeSnapshotsWithHooks(sg, recorder, func() ([]*GeminiSnapshot, error) {
+			return createScheduledSnapshots(sg, pvc, toCreate, manualToken, needsManual, recorder)
+		})
+		if err != nil {
+			expectSnapshotChanges(sg, created, toDelete)
+			return pvc, nil, err
+		}
+		if sg.Status.LastHookFailureTime != nil {
+			// The hooks work again, so any other snapshots they put off are retried straight away
+			err := updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+				status.LastHookFailureTime = nil
+			})
+			if err != nil {
+				expectSnapshotChanges(sg, created, toDelete)
+				return pvc, nil, err
+			}
+		}
+	}
+	// Manual snapshots are only pruned once the new one exists, so a failed snapshot never leaves fewer than keepManual
+	expiredManual := getSetMembers(getExpiredManualSnapshots(sg, sets, needsManual), snapshots)
+	if err := deleteExpiredSnapshots(sg, expiredManual, recorder); err != nil {
+		expectSnapshotChanges(sg, created, toDelete)
+		return pvc, nil, err
+	}
+	toDelete = append(toDelete, expiredManual...)
+	if manualToken != "" {
+		// Record the token so that the snapshot is only taken once
+		err := updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+			status.LastManualSnapshot = manualToken
+		})
+		if err != nil {
+			expectSnapshotChanges(sg, created, toDelete)
+			return pvc, nil, err
+		}
+	}
+	expectSnapshotChanges(sg, created, toDelete)
+	return pvc, applySnapshotChanges(snapshots, created, toDelete), nil
+}
+
+// deleteExpiredSnapshots deletes snapshots that are no longer retained, and records an event for each of them
+func deleteExpiredSnapshots(sg *snapshotgroup.SnapshotGroup, toDelete []*GeminiSnapshot, recorder record.EventRecorder) error {
+	if len(toDelete) == 0 {
+		return nil
+	}
+	if err := deleteSnapshots(toDelete); err != nil {
+		recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonSnapshotFailed, "Failed to delete expired snapshots: %v", err)
 		return err
 	}
+	metrics.SnapshotsDeleted.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Add(float64(len(toDelete)))
+	for _, snapshot := range toDelete {
+		recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonSnapshotDeleted, "Deleted expired snapshot %s", snapshot.Name)
+	}
 	klog.V(3).Infof("%s/%s: deleted %d snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(toDelete))
+	return nil
+}
 
-	_, err = createSnapshotForIntervals(sg, toCreate)
+// createScheduledSnapshots creates a snapshot for the intervals that are due, and a manual snapshot if one was requested
+func createScheduledSnapshots(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim, toCreate []string, manualToken string, needsManual bool, recorder record.EventRecorder) ([]*GeminiSnapshot, error) {
+	created, err := createSnapshotForIntervals(sg, toCreate)
 	if err != nil {
-		return err
+		metrics.SnapshotsFailed.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonSnapshotFailed, "Failed to create snapshot for intervals %v: %v", toCreate, err)
+		return created, err
+	}
+	for _, snapshot := range created {
+		metrics.SnapshotsCreated.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+		recordEvent(recorder, sg, pvc, corev1.EventTypeNormal, ReasonSnapshotCreated, "Created snapshot %s for intervals %v", snapshot.Name, toCreate)
 	}
-	klog.V(3).Infof("%s/%s: created %d snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(toCreate))
+	klog.V(3).Infof("%s/%s: created %d snapshots", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(created))
 
-	return nil
+	if needsManual {
+		manual, err := createSnapshotForManual(sg, manualToken)
+		if err != nil {
+			metrics.SnapshotsFailed.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+			recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonSnapshotFailed, "Failed to create manual snapshot for %s: %v", manualToken, err)
+			return created, err
+		}
+		for _, snapshot := range manual {
+			metrics.SnapshotsCreated.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+			recordEvent(recorder, sg, pvc, corev1.EventTypeNormal, ReasonSnapshotCreated, "Created manual snapshot %s for %s", snapshot.Name, manualToken)
+		}
+		created = append(created, manual...)
+	}
+	return created, nil
 }
 
 // RestoreSnapshotGroup restores the PV to a particular snapshot
-func RestoreSnapshotGroup(sg *snapshotgroup.SnapshotGroup, waitForRestoreSeconds int) error {
+func RestoreSnapshotGroup(sg *snapshotgroup.SnapshotGroup, waitForRestoreSeconds int, recorder record.EventRecorder) error {
 	restorePoint := sg.ObjectMeta.Annotations[RestoreAnnotation]
 	if restorePoint == "" {
 		err := fmt.Errorf("%s/%s: has an empty restore annotation", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
 		return err
 	}
+	if HasMultipleClaims(sg) {
+		setRestoreFailedStatus(sg, errMultipleClaimsRestore)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonRestoreFailed, "Failed to restore to %s: %v", restorePoint, errMultipleClaimsRestore)
+		return errMultipleClaimsRestore
+	}
+	if target := sg.ObjectMeta.Annotations[RestoreTargetAnnotation]; target != "" {
+		return restoreToNewPVC(sg, restorePoint, target, recorder)
+	}
+	pvc, err := getPVC(sg)
+	if errors.IsNotFound(err) {
+		pvc = nil
+	} else if err != nil {
+		return err
+	}
+	if pvc != nil && pvc.ObjectMeta.DeletionTimestamp == nil && pvc.ObjectMeta.Annotations[RestoreAnnotation] == restorePoint {
+		// The PVC was restored, but the controller stopped before recording it, so only the rest is resumed
+		klog.V(3).Infof("%s/%s: PVC was already restored to %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, restorePoint)
+		return completeRestore(sg, pvc, restorePoint, recorder)
+	}
 	klog.V(3).Infof("%s/%s: restoring to %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, restorePoint)
-	snap, err := createSnapshotForRestore(sg)
+	if err := setRestoringStatus(sg, nil, false); err != nil {
+		return err
+	}
+	recordEvent(recorder, sg, pvc, corev1.EventTypeNormal, ReasonRestoreStarted, "Restoring PVC %s to %s", GetPVCName(sg), restorePoint)
+	if err := quiesceWorkloads(sg, recorder); err != nil {
+		klog.Errorf("%s/%s: could not scale down workloads before restore - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		setRestoreFailedStatus(sg, err)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonRestoreFailed, "Could not scale down workloads using PVC %s: %v", GetPVCName(sg), err)
+		resumeWorkloadsIfPVCExists(sg, recorder)
+		return err
+	}
+	if err := waitForPodsToTerminate(sg, quiesceTimeout); err != nil {
+		klog.Errorf("%s/%s: pods using PVC %s did not terminate - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, GetPVCName(sg), err)
+		setRestoreFailedStatus(sg, err)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonRestoreFailed, "Pods using PVC %s did not terminate after %s: %v", GetPVCName(sg), quiesceTimeout, err)
+		resumeWorkloadsIfPVCExists(sg, recorder)
+		return err
+	}
+	snap, err := createSnapshotForRestore(sg, restorePoint)
 	if err != nil {
 		klog.Errorf("%s/%s: could not create failsafe snapshot before restore - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		setRestoreFailedStatus(sg, err)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonRestoreFailed, "Could not create failsafe snapshot before restore: %v", err)
+		resumeWorkloadsIfPVCExists(sg, recorder)
 		return err
 	}
 	_, err = waitUntilSnapshotReady(snap.Namespace, snap.Name, waitForRestoreSeconds)
 	if err != nil {
 		klog.Warningf("%s/%s: failed to create failsafe snapshot before restore - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
 		klog.Warningf("%s/%s: proceeding with restore anyway", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonFailsafeSnapshotTimedOut, "Failsafe snapshot %s was not ready after %ds, proceeding with restore anyway", snap.Name, waitForRestoreSeconds)
 	}
-	err = restorePVC(sg)
+	restored, err := restorePVC(sg, restorePoint)
 	if err != nil {
 		klog.Warningf("%s/%s: failed to restore PVC - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		setRestoreFailedStatus(sg, err)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonRestoreFailed, "Failed to restore PVC %s to %s: %v", GetPVCName(sg), restorePoint, err)
+		resumeWorkloadsIfPVCExists(sg, recorder)
 		return err
 	}
-	return nil
+	return completeRestore(sg, restored, restorePoint, recorder)
 }
 
-// OnSnapshotGroupDelete is called when a SnapshotGroup is removed
-func OnSnapshotGroupDelete(sg *snapshotgroup.SnapshotGroup) error {
-	// TODO(rbren): option to delete snapshots on group deletion
-	name := sg.ObjectMeta.Name
-	namespace := sg.ObjectMeta.Namespace
-	klog.V(3).Infof("%s/%s was deleted. Taking no action. You may want to run kubectl delete volumesnapshots --all --namespace %s", namespace, name, namespace)
+// completeRestore scales workloads back up once the PVC has been restored, and records that the restore finished.
+// The restored PVC has the restore annotation, so if recording it fails, retrying the restore only does this again
+func completeRestore(sg *snapshotgroup.SnapshotGroup, restored *corev1.PersistentVolumeClaim, restorePoint string, recorder record.EventRecorder) error {
+	if err := resumeWorkloads(sg, recorder); err != nil {
+		// The next reconcile scales them back up
+		klog.Warningf("%s/%s: failed to scale workloads back up after restore - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	if err := setRestoringStatus(sg, nil, true); err != nil {
+		return err
+	}
+	metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "success").Inc()
+	recordEvent(recorder, sg, restored, corev1.EventTypeNormal, ReasonRestoreCompleted, "Restored PVC %s to %s", restored.ObjectMeta.Name, restorePoint)
 	return nil
 }
@@ -0,0 +1,324 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// groupSnapshotTimeout is how long the snapshot controller has to create the VolumeSnapshots of a VolumeGroupSnapshot
+const groupSnapshotTimeout = 2 * time.Minute
+
+// groupSnapshotRequeueDelay is how often a SnapshotGroup is reconciled while it waits for the VolumeSnapshots of a
+// VolumeGroupSnapshot. They aren't managed by Gemini until they are adopted, so creating them doesn't trigger a reconcile
+const groupSnapshotRequeueDelay = 5 * time.Second
+
+// pendingGroupSnapshots holds the keys of the SnapshotGroups waiting for the VolumeSnapshots of a VolumeGroupSnapshot
+var pendingGroupSnapshots sync.Map
+
+// useGroupSnapshot returns true if the PVCs of the SnapshotGroup should be snapshotted with a single VolumeGroupSnapshot
+func useGroupSnapshot(sg *snapshotgroup.SnapshotGroup) bool {
+	if sg.Spec.Template.VolumeGroupSnapshotClassName == "" {
+		return false
+	}
+	if sg.Spec.Claim.Selector == nil {
+		klog.V(3).Infof("%s/%s: VolumeGroupSnapshots need a PVC selector, snapshotting PVCs one at a time", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		return false
+	}
+	if kube.GetClient().GroupSnapshotClient == nil {
+		klog.Warningf("%s/%s: VolumeGroupSnapshots are not available, snapshotting PVCs one at a time", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		return false
+	}
+	return true
+}
+
+// createGroupSnapshot creates a VolumeGroupSnapshot of the PVCs matching the selector. The VolumeSnapshots the snapshot
+// controller creates for it are adopted as a snapshot set by reconcileGroupSnapshots, so none are returned
+func createGroupSnapshot(sg *snapshotgroup.SnapshotGroup, set string, numClaims int, annotations map[string]string) ([]*GeminiSnapshot, error) {
+	client := kube.GetClient()
+	selector, err := runtime.DefaultUnstructuredConverter.ToUnstructured(sg.Spec.Claim.Selector)
+	if err != nil {
+		return nil, err
+	}
+	group := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": client.VolumeGroupSnapshotVersion,
+		"kind":       kube.VolumeGroupSnapshotKind,
+		"spec": map[string]interface{}{
+			"volumeGroupSnapshotClassName": sg.Spec.Template.VolumeGroupSnapshotClassName,
+			"source": map[string]interface{}{
+				"selector": selector,
+			},
+		},
+	}}
+	group.SetName(set)
+	group.SetNamespace(sg.ObjectMeta.Namespace)
+	group.SetLabels(getSnapshotLabels(sg))
+	groupAnnotations := map[string]string{ClaimCountAnnotation: strconv.Itoa(numClaims)}
+	for key, value := range annotations {
+		groupAnnotations[key] = value
+	}
+	group.SetAnnotations(groupAnnotations)
+	group.SetOwnerReferences(getOwnerReferences(sg))
+
+	klog.V(3).Infof("%s/%s: creating VolumeGroupSnapshot %s of %d PVCs", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, set, numClaims)
+	groupClient := client.GroupSnapshotClient.Namespace(sg.ObjectMeta.Namespace)
+	if _, err := groupClient.Create(context.TODO(), group, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+	// The VolumeSnapshots are adopted by a later reconcile, once the snapshot controller has created them
+	pendingGroupSnapshots.Store(getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name), true)
+	if sg.Spec.Hooks != nil && len(sg.Spec.Hooks.Post) > 0 {
+		// Post hooks wait for the snapshots to be cut, which happens for all of them when the VolumeGroupSnapshot is
+		if err := waitForGroupSnapshotCreation(sg.ObjectMeta.Namespace, set, hookSnapshotTimeout); err != nil {
+			klog.Warningf("%s/%s: running post hooks before VolumeGroupSnapshot %s was cut - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, set, err)
+		}
+	}
+	return nil, nil
+}
+
+// waitForGroupSnapshotCreation waits until the CSI driver has cut the snapshots of a VolumeGroupSnapshot
+func waitForGroupSnapshotCreation(namespace, name string, timeout time.Duration) error {
+	groupClient := kube.GetClient().GroupSnapshotClient.Namespace(namespace)
+	return wait.PollImmediate(hookPollInterval, timeout, func() (bool, error) {
+		group, err := groupClient.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if message := getGroupSnapshotError(group); message != "" {
+			return false, errors.New(message)
+		}
+		_, found, _ := unstructured.NestedString(group.Object, "status", "creationTime")
+		return found, nil
+	})
+}
+
+// getGroupSnapshotError returns the error the snapshot controller reported for a VolumeGroupSnapshot
+func getGroupSnapshotError(group *unstructured.Unstructured) string {
+	message, _, _ := unstructured.NestedString(group.Object, "status", "error", "message")
+	return message
+}
+
+// indexByGroupSnapshot indexes VolumeSnapshots by the namespace and name of the VolumeGroupSnapshot that created them
+func indexByGroupSnapshot(obj interface{}) ([]string, error) {
+	snapshotMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range snapshotMeta.GetOwnerReferences() {
+		if ref.Kind == kube.VolumeGroupSnapshotKind {
+			return []string{snapshotMeta.GetNamespace() + "/" + ref.Name}, nil
+		}
+	}
+	return nil, nil
+}
+
+// getGroupSnapshotMembers returns the VolumeSnapshots the snapshot controller created for a VolumeGroupSnapshot,
+// sorted by name
+func getGroupSnapshotMembers(namespace, name string) ([]unstructured.Unstructured, error) {
+	client := kube.GetClient()
+	members := []unstructured.Unstructured{}
+	if informer := client.GetSnapshotInformer(namespace); informer != nil && informer.HasSynced() {
+		objs, err := informer.GetIndexer().ByIndex(groupSnapshotIndex, namespace+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if snapshot, ok := obj.(*unstructured.Unstructured); ok {
+				members = append(members, *snapshot)
+			}
+		}
+	} else {
+		list, err := client.SnapshotClient.Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range list.Items {
+			if keys, _ := indexByGroupSnapshot(&snapshot); len(keys) == 1 && keys[0] == namespace+"/"+name {
+				members = append(members, snapshot)
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].GetName() < members[j].GetName()
+	})
+	return members, nil
+}
+
+// reconcileGroupSnapshots adopts the VolumeSnapshots of the SnapshotGroup's VolumeGroupSnapshots once the snapshot
+// controller has created one for each PVC, and deletes the VolumeGroupSnapshots that failed or timed out. It returns
+// true while a VolumeGroupSnapshot is waiting for its VolumeSnapshots, or they were only just adopted, so that no
+// more snapshots are created until they are listed
+func reconcileGroupSnapshots(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim, recorder record.EventRecorder) (bool, error) {
+	client := kube.GetClient()
+	key := getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	pendingGroupSnapshots.Delete(key)
+	if !HasMultipleClaims(sg) || client.GroupSnapshotClient == nil {
+		return false, nil
+	}
+	groupClient := client.GroupSnapshotClient.Namespace(sg.ObjectMeta.Namespace)
+	list, err := groupClient.List(context.TODO(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(getSnapshotLabels(sg)).String()})
+	if err != nil {
+		return false, err
+	}
+	waiting := false
+	for i := range list.Items {
+		group := &list.Items[i]
+		if GetSnapshotGroupName(group) != sg.ObjectMeta.Name || !isOwnedBy(group, sg) || group.GetDeletionTimestamp() != nil {
+			continue
+		}
+		done, err := reconcileGroupSnapshot(sg, group, pvc, recorder)
+		if err != nil {
+			return false, err
+		}
+		waiting = waiting || !done
+	}
+	if waiting {
+		pendingGroupSnapshots.Store(key, true)
+	}
+	return waiting, nil
+}
+
+// reconcileGroupSnapshot adopts the VolumeSnapshots of a VolumeGroupSnapshot, and returns true once they have been
+func reconcileGroupSnapshot(sg *snapshotgroup.SnapshotGroup, group *unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim, recorder record.EventRecorder) (bool, error) {
+	name := group.GetName()
+	members, err := getGroupSnapshotMembers(group.GetNamespace(), name)
+	if err != nil {
+		return false, err
+	}
+	numClaims, _ := strconv.Atoi(group.GetAnnotations()[ClaimCountAnnotation])
+	adopted := 0
+	for _, member := range members {
+		if member.GetAnnotations()[GroupSnapshotAnnotation] == name {
+			adopted++
+		}
+	}
+	if len(members) > 0 && adopted == len(members) && len(members) >= numClaims {
+		return true, nil
+	}
+	if message := getGroupSnapshotError(group); message != "" {
+		return true, failGroupSnapshot(sg, name, pvc, recorder, errors.New(message))
+	}
+	if numClaims > 0 && len(members) >= numClaims {
+		annotations := map[string]string{}
+		for key, value := range group.GetAnnotations() {
+			if key != ClaimCountAnnotation {
+				annotations[key] = value
+			}
+		}
+		created, err := adoptGroupSnapshotMembers(sg, name, members, annotations)
+		if err != nil {
+			return false, err
+		}
+		metrics.SnapshotsCreated.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Add(float64(len(created)))
+		recordEvent(recorder, sg, pvc, corev1.EventTypeNormal, ReasonSnapshotCreated, "Created snapshot set %s of %d PVCs with a VolumeGroupSnapshot", name, len(created))
+		return false, nil
+	}
+	if time.Since(getGroupSnapshotTime(group)) > groupSnapshotTimeout {
+		return true, failGroupSnapshot(sg, name, pvc, recorder, fmt.Errorf("only %d of %d VolumeSnapshots were created after %s", len(members), numClaims, groupSnapshotTimeout))
+	}
+	klog.V(3).Infof("%s/%s: waiting for the VolumeSnapshots of VolumeGroupSnapshot %s, %d of %d created", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, name, len(members), numClaims)
+	return false, nil
+}
+
+// getGroupSnapshotTime returns when Gemini created a VolumeGroupSnapshot
+func getGroupSnapshotTime(group *unstructured.Unstructured) time.Time {
+	if timestamp, err := strconv.Atoi(group.GetAnnotations()[TimestampAnnotation]); err == nil {
+		return time.Unix(int64(timestamp), 0)
+	}
+	return group.GetCreationTimestamp().Time
+}
+
+// failGroupSnapshot deletes a VolumeGroupSnapshot that failed, along with any VolumeSnapshots it created, so that
+// snapshot sets are never incomplete
+func failGroupSnapshot(sg *snapshotgroup.SnapshotGroup, name string, pvc *corev1.PersistentVolumeClaim, recorder record.EventRecorder, err error) error {
+	metrics.SnapshotsFailed.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+	recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonSnapshotFailed, "VolumeGroupSnapshot %s failed: %v", name, err)
+	if deleteErr := deleteGroupSnapshot(sg.ObjectMeta.Namespace, name); deleteErr != nil {
+		klog.Warningf("%s/%s: failed to delete incomplete VolumeGroupSnapshot %s - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, name, deleteErr)
+	}
+	return fmt.Errorf("VolumeGroupSnapshot %s failed: %w", name, err)
+}
+
+// adoptGroupSnapshotMembers labels and annotates the VolumeSnapshots created for a VolumeGroupSnapshot,
+// so that they are managed as a snapshot set of the SnapshotGroup
+func adoptGroupSnapshotMembers(sg *snapshotgroup.SnapshotGroup, set string, members []unstructured.Unstructured, annotations map[string]string) ([]*GeminiSnapshot, error) {
+	snapClient := kube.GetClient().SnapshotClient.Namespace(sg.ObjectMeta.Namespace)
+	created := []*GeminiSnapshot{}
+	for _, member := range members {
+		memberAnnotations := map[string]string{
+			SnapshotSetAnnotation:   set,
+			GroupSnapshotAnnotation: set,
+		}
+		if claim, _, _ := unstructured.NestedString(member.Object, "spec", "source", "persistentVolumeClaimName"); claim != "" {
+			memberAnnotations[ClaimAnnotation] = claim
+		}
+		for key, value := range annotations {
+			memberAnnotations[key] = value
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      getSnapshotLabels(sg),
+				"annotations": memberAnnotations,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		patched, err := snapClient.Patch(context.TODO(), member.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return nil, err
+		}
+		snapshot, err := parseSnapshot(patched)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, snapshot)
+	}
+	return created, nil
+}
+
+// deleteGroupSnapshot deletes a VolumeGroupSnapshot, along with the VolumeSnapshots it created
+func deleteGroupSnapshot(namespace, name string) error {
+	klog.V(5).Infof("Deleting VolumeGroupSnapshot %s/%s", namespace, name)
+	groupClient := kube.GetClient().GroupSnapshotClient.Namespace(namespace)
+	err := groupClient.Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+const defaultHookTimeoutSeconds = 30
+
+// hookSnapshotTimeout is how long post hooks wait for the snapshot to be cut
+const hookSnapshotTimeout = 2 * time.Minute
+const hookPollInterval = time.Second
+
+// maxHookErrorLength limits how much of a failed command's stderr is recorded
+const maxHookErrorLength = 256
+
+// preHookError is returned by takeSnapshotsWithHooks when a pre hook aborted the snapshot
+type preHookError struct {
+	error
+}
+
+func (e preHookError) Unwrap() error {
+	return e.error
+}
+
+// isPreHookFailure returns true if the error is from a pre hook that aborted the snapshot
+func isPreHookFailure(err error) bool {
+	var hookErr preHookError
+	return errors.As(err, &hookErr)
+}
+
+// takeSnapshotsWithHooks runs the pre hooks of the SnapshotGroup, takes snapshots, waits for them to be cut and runs
+// the post hooks. Post hooks also run if a pre hook or the snapshot failed. The results are recorded on the snapshots
+func takeSnapshotsWithHooks(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder, take func() ([]*GeminiSnapshot, error)) ([]*GeminiSnapshot, error) {
+	if sg.Spec.Hooks == nil {
+		return take()
+	}
+	results, err := runHooks(sg, snapshotgroup.HookPhasePre, sg.Spec.Hooks.Pre, recorder)
+	var snapshots []*GeminiSnapshot
+	if err == nil {
+		snapshots, err = take()
+	} else {
+		metrics.SnapshotsFailed.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name).Inc()
+		err = preHookError{err}
+	}
+	for _, snapshot := range snapshots {
+		if waitErr := waitForSnapshotCreation(snapshot, hookSnapshotTimeout); waitErr != nil {
+			klog.Warningf("%s/%s: running post hooks before snapshot %s was cut - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, snapshot.Name, waitErr)
+		}
+	}
+	postResults, postErr := runHooks(sg, snapshotgroup.HookPhasePost, sg.Spec.Hooks.Post, recorder)
+	results = append(results, postResults...)
+	for _, snapshot := range snapshots {
+		if recordErr := recordHookResults(snapshot, results); recordErr != nil {
+			klog.Warningf("%s/%s: failed to record hook results on snapshot %s - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, snapshot.Name, recordErr)
+		}
+	}
+	if err == nil {
+		err = postErr
+	}
+	return snapshots, err
+}
+
+// runHooks runs each hook in its Pods, stopping at the first failure unless the hook's policy is to continue
+func runHooks(sg *snapshotgroup.SnapshotGroup, phase string, hooks []snapshotgroup.SnapshotHook, recorder record.EventRecorder) ([]snapshotgroup.HookResult, error) {
+	results := []snapshotgroup.HookResult{}
+	for _, hook := range hooks {
+		pods, err := getHookPods(sg, hook)
+		if err != nil {
+			return results, fmt.Errorf("could not find Pods for %s hook %s: %w", strings.ToLower(phase), hook.Name, err)
+		}
+		if len(pods) == 0 {
+			klog.V(3).Infof("%s/%s: no running Pods for %s hook %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, strings.ToLower(phase), hook.Name)
+			continue
+		}
+		for _, pod := range pods {
+			result := execHook(sg, phase, hook, pod)
+			results = append(results, result)
+			if result.Error == "" {
+				continue
+			}
+			recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonHookFailed, "%s hook %s failed in Pod %s: %s", phase, hook.Name, pod.Name, result.Error)
+			if hook.OnFailure != snapshotgroup.HookOnFailureContinue {
+				return results, fmt.Errorf("%s hook %s failed in Pod %s: %s", strings.ToLower(phase), hook.Name, pod.Name, result.Error)
+			}
+		}
+	}
+	return results, nil
+}
+
+// getHookPods returns the running Pods selected by the hook, sorted by name. Pods matched by a podSelector must mount
+// one of the PVCs of the SnapshotGroup, or have the allow-hooks annotation
+func getHookPods(sg *snapshotgroup.SnapshotGroup, hook snapshotgroup.SnapshotHook) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	if hook.PodSelector == nil {
+		mounting, err := getMountingPods(sg)
+		if err != nil {
+			return nil, err
+		}
+		pods = mounting
+	} else {
+		selector, err := metav1.LabelSelectorAsSelector(hook.PodSelector)
+		if err != nil {
+			return nil, err
+		}
+		client := kube.GetClient()
+		list, err := client.K8s.CoreV1().Pods(sg.ObjectMeta.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+		// Anyone who can edit the SnapshotGroup can run commands through its hooks, so they only run in Pods that
+		// already have access to the data, or that opted in
+		claims, err := getClaimSet(sg)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			if mountsClaim(pod, claims) || pod.ObjectMeta.Annotations[AllowHooksAnnotation] == "true" {
+				pods = append(pods, pod)
+			} else {
+				klog.V(3).Infof("%s/%s: skipping hook %s in Pod %s, which doesn't mount the PVC or have the %s annotation", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, hook.Name, pod.ObjectMeta.Name, AllowHooksAnnotation)
+			}
+		}
+	}
+	running := []corev1.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning && pod.ObjectMeta.DeletionTimestamp == nil {
+			running = append(running, pod)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].ObjectMeta.Name < running[j].ObjectMeta.Name
+	})
+	return running, nil
+}
+
+// getHookRetryTime returns when the snapshot of a schedule can be retried after a pre hook aborted it, which is the
+// next time the schedule is due after the failure. It is zero if no pre hook has failed
+func getHookRetryTime(sg *snapshotgroup.SnapshotGroup, interval string, location *time.Location) (time.Time, error) {
+	failed := sg.Status.LastHookFailureTime
+	if failed == nil {
+		return time.Time{}, nil
+	}
+	parsed, err := parseSchedule(interval, location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parsed.Next(failed.Time), nil
+}
+
+// deferFailedHooks removes the intervals that can't be retried yet after a pre hook failure
+func deferFailedHooks(sg *snapshotgroup.SnapshotGroup, toCreate []string, location *time.Location) ([]string, error) {
+	now := time.Now()
+	due := []string{}
+	for _, interval := range toCreate {
+		retry, err := getHookRetryTime(sg, interval, location)
+		if err != nil {
+			return nil, err
+		}
+		if retry.After(now) {
+			klog.V(3).Infof("%s/%s: a pre hook failed, not retrying the %s snapshot until %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, interval, retry)
+			continue
+		}
+		due = append(due, interval)
+	}
+	return due, nil
+}
+
+// deferNextSnapshots moves the scheduled snapshots that a pre hook failure put off to the time they will be retried
+func deferNextSnapshots(sg *snapshotgroup.SnapshotGroup, nextSnapshots []snapshotgroup.ScheduledSnapshot, location *time.Location) ([]snapshotgroup.ScheduledSnapshot, error) {
+	if sg.Status.LastHookFailureTime == nil {
+		return nextSnapshots, nil
+	}
+	now := time.Now()
+	deferred := []snapshotgroup.ScheduledSnapshot{}
+	for _, schedule := range sg.Spec.Schedule {
+		name, err := getScheduleName(schedule)
+		if err != nil {
+			return nil, err
+		}
+		retry, err := getHookRetryTime(sg, name, location)
+		if err != nil {
+			return nil, err
+		}
+		next := snapshotgroup.ScheduledSnapshot{Interval: name}
+		for _, scheduled := range nextSnapshots {
+			if scheduled.Interval == name {
+				next.Time = scheduled.Time
+			}
+		}
+		if retry.After(now) && retry.After(next.Time.Time) {
+			next.Time = metav1.NewTime(retry)
+		}
+		if !next.Time.IsZero() {
+			deferred = append(deferred, next)
+		}
+	}
+	return deferred, nil
+}
+
+// execHook runs the hook's command in the Pod
+func execHook(sg *snapshotgroup.SnapshotGroup, phase string, hook snapshotgroup.SnapshotHook, pod corev1.Pod) snapshotgroup.HookResult {
+	result := snapshotgroup.HookResult{
+		Name:  hook.Name,
+		Phase: phase,
+		Pod:   pod.ObjectMeta.Name,
+		Time:  metav1.Now(),
+	}
+	container := hook.Container
+	if container == "" && len(pod.Spec.Containers) > 0 {
+		container = pod.Spec.Containers[0].Name
+	}
+	timeoutSeconds := hook.TimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultHookTimeoutSeconds
+	}
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	klog.V(3).Infof("%s/%s: running %s hook %s in Pod %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, strings.ToLower(phase), hook.Name, pod.ObjectMeta.Name)
+	_, stderr, err := kube.GetClient().Executor.Exec(ctx, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, container, hook.Command)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		message := err.Error()
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			message += ": " + stderr
+		}
+		if len(message) > maxHookErrorLength {
+			message = message[:maxHookErrorLength]
+		}
+		result.Error = message
+	}
+	return result
+}
+
+// waitForSnapshotCreation waits until the CSI driver has cut the snapshot, which is when its creationTime is set
+func waitForSnapshotCreation(snapshot *GeminiSnapshot, timeout time.Duration) error {
+	return wait.PollImmediate(hookPollInterval, timeout, func() (bool, error) {
+		latest, err := GetSnapshot(snapshot.Namespace, snapshot.Name)
+		if err != nil {
+			return false, err
+		}
+		status := latest.VolumeSnapshot.Status
+		if status == nil {
+			return false, nil
+		}
+		if status.Error != nil && status.Error.Message != nil {
+			return false, errors.New(*status.Error.Message)
+		}
+		return status.CreationTime != nil, nil
+	})
+}
+
+// recordHookResults stores the results of the hooks in an annotation on the snapshot
+func recordHookResults(snapshot *GeminiSnapshot, results []snapshotgroup.HookResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				HookResultsAnnotation: string(encoded),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	snapClient := kube.GetClient().SnapshotClient.Namespace(snapshot.Namespace)
+	_, err = snapClient.Patch(context.TODO(), snapshot.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// parseHookResults returns the hook results recorded on a snapshot
+func parseHookResults(snapshotMeta metav1.Object) []snapshotgroup.HookResult {
+	encoded := snapshotMeta.GetAnnotations()[HookResultsAnnotation]
+	if encoded == "" {
+		return nil
+	}
+	results := []snapshotgroup.HookResult{}
+	if err := json.Unmarshal([]byte(encoded), &results); err != nil {
+		klog.Warningf("%s/%s: could not parse hook results - %v", snapshotMeta.GetNamespace(), snapshotMeta.GetName(), err)
+		return nil
+	}
+	return results
+}
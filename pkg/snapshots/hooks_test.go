@@ -0,0 +1,253 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// fakeExecutor records the commands it runs, and fails those starting with "false"
+type fakeExecutor struct {
+	calls []string
+}
+
+func (e *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	e.calls = append(e.calls, pod+"/"+container+": "+strings.Join(command, " "))
+	if command[0] == "false" {
+		return "", "no luck", errors.New("command terminated with exit code 1")
+	}
+	return "ok", "", nil
+}
+
+func newHookPod(t *testing.T, client *kube.Client, name string, labels map[string]string) {
+	pod := newMountingPod(name, "foo", "", "")
+	pod.ObjectMeta.Labels = labels
+	pod.Spec.Containers = []corev1.Container{{Name: "main"}, {Name: "sidecar"}}
+	pod.Status.Phase = corev1.PodRunning
+	_, err := client.K8s.CoreV1().Pods("default").Create(context.TODO(), pod, metav1.CreateOptions{})
+	assert.NoError(t, err)
+}
+
+// markSnapshotCut sets the creationTime of a snapshot, as the CSI snapshotter would
+func markSnapshotCut(t *testing.T, client *kube.Client, snapshot *GeminiSnapshot) {
+	snapClient := client.SnapshotClient.Namespace(snapshot.Namespace)
+	unst, err := snapClient.Get(context.TODO(), snapshot.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(unst.Object, metav1.Now().UTC().Format("2006-01-02T15:04:05Z"), "status", "creationTime"))
+	_, err = snapClient.Update(context.TODO(), unst, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func TestSnapshotHooks(t *testing.T) {
+	client := kube.SetFakeClient()
+	executor := &fakeExecutor{}
+	client.Executor = executor
+	recorder := record.NewFakeRecorder(100)
+	newHookPod(t, client, "db-0", map[string]string{"app": "db"})
+	newHookPod(t, client, "db-1", map[string]string{"app": "db"})
+
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim: snapshotgroup.SnapshotClaim{Name: "foo"},
+			Hooks: &snapshotgroup.SnapshotHooks{
+				Pre: []snapshotgroup.SnapshotHook{{
+					Name:      "freeze",
+					Container: "sidecar",
+					Command:   []string{"fsfreeze", "-f", "/data"},
+				}},
+				Post: []snapshotgroup.SnapshotHook{{
+					Name:        "unfreeze",
+					PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+					Command:     []string{"fsfreeze", "-u", "/data"},
+				}},
+			},
+		},
+	}
+	created, err := takeSnapshotsWithHooks(sg, recorder, func() ([]*GeminiSnapshot, error) {
+		assert.Equal(t, 2, len(executor.calls), "pre hooks run before the snapshot is taken")
+		created, err := createSnapshotForIntervals(sg, []string{"1h"})
+		for _, snapshot := range created {
+			markSnapshotCut(t, client, snapshot)
+		}
+		return created, err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(created))
+	assert.Equal(t, []string{
+		"db-0/sidecar: fsfreeze -f /data",
+		"db-1/sidecar: fsfreeze -f /data",
+		"db-0/main: fsfreeze -u /data",
+		"db-1/main: fsfreeze -u /data",
+	}, executor.calls)
+
+	snapshots, err := ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snapshots))
+	status := getSnapshotStatus(snapshots[0])
+	assert.Equal(t, 4, len(status.Hooks))
+	assert.Equal(t, "freeze", status.Hooks[0].Name)
+	assert.Equal(t, snapshotgroup.HookPhasePre, status.Hooks[0].Phase)
+	assert.Equal(t, "db-1", status.Hooks[3].Pod)
+	assert.Equal(t, snapshotgroup.HookPhasePost, status.Hooks[3].Phase)
+	assert.Equal(t, "", status.Hooks[3].Error)
+}
+
+func TestSnapshotHookFailures(t *testing.T) {
+	client := kube.SetFakeClient()
+	executor := &fakeExecutor{}
+	client.Executor = executor
+	recorder := record.NewFakeRecorder(100)
+	newHookPod(t, client, "db-0", nil)
+
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim: snapshotgroup.SnapshotClaim{Name: "foo"},
+			Hooks: &snapshotgroup.SnapshotHooks{
+				Pre: []snapshotgroup.SnapshotHook{
+					{Name: "flush", Command: []string{"false"}, OnFailure: snapshotgroup.HookOnFailureContinue},
+					{Name: "lock", Command: []string{"false"}},
+					{Name: "never", Command: []string{"true"}},
+				},
+				Post: []snapshotgroup.SnapshotHook{{Name: "unlock", Command: []string{"true"}}},
+			},
+		},
+	}
+	taken := false
+	_, err := takeSnapshotsWithHooks(sg, recorder, func() ([]*GeminiSnapshot, error) {
+		taken = true
+		return nil, nil
+	})
+	assert.EqualError(t, err, "pre hook lock failed in Pod db-0: command terminated with exit code 1: no luck")
+	assert.True(t, isPreHookFailure(err))
+	assert.False(t, taken, "no snapshot is taken when a pre hook aborts")
+	assert.Equal(t, []string{"db-0/main: false", "db-0/main: false", "db-0/main: true"}, executor.calls, "post hooks still run")
+	assert.Equal(t, "Warning HookFailed Pre hook flush failed in Pod db-0: command terminated with exit code 1: no luck", <-recorder.Events)
+
+	executor.calls = nil
+	sg.Spec.Hooks.Pre = nil
+	sg.Spec.Hooks.Post[0].Command = []string{"false"}
+	_, err = takeSnapshotsWithHooks(sg, recorder, func() ([]*GeminiSnapshot, error) {
+		return nil, errors.New("snapshot failed")
+	})
+	assert.EqualError(t, err, "snapshot failed", "the snapshot error is reported before post hook errors")
+	assert.False(t, isPreHookFailure(err))
+	assert.Equal(t, []string{"db-0/main: false"}, executor.calls)
+}
+
+func TestHookPodSelector(t *testing.T) {
+	client := kube.SetFakeClient()
+	newHookPod(t, client, "db-0", map[string]string{"app": "db"})
+	for _, pod := range []*corev1.Pod{
+		newMountingPod("web-0", "other", "", ""),
+		newMountingPod("cache-0", "other", "", ""),
+	} {
+		pod.ObjectMeta.Labels = map[string]string{"app": "db"}
+		pod.Status.Phase = corev1.PodRunning
+		if pod.ObjectMeta.Name == "cache-0" {
+			pod.ObjectMeta.Annotations = map[string]string{AllowHooksAnnotation: "true"}
+		}
+		_, err := client.K8s.CoreV1().Pods("default").Create(context.TODO(), pod, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       snapshotgroup.SnapshotGroupSpec{Claim: snapshotgroup.SnapshotClaim{Name: "foo"}},
+	}
+	pods, err := getHookPods(sg, snapshotgroup.SnapshotHook{
+		Name:        "flush",
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+	})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, pod.ObjectMeta.Name)
+	}
+	assert.Equal(t, []string{"cache-0", "db-0"}, names, "selected Pods must mount the PVC or opt in")
+}
+
+func TestPreHookFailureBackoff(t *testing.T) {
+	client := kube.SetFakeClient()
+	executor := &fakeExecutor{}
+	client.Executor = executor
+	recorder := record.NewFakeRecorder(100)
+	newHookPod(t, client, "db-0", nil)
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	_, err := client.K8s.CoreV1().PersistentVolumeClaims("default").Create(context.TODO(), pvc, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.PVCInformers[0].Informer().GetIndexer().Add(pvc))
+
+	sgClient := client.SnapshotGroupClient.SnapshotGroups("default")
+	sg, err := sgClient.Create(context.TODO(), &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim:    snapshotgroup.SnapshotClaim{Name: "foo"},
+			Schedule: []snapshotgroup.SnapshotSchedule{{Every: "1 hour", Keep: 1}},
+			Hooks: &snapshotgroup.SnapshotHooks{
+				Pre: []snapshotgroup.SnapshotHook{{Name: "lock", Command: []string{"false"}}},
+			},
+		},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	next, err := ReconcileBackupsForSnapshotGroup(sg, recorder)
+	assert.NoError(t, err, "a failed pre hook is retried on the schedule, not by the rate limiter")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), next, time.Minute)
+	assert.Equal(t, 1, len(executor.calls))
+	sg, err = sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotNil(t, sg.Status.LastHookFailureTime)
+	assert.Equal(t, 1, len(sg.Status.NextSnapshots))
+	assert.True(t, next.Equal(sg.Status.NextSnapshots[0].Time.Time))
+	assert.Contains(t, meta.FindStatusCondition(sg.Status.Conditions, snapshotgroup.ConditionSnapshotFailing).Message, "pre hook lock failed")
+
+	// The hook isn't run again until the schedule is next due
+	_, err = ReconcileBackupsForSnapshotGroup(sg, recorder)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(executor.calls))
+	snapshots, err := ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snapshots))
+
+	// Once it is, the snapshot is taken and the failure is cleared
+	failed := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	sg.Status.LastHookFailureTime = &failed
+	sg, err = sgClient.UpdateStatus(context.TODO(), sg, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	sg.Spec.Hooks = nil
+	_, err = ReconcileBackupsForSnapshotGroup(sg, recorder)
+	assert.NoError(t, err)
+	snapshots, err = ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snapshots))
+	sg, err = sgClient.Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, sg.Status.LastHookFailureTime)
+}
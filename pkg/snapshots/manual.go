@@ -0,0 +1,73 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"k8s.io/klog/v2"
+
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// getManualSnapshotToken returns the snapshot-now token of the SnapshotGroup if it hasn't been handled yet
+func getManualSnapshotToken(sg *snapshotgroup.SnapshotGroup) string {
+	token := sg.ObjectMeta.Annotations[SnapshotNowAnnotation]
+	if token == sg.Status.LastManualSnapshot {
+		return ""
+	}
+	return token
+}
+
+// findManualSnapshot returns the snapshot taken for the token, if there is one
+func findManualSnapshot(snapshots []*GeminiSnapshot, token string) *GeminiSnapshot {
+	for _, snapshot := range snapshots {
+		if snapshot.Manual == token {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// getExpiredManualSnapshots returns the manual snapshots beyond the number to keep,
+// leaving room for a new one if needsCreation is true. Snapshots are sorted newest first.
+func getExpiredManualSnapshots(sg *snapshotgroup.SnapshotGroup, snapshots []*GeminiSnapshot, needsCreation bool) []*GeminiSnapshot {
+	keep := sg.Spec.KeepManual
+	if keep <= 0 {
+		keep = defaultKeepManual
+	}
+	if needsCreation {
+		keep--
+	}
+	expired := []*GeminiSnapshot{}
+	for _, snapshot := range snapshots {
+		if snapshot.Manual == "" {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		expired = append(expired, snapshot)
+	}
+	return expired
+}
+
+// createSnapshotForManual creates a snapshot for the snapshot-now token
+func createSnapshotForManual(sg *snapshotgroup.SnapshotGroup, token string) ([]*GeminiSnapshot, error) {
+	klog.V(5).Infof("%s/%s: creating manual snapshot for %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, token)
+	annotations := map[string]string{
+		ManualAnnotation: token,
+	}
+	return createSnapshots(sg, annotations)
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"reflect"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+const snapshotGroupKind = "SnapshotGroup"
+
+// wantsOwnerReference returns true if objects Gemini creates for the SnapshotGroup should be owned by it.
+// This is only the case for the Delete policy, because garbage collection would otherwise remove
+// VolumeSnapshots and PVCs that the policy is meant to keep.
+func wantsOwnerReference(sg *snapshotgroup.SnapshotGroup) bool {
+	return sg.ObjectMeta.UID != "" && sg.Spec.DeletionPolicy == snapshotgroup.DeletionPolicyDelete
+}
+
+// getOwnerReferences returns the owner references for a new object created for the SnapshotGroup
+func getOwnerReferences(sg *snapshotgroup.SnapshotGroup) []metav1.OwnerReference {
+	refs, _ := syncOwnerReferences(sg, nil)
+	return refs
+}
+
+func newOwnerReference(sg *snapshotgroup.SnapshotGroup) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{
+		APIVersion: snapshotgroup.SchemeGroupVersion.String(),
+		Kind:       snapshotGroupKind,
+		Name:       sg.ObjectMeta.Name,
+		UID:        sg.ObjectMeta.UID,
+		Controller: &isController,
+	}
+}
+
+// isSnapshotGroupReference returns true if the owner reference points to any SnapshotGroup
+func isSnapshotGroupReference(ref metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	return err == nil && gv.Group == snapshotgroup.SchemeGroupVersion.Group && ref.Kind == snapshotGroupKind
+}
+
+// syncOwnerReferences adds or removes the SnapshotGroup's owner reference as required by its deletion policy,
+// leaving any other owner references in place. It returns the new references, and whether they changed.
+func syncOwnerReferences(sg *snapshotgroup.SnapshotGroup, refs []metav1.OwnerReference) ([]metav1.OwnerReference, bool) {
+	synced := []metav1.OwnerReference{}
+	for _, ref := range refs {
+		if !isSnapshotGroupReference(ref) || ref.UID != sg.ObjectMeta.UID {
+			synced = append(synced, ref)
+		}
+	}
+	if wantsOwnerReference(sg) {
+		synced = append(synced, newOwnerReference(sg))
+	}
+	if len(synced) == 0 && len(refs) == 0 {
+		return nil, false
+	}
+	return synced, !reflect.DeepEqual(synced, refs)
+}
+
+// isOwnedBy returns false if the object belongs to a different SnapshotGroup, such as an earlier group
+// with the same name. Objects without a SnapshotGroup owner are matched by the group UID annotation, which
+// objects created by older versions of Gemini don't have, so they are matched by name alone.
+func isOwnedBy(obj metav1.Object, sg *snapshotgroup.SnapshotGroup) bool {
+	if sg.ObjectMeta.UID == "" {
+		return true
+	}
+	hasOwner := false
+	for _, ref := range obj.GetOwnerReferences() {
+		if !isSnapshotGroupReference(ref) {
+			continue
+		}
+		if ref.UID == sg.ObjectMeta.UID {
+			return true
+		}
+		hasOwner = true
+	}
+	if hasOwner {
+		return false
+	}
+	uid := obj.GetAnnotations()[GroupUIDAnnotation]
+	return uid == "" || uid == string(sg.ObjectMeta.UID)
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestSyncOwnerReferences(t *testing.T) {
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+	}
+	other := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "other", UID: "uid-2"}
+
+	refs, changed := syncOwnerReferences(sg, nil)
+	assert.False(t, changed, "Retain does not set owner references")
+	assert.Nil(t, refs)
+
+	sg.Spec.DeletionPolicy = snapshotgroup.DeletionPolicyDelete
+	refs, changed = syncOwnerReferences(sg, []metav1.OwnerReference{other})
+	assert.True(t, changed)
+	assert.Equal(t, 2, len(refs))
+	assert.Equal(t, other, refs[0])
+	assert.Equal(t, "SnapshotGroup", refs[1].Kind)
+	assert.Equal(t, sg.ObjectMeta.UID, refs[1].UID)
+	assert.True(t, *refs[1].Controller)
+
+	_, changed = syncOwnerReferences(sg, refs)
+	assert.False(t, changed)
+
+	sg.Spec.DeletionPolicy = snapshotgroup.DeletionPolicyRetainLatest
+	refs, changed = syncOwnerReferences(sg, refs)
+	assert.True(t, changed, "owner references are removed when the policy no longer deletes")
+	assert.Equal(t, []metav1.OwnerReference{other}, refs)
+}
+
+func TestListSnapshotsMatchesOwner(t *testing.T) {
+	kube.SetFakeClient()
+	previous := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+		Spec:       snapshotgroup.SnapshotGroupSpec{DeletionPolicy: snapshotgroup.DeletionPolicyDelete},
+	}
+	_, err := createSnapshotForIntervals(previous, []string{"1 hour"})
+	assert.NoError(t, err)
+
+	recreated := previous.DeepCopy()
+	recreated.ObjectMeta.UID = "uid-2"
+	snapshots, err := ListSnapshots(recreated)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snapshots), "snapshots owned by another group are not adopted")
+
+	snapshots, err = ListSnapshots(previous)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snapshots))
+
+	retained := previous.DeepCopy()
+	retained.ObjectMeta.UID = "uid-3"
+	retained.Spec.DeletionPolicy = snapshotgroup.DeletionPolicyRetain
+	_, err = createSnapshotForManual(retained, "now")
+	assert.NoError(t, err)
+	recreated.Spec.DeletionPolicy = snapshotgroup.DeletionPolicyRetain
+	snapshots, err = ListSnapshots(recreated)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snapshots), "snapshots of a previous group are not adopted, whatever its deletion policy")
+	snapshots, err = ListSnapshots(retained)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snapshots))
+
+	pvc, err := createPVC(previous, previous.Spec.Claim.Spec, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pvc.ObjectMeta.OwnerReferences))
+	assert.True(t, isCreatedPVC(previous, pvc))
+	assert.False(t, isCreatedPVC(recreated, pvc))
+
+	previous.Spec.DeletionPolicy = snapshotgroup.DeletionPolicyRetain
+	pvc, err = updatePVCOwnerReferences(previous, pvc)
+	assert.NoError(t, err)
+	assert.Empty(t, pvc.ObjectMeta.OwnerReferences)
+	pvc, err = kube.GetClient().K8s.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, pvc.ObjectMeta.OwnerReferences)
+}
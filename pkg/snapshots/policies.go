@@ -0,0 +1,343 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// ReconcileSnapshotPolicy creates a SnapshotGroup for each PVC matching the SnapshotPolicy, keeps their specs in sync
+// with the policy, and deletes the SnapshotGroups of PVCs that no longer match
+func ReconcileSnapshotPolicy(policy *snapshotgroup.SnapshotPolicy, recorder record.EventRecorder) error {
+	desired, err := getPolicySnapshotGroups(policy)
+	if err != nil {
+		return updatePolicyStatus(policy, 0, err)
+	}
+	generated, err := listPolicySnapshotGroups(policy)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for key, sg := range generated {
+		if _, ok := desired[key]; ok || sg.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if isClaimRestored(sg) {
+			// Restored PVCs don't have the labels of the original, so keep backing them up
+			desired[key] = newPolicySnapshotGroup(policy, sg.ObjectMeta.Namespace, sg.Spec.Claim.Name)
+			continue
+		}
+		if err := deletePolicySnapshotGroup(policy, sg, recorder); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	keys := []string{}
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := applyPolicySnapshotGroup(policy, desired[key], generated[key], recorder); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	reconcileErr := utilerrors.NewAggregate(errs)
+	if reconcileErr != nil {
+		klog.Warningf("%s: failed to sync SnapshotGroups - %v", policy.ObjectMeta.Name, reconcileErr)
+	}
+	if err := updatePolicyStatus(policy, len(desired), reconcileErr); err != nil {
+		return err
+	}
+	return reconcileErr
+}
+
+// getPolicySnapshotGroups returns the SnapshotGroup that should exist for each PVC matching the policy,
+// keyed by namespace/name
+func getPolicySnapshotGroups(policy *snapshotgroup.SnapshotPolicy) (map[string]*snapshotgroup.SnapshotGroup, error) {
+	claims, err := listPolicyClaims(policy)
+	if err != nil {
+		return nil, err
+	}
+	desired := map[string]*snapshotgroup.SnapshotGroup{}
+	for _, pvc := range claims {
+		sg := newPolicySnapshotGroup(policy, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+		desired[sg.ObjectMeta.Namespace+"/"+sg.ObjectMeta.Name] = sg
+	}
+	return desired, nil
+}
+
+// listPolicyClaims returns the PVCs in watched namespaces that match the selectors of the policy from the informer cache
+func listPolicyClaims(policy *snapshotgroup.SnapshotPolicy) ([]*corev1.PersistentVolumeClaim, error) {
+	claims := []*corev1.PersistentVolumeClaim{}
+	// A missing selector matches nothing, rather than every PVC in the cluster
+	if policy.Spec.Selector == nil {
+		return claims, nil
+	}
+	client := kube.GetClient()
+	selector, err := metav1.LabelSelectorAsSelector(policy.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	var namespaces map[string]bool
+	if policy.Spec.NamespaceSelector != nil {
+		nsSelector, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %w", err)
+		}
+		list, err := client.SelectNamespaces(nsSelector)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = map[string]bool{}
+		for _, ns := range list {
+			namespaces[ns.ObjectMeta.Name] = true
+		}
+	}
+	pvcs, err := client.SelectPVCs(metav1.NamespaceAll, selector)
+	if err != nil {
+		return nil, err
+	}
+	for _, pvc := range pvcs {
+		if pvc.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if namespaces != nil && !namespaces[pvc.ObjectMeta.Namespace] {
+			continue
+		}
+		if !client.IsWatched(pvc.ObjectMeta.Namespace) {
+			continue
+		}
+		claims = append(claims, pvc)
+	}
+	return claims, nil
+}
+
+// getPolicySnapshotGroupName returns the name of the SnapshotGroup generated from the policy for a PVC. Names that
+// are too long for a label value are truncated, with a hash of the full name so that they stay unique
+func getPolicySnapshotGroupName(policy, claim string) string {
+	name := policy + "-" + claim
+	if len(name) <= validation.LabelValueMaxLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(policy + "/" + claim))
+	suffix := hex.EncodeToString(hash[:])[:policyNameHashLength]
+	prefix := strings.TrimRight(name[:validation.LabelValueMaxLength-policyNameHashLength-1], "-.")
+	return prefix + "-" + suffix
+}
+
+// newPolicySnapshotGroup returns the SnapshotGroup generated from the policy for a PVC
+func newPolicySnapshotGroup(policy *snapshotgroup.SnapshotPolicy, namespace, claim string) *snapshotgroup.SnapshotGroup {
+	isController := true
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getPolicySnapshotGroupName(policy.ObjectMeta.Name, claim),
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managerName},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: snapshotgroup.SchemeGroupVersion.String(),
+				Kind:       snapshotgroup.SnapshotPolicyKind,
+				Name:       policy.ObjectMeta.Name,
+				UID:        policy.ObjectMeta.UID,
+				Controller: &isController,
+			}},
+		},
+		Spec: snapshotgroup.SnapshotGroupSpec{
+			Claim:          snapshotgroup.SnapshotClaim{Name: claim},
+			TimeZone:       policy.Spec.TimeZone,
+			DeletionPolicy: policy.Spec.DeletionPolicy,
+			KeepManual:     policy.Spec.KeepManual,
+			Suspend:        policy.Spec.Suspend,
+		},
+	}
+	if len(validation.IsValidLabelValue(policy.ObjectMeta.Name)) == 0 {
+		sg.ObjectMeta.Labels[PolicyLabel] = policy.ObjectMeta.Name
+	}
+	policy.Spec.Template.DeepCopyInto(&sg.Spec.Template)
+	if policy.Spec.Schedule != nil {
+		sg.Spec.Schedule = append([]snapshotgroup.SnapshotSchedule{}, policy.Spec.Schedule...)
+	}
+	if policy.Spec.Hooks != nil {
+		sg.Spec.Hooks = policy.Spec.Hooks.DeepCopy()
+	}
+	return sg
+}
+
+// listPolicySnapshotGroups returns the SnapshotGroups controlled by the policy from the informer cache, keyed by
+// namespace/name. They are selected by the policy label, unless the policy's name is too long for one
+func listPolicySnapshotGroups(policy *snapshotgroup.SnapshotPolicy) (map[string]*snapshotgroup.SnapshotGroup, error) {
+	groupLabels := labels.Set{managedByLabel: managerName}
+	if len(validation.IsValidLabelValue(policy.ObjectMeta.Name)) == 0 {
+		groupLabels[PolicyLabel] = policy.ObjectMeta.Name
+	}
+	groups, err := kube.GetClient().SelectSnapshotGroups(metav1.NamespaceAll, labels.SelectorFromSet(groupLabels))
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]*snapshotgroup.SnapshotGroup{}
+	for _, sg := range groups {
+		if isControlledByPolicy(sg, policy) {
+			generated[sg.ObjectMeta.Namespace+"/"+sg.ObjectMeta.Name] = sg
+		}
+	}
+	return generated, nil
+}
+
+// isControlledByPolicy returns true if the SnapshotGroup was generated from the policy
+func isControlledByPolicy(sg *snapshotgroup.SnapshotGroup, policy *snapshotgroup.SnapshotPolicy) bool {
+	ref := metav1.GetControllerOf(sg)
+	return ref != nil && ref.Kind == snapshotgroup.SnapshotPolicyKind && ref.UID == policy.ObjectMeta.UID
+}
+
+// GetPolicyName returns the name of the SnapshotPolicy that generated the SnapshotGroup, or an empty string
+func GetPolicyName(sg metav1.Object) string {
+	ref := metav1.GetControllerOf(sg)
+	if ref == nil || ref.Kind != snapshotgroup.SnapshotPolicyKind {
+		return ""
+	}
+	return ref.Name
+}
+
+// applyPolicySnapshotGroup creates the desired SnapshotGroup, or updates the existing one if its spec has drifted from the policy
+func applyPolicySnapshotGroup(policy *snapshotgroup.SnapshotPolicy, desired, existing *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	isManaged := func(sg *snapshotgroup.SnapshotGroup) bool {
+		return isControlledByPolicy(sg, policy)
+	}
+	created, err := applyGeneratedSnapshotGroup(desired, existing, "the policy", isManaged)
+	if created {
+		klog.V(3).Infof("%s: created SnapshotGroup %s/%s for PVC %s", policy.ObjectMeta.Name, desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, desired.Spec.Claim.Name)
+		recorder.Eventf(policy, corev1.EventTypeNormal, ReasonSnapshotGroupCreated, "Created SnapshotGroup %s/%s for PVC %s", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, desired.Spec.Claim.Name)
+	}
+	return err
+}
+
+// deletePolicySnapshotGroup deletes a SnapshotGroup whose PVC no longer matches the policy. Its deletion policy decides
+// what happens to its VolumeSnapshots
+func deletePolicySnapshotGroup(policy *snapshotgroup.SnapshotPolicy, sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	klog.V(3).Infof("%s: deleting SnapshotGroup %s/%s, PVC %s no longer matches", policy.ObjectMeta.Name, sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, sg.Spec.Claim.Name)
+	client := kube.GetClient()
+	err := client.SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace).Delete(context.TODO(), sg.ObjectMeta.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete SnapshotGroup %s/%s: %w", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	recorder.Eventf(policy, corev1.EventTypeNormal, ReasonSnapshotGroupDeleted, "Deleted SnapshotGroup %s/%s, PVC %s no longer matches", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, sg.Spec.Claim.Name)
+	return nil
+}
+
+// updatePolicyStatus records the number of generated SnapshotGroups and whether they are in sync with the policy
+func updatePolicyStatus(policy *snapshotgroup.SnapshotPolicy, numGroups int, reconcileErr error) error {
+	ready := metav1.Condition{
+		Type:               snapshotgroup.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "SnapshotGroupsSynced",
+		Message:            fmt.Sprintf("%d SnapshotGroups are in sync with the policy", numGroups),
+		ObservedGeneration: policy.ObjectMeta.Generation,
+	}
+	if reconcileErr != nil {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "ReconcileFailed"
+		ready.Message = reconcileErr.Error()
+	}
+	policyClient := kube.GetClient().SnapshotGroupClient.SnapshotPolicies()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := policyClient.Get(context.TODO(), policy.ObjectMeta.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			klog.V(5).Infof("%s: not updating status of deleted SnapshotPolicy", policy.ObjectMeta.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		status := latest.Status.DeepCopy()
+		status.ObservedGeneration = policy.ObjectMeta.Generation
+		status.SnapshotGroups = numGroups
+		meta.SetStatusCondition(&status.Conditions, ready)
+		if equality.Semantic.DeepEqual(*status, latest.Status) {
+			return nil
+		}
+		latest.Status = *status
+		_, err = policyClient.UpdateStatus(context.TODO(), latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// GetPoliciesForClaim returns the names of the SnapshotPolicies from the informer cache whose selector matches the labels of a PVC
+func GetPoliciesForClaim(pvcLabels map[string]string) []string {
+	return getMatchingPolicies(func(policy *snapshotgroup.SnapshotPolicy) *metav1.LabelSelector {
+		return policy.Spec.Selector
+	}, pvcLabels)
+}
+
+// GetPoliciesForNamespace returns the names of the SnapshotPolicies from the informer cache that may select PVCs in a
+// namespace with these labels, as they have no namespaceSelector or it matches
+func GetPoliciesForNamespace(nsLabels map[string]string) []string {
+	return getMatchingPolicies(func(policy *snapshotgroup.SnapshotPolicy) *metav1.LabelSelector {
+		if policy.Spec.NamespaceSelector == nil {
+			return &metav1.LabelSelector{}
+		}
+		return policy.Spec.NamespaceSelector
+	}, nsLabels)
+}
+
+// getMatchingPolicies returns the names of the SnapshotPolicies from the informer cache where the selector returned
+// by getSelector matches objLabels. A nil selector matches nothing
+func getMatchingPolicies(getSelector func(*snapshotgroup.SnapshotPolicy) *metav1.LabelSelector, objLabels map[string]string) []string {
+	client := kube.GetClient()
+	if client.PolicyInformer == nil {
+		return nil
+	}
+	policies, err := client.PolicyInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Warningf("could not list SnapshotPolicies - %v", err)
+		return nil
+	}
+	names := []string{}
+	for _, policy := range policies {
+		labelSelector := getSelector(policy)
+		if labelSelector == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(labels.Set(objLabels)) {
+			names = append(names, policy.ObjectMeta.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestReconcileSnapshotPolicy(t *testing.T) {
+	client := kube.SetFakeClient()
+	recorder := record.NewFakeRecorder(100)
+	for ns, tier := range map[string]string{"prod": "prod", "staging": "staging"} {
+		assert.NoError(t, client.NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: ns, Labels: map[string]string{"env": tier}},
+		}))
+	}
+	pvcIndexer := client.PVCInformers[0].Informer().GetIndexer()
+	newPVC := func(namespace, name string, labels map[string]string) {
+		pvc, err := client.K8s.CoreV1().PersistentVolumeClaims(namespace).Create(context.TODO(), &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, pvcIndexer.Add(pvc))
+	}
+	newPVC("prod", "db", map[string]string{"tier": "prod"})
+	newPVC("prod", "cache", map[string]string{"tier": "dev"})
+	newPVC("staging", "db", map[string]string{"tier": "prod"})
+
+	policy, err := client.SnapshotGroupClient.SnapshotPolicies().Create(context.TODO(), &snapshotgroup.SnapshotPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "hourly", UID: "policy-uid", Generation: 1},
+		Spec: snapshotgroup.SnapshotPolicySpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}},
+			Selector:          &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "prod"}},
+			Schedule:          []snapshotgroup.SnapshotSchedule{{Every: "hour", Keep: 24}},
+			DeletionPolicy:    snapshotgroup.DeletionPolicyRetain,
+		},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, ReconcileSnapshotPolicy(policy, recorder))
+	sg, err := client.SnapshotGroupClient.SnapshotGroups("prod").Get(context.TODO(), "hourly-db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "db", sg.Spec.Claim.Name)
+	assert.Equal(t, policy.Spec.Schedule, sg.Spec.Schedule)
+	assert.Equal(t, "hourly", sg.ObjectMeta.Labels[PolicyLabel])
+	assert.Equal(t, "hourly", GetPolicyName(sg))
+	assert.True(t, isControlledByPolicy(sg, policy))
+	_, err = client.SnapshotGroupClient.SnapshotGroups("prod").Get(context.TODO(), "hourly-cache", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "PVCs not matching the selector are not enrolled")
+	_, err = client.SnapshotGroupClient.SnapshotGroups("staging").Get(context.TODO(), "hourly-db", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "PVCs in namespaces not matching the namespace selector are not enrolled")
+	assert.Equal(t, "Normal SnapshotGroupCreated Created SnapshotGroup prod/hourly-db for PVC db", <-recorder.Events)
+
+	latest, err := client.SnapshotGroupClient.SnapshotPolicies().Get(context.TODO(), "hourly", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, latest.Status.SnapshotGroups)
+	assert.True(t, meta.IsStatusConditionTrue(latest.Status.Conditions, snapshotgroup.ConditionReady))
+
+	// Changes to the policy are copied to the SnapshotGroups it generated
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(sg))
+	policy.Spec.Schedule[0].Keep = 48
+	assert.NoError(t, ReconcileSnapshotPolicy(policy, recorder))
+	sg, err = client.SnapshotGroupClient.SnapshotGroups("prod").Get(context.TODO(), "hourly-db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 48, sg.Spec.Schedule[0].Keep)
+
+	// SnapshotGroups of PVCs that no longer match are deleted
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Update(sg))
+	pvc, err := client.K8s.CoreV1().PersistentVolumeClaims("prod").Get(context.TODO(), "db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	pvc.ObjectMeta.Labels["tier"] = "dev"
+	pvc, err = client.K8s.CoreV1().PersistentVolumeClaims("prod").Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, pvcIndexer.Update(pvc))
+	assert.NoError(t, ReconcileSnapshotPolicy(policy, recorder))
+	_, err = client.SnapshotGroupClient.SnapshotGroups("prod").Get(context.TODO(), "hourly-db", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Equal(t, "Normal SnapshotGroupDeleted Deleted SnapshotGroup prod/hourly-db, PVC db no longer matches", <-recorder.Events)
+
+	// A restored PVC doesn't have the labels of the original, but is still backed up
+	newPVC("prod", "restored", nil)
+	restored, err := client.K8s.CoreV1().PersistentVolumeClaims("prod").Get(context.TODO(), "restored", metav1.GetOptions{})
+	assert.NoError(t, err)
+	restored.ObjectMeta.Annotations = map[string]string{managedByAnnotation: managerName, RestoreAnnotation: "1234"}
+	restored, err = client.K8s.CoreV1().PersistentVolumeClaims("prod").Update(context.TODO(), restored, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, pvcIndexer.Update(restored))
+	restoredGroup, err := client.SnapshotGroupClient.SnapshotGroups("prod").Create(context.TODO(), newPolicySnapshotGroup(policy, "prod", "restored"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Delete(sg))
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(restoredGroup))
+	assert.NoError(t, ReconcileSnapshotPolicy(policy, recorder))
+	_, err = client.SnapshotGroupClient.SnapshotGroups("prod").Get(context.TODO(), "hourly-restored", metav1.GetOptions{})
+	assert.NoError(t, err, "the SnapshotGroup of a restored PVC is kept")
+
+	assert.NoError(t, client.PolicyInformer.Informer().GetIndexer().Add(policy))
+	assert.Equal(t, []string{"hourly"}, GetPoliciesForClaim(map[string]string{"tier": "prod"}))
+	assert.Equal(t, []string{}, GetPoliciesForClaim(map[string]string{"tier": "dev"}))
+	assert.Equal(t, []string{"hourly"}, GetPoliciesForNamespace(map[string]string{"env": "prod"}))
+	assert.Equal(t, []string{}, GetPoliciesForNamespace(map[string]string{"env": "staging"}))
+
+	// Groups generated by other policies are left alone, even if their PVC matches
+	other := newPolicySnapshotGroup(&snapshotgroup.SnapshotPolicy{ObjectMeta: metav1.ObjectMeta{Name: "daily", UID: "other-uid"}}, "prod", "restored")
+	assert.NoError(t, client.Informers[0].Informer().GetIndexer().Add(other))
+	generated, err := listPolicySnapshotGroups(policy)
+	assert.NoError(t, err)
+	assert.Len(t, generated, 1)
+	assert.Contains(t, generated, "prod/hourly-restored")
+}
+
+func TestPolicySnapshotGroupName(t *testing.T) {
+	assert.Equal(t, "hourly-db", getPolicySnapshotGroupName("hourly", "db"))
+
+	long := strings.Repeat("a", 40)
+	name := getPolicySnapshotGroupName(long, long)
+	assert.Len(t, name, validation.LabelValueMaxLength)
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+	assert.Empty(t, validation.IsValidLabelValue(name))
+	assert.Equal(t, name, getPolicySnapshotGroupName(long, long))
+	assert.NotEqual(t, name, getPolicySnapshotGroupName(long, long+"b"), "names that only differ once truncated stay unique")
+	assert.NotEqual(t, name, getPolicySnapshotGroupName(long+"-"+long[:10], long[10:]))
+}
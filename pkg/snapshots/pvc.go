@@ -16,18 +16,23 @@ package snapshots
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
 	"github.com/fairwindsops/gemini/pkg/kube"
 	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
 )
 
-func getPVCName(sg *snapshotgroup.SnapshotGroup) string {
+// GetPVCName returns the name of the PVC backed up by sg
+func GetPVCName(sg *snapshotgroup.SnapshotGroup) string {
 	name := sg.Spec.Claim.Name
 	if name == "" {
 		name = sg.ObjectMeta.Name
@@ -38,7 +43,7 @@ func getPVCName(sg *snapshotgroup.SnapshotGroup) string {
 func getPVC(sg *snapshotgroup.SnapshotGroup) (*corev1.PersistentVolumeClaim, error) {
 	client := kube.GetClient()
 	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(sg.ObjectMeta.Namespace)
-	pvc, err := pvcClient.Get(context.TODO(), getPVCName(sg), metav1.GetOptions{})
+	pvc, err := pvcClient.Get(context.TODO(), GetPVCName(sg), metav1.GetOptions{})
 	return pvc, err
 }
 
@@ -46,7 +51,7 @@ func maybeCreatePVC(sg *snapshotgroup.SnapshotGroup) (*corev1.PersistentVolumeCl
 	pvc, err := getPVC(sg)
 	if err == nil {
 		klog.V(5).Infof("%s/%s: PVC found", pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
-		return pvc, nil
+		return updatePVCOwnerReferences(sg, pvc)
 	}
 	if !errors.IsNotFound(err) {
 		return nil, err
@@ -54,17 +59,29 @@ func maybeCreatePVC(sg *snapshotgroup.SnapshotGroup) (*corev1.PersistentVolumeCl
 	if sg.Spec.Claim.Name != "" {
 		return nil, fmt.Errorf("%s/%s: could not find existing PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, sg.Spec.Claim.Name)
 	}
+	restore, err := getReplacingRestore(sg)
+	if err != nil {
+		// Fail closed, rather than risk creating an empty PVC in place of one being restored
+		return nil, fmt.Errorf("%s/%s: could not check for SnapshotRestores replacing the PVC - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	if restore != "" {
+		// An empty PVC would be restored over, or block the restored PVC from being created
+		return nil, fmt.Errorf("%s/%s: PVC is being replaced by SnapshotRestore %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, restore)
+	}
 	klog.V(5).Infof("%s/%s: PVC not found, creating it", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
 	return createPVC(sg, sg.Spec.Claim.Spec, nil)
 }
 
 func createPVC(sg *snapshotgroup.SnapshotGroup, spec corev1.PersistentVolumeClaimSpec, annotations map[string]string) (*corev1.PersistentVolumeClaim, error) {
-	name := getPVCName(sg)
+	name := GetPVCName(sg)
 	klog.V(3).Infof("%s/%s: creating PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, name)
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
 	annotations[managedByAnnotation] = managerName
+	if sg.ObjectMeta.UID != "" {
+		annotations[GroupUIDAnnotation] = string(sg.ObjectMeta.UID)
+	}
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        name,
@@ -73,37 +90,115 @@ func createPVC(sg *snapshotgroup.SnapshotGroup, spec corev1.PersistentVolumeClai
 		},
 		Spec: spec,
 	}
+	if sg.Spec.Claim.Name == "" {
+		pvc.ObjectMeta.OwnerReferences = getOwnerReferences(sg)
+	}
 	client := kube.GetClient()
 	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(sg.ObjectMeta.Namespace)
 	return pvcClient.Create(context.TODO(), pvc, metav1.CreateOptions{})
 }
 
-func restorePVC(sg *snapshotgroup.SnapshotGroup) error {
+// isCreatedPVC returns true if Gemini created the PVC for the SnapshotGroup, rather than using an existing claim
+func isCreatedPVC(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim) bool {
+	return sg.Spec.Claim.Name == "" && pvc.ObjectMeta.Annotations[managedByAnnotation] == managerName && isOwnedBy(pvc, sg)
+}
+
+// updatePVCOwnerReferences adds or removes the SnapshotGroup's owner reference on a PVC that Gemini created,
+// when the deletion policy changes
+func updatePVCOwnerReferences(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim) (*corev1.PersistentVolumeClaim, error) {
+	if !isCreatedPVC(sg, pvc) {
+		return pvc, nil
+	}
+	refs, changed := syncOwnerReferences(sg, pvc.ObjectMeta.OwnerReferences)
+	if !changed {
+		return pvc, nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": refs,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.V(3).Infof("%s/%s: updating owner references of PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, pvc.ObjectMeta.Name)
+	client := kube.GetClient()
+	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(sg.ObjectMeta.Namespace)
+	return pvcClient.Patch(context.TODO(), pvc.ObjectMeta.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+func restorePVC(sg *snapshotgroup.SnapshotGroup, restorePoint string) (*corev1.PersistentVolumeClaim, error) {
 	klog.V(3).Infof("%s/%s: restoring PVC", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
 	err := deletePVC(sg)
 	if err != nil && !errors.IsNotFound(err) {
-		return err
+		return nil, err
+	}
+	if err := waitForPVCDeletion(sg, quiesceTimeout); err != nil {
+		return nil, fmt.Errorf("PVC %s was not deleted: %w", GetPVCName(sg), err)
 	}
+	return createPVCFromSnapshot(sg, restorePoint)
+}
+
+// waitForPVCDeletion waits for the PVC of the SnapshotGroup to be gone. The PVC isn't deleted until no Pods use it.
+func waitForPVCDeletion(sg *snapshotgroup.SnapshotGroup, timeout time.Duration) error {
+	return wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		_, err := getPVC(sg)
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
 
-	restorePoint := sg.ObjectMeta.Annotations[RestoreAnnotation]
-	annotations := map[string]string{
-		RestoreAnnotation: restorePoint,
+// createPVCFromSnapshot creates the PVC of the SnapshotGroup from the snapshot at restorePoint. A PVC enrolled with the
+// schedule annotation keeps it, so that removing it later still deletes the SnapshotGroup
+func createPVCFromSnapshot(sg *snapshotgroup.SnapshotGroup, restorePoint string) (*corev1.PersistentVolumeClaim, error) {
+	annotations := getEnrolledClaimAnnotations(sg)
+	if annotations == nil {
+		annotations = map[string]string{}
 	}
-	spec := sg.Spec.Claim.Spec
+	annotations[RestoreAnnotation] = restorePoint
+	spec := getRestoreClaimSpec(sg)
 	apiGroup := kube.VolumeSnapshotGroupName
 	spec.DataSource = &corev1.TypedLocalObjectReference{
 		APIGroup: &apiGroup,
 		Kind:     kube.VolumeSnapshotKind,
 		Name:     sg.ObjectMeta.Name + "-" + restorePoint,
 	}
-	_, err = createPVC(sg, spec, annotations)
-	return err
+	return createPVC(sg, spec, annotations)
 }
 
 func deletePVC(sg *snapshotgroup.SnapshotGroup) error {
-	name := getPVCName(sg)
+	name := GetPVCName(sg)
 	klog.V(3).Infof("%s/%s: deleting PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, name)
 	client := kube.GetClient()
 	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(sg.ObjectMeta.Namespace)
 	return pvcClient.Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
+
+// getObservedClaimSpec returns the spec of pvc without the fields that bind it to its current volume,
+// so that it can be used to create a new PVC
+func getObservedClaimSpec(pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaimSpec {
+	spec := pvc.Spec.DeepCopy()
+	spec.VolumeName = ""
+	spec.DataSource = nil
+	spec.DataSourceRef = nil
+	return spec
+}
+
+// getRestoreClaimSpec returns the spec to restore the PVC with. This is the spec recorded in the
+// SnapshotGroup's status, or the spec of the SnapshotGroup if the PVC has not been observed yet
+func getRestoreClaimSpec(sg *snapshotgroup.SnapshotGroup) corev1.PersistentVolumeClaimSpec {
+	client := kube.GetClient()
+	latest, err := client.SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace).Get(context.TODO(), sg.ObjectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("%s/%s: could not get the recorded PVC spec - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+		latest = sg
+	}
+	if latest.Status.ClaimSpec != nil {
+		return *latest.Status.ClaimSpec.DeepCopy()
+	}
+	spec := sg.Spec.Claim.Spec.DeepCopy()
+	spec.VolumeName = ""
+	return *spec
+}
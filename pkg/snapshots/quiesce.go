@@ -0,0 +1,432 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+const (
+	deploymentKind  = "Deployment"
+	statefulSetKind = "StatefulSet"
+	replicaSetKind  = "ReplicaSet"
+)
+
+// quiesceTimeout is how long a restore waits for Pods using the PVC to terminate, and for the PVC to be deleted
+const quiesceTimeout = 5 * time.Minute
+
+// workload is a Deployment, StatefulSet or ReplicaSet whose Pods mount the PVC being restored
+type workload struct {
+	Kind     string
+	Name     string
+	Replicas int32
+	// OriginalReplicas is the replica count recorded when Gemini scaled the workload down, or -1 if it hasn't
+	OriginalReplicas int32
+	QuiescedBy       string
+}
+
+func (w workload) String() string {
+	return w.Kind + " " + w.Name
+}
+
+// getMountingPods returns the Pods that mount the PVC of the SnapshotGroup
+func getMountingPods(sg *snapshotgroup.SnapshotGroup) ([]corev1.Pod, error) {
+	client := kube.GetClient()
+	pods, err := client.K8s.CoreV1().Pods(sg.ObjectMeta.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := getClaimSet(sg)
+	if err != nil {
+		return nil, err
+	}
+	mounting := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if mountsClaim(pod, claims) {
+			mounting = append(mounting, pod)
+		}
+	}
+	return mounting, nil
+}
+
+// getClaimSet returns the names of the PVCs of the SnapshotGroup
+func getClaimSet(sg *snapshotgroup.SnapshotGroup) (map[string]bool, error) {
+	names, err := getClaimNames(sg)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]bool{}
+	for _, name := range names {
+		claims[name] = true
+	}
+	return claims, nil
+}
+
+// mountsClaim returns true if the Pod has a volume for one of the PVCs
+func mountsClaim(pod corev1.Pod, claims map[string]bool) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && claims[volume.PersistentVolumeClaim.ClaimName] {
+			return true
+		}
+	}
+	return false
+}
+
+// getController returns the owner reference of the object's controller, if it has one
+func getController(obj metav1.Object) *metav1.OwnerReference {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Controller != nil && *ref.Controller {
+			ref := ref
+			return &ref
+		}
+	}
+	return nil
+}
+
+// findMountingWorkloads returns the workloads that manage the Pods mounting the PVC of the SnapshotGroup.
+// ReplicaSets that belong to a Deployment are scaled through the Deployment.
+func findMountingWorkloads(sg *snapshotgroup.SnapshotGroup) ([]workload, error) {
+	pods, err := getMountingPods(sg)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]workload{}
+	for _, pod := range pods {
+		owner := getController(&pod)
+		if owner == nil || (owner.Kind != replicaSetKind && owner.Kind != statefulSetKind) {
+			return nil, fmt.Errorf("pod %s mounts PVC %s, but is not managed by a Deployment, StatefulSet or ReplicaSet", pod.ObjectMeta.Name, GetPVCName(sg))
+		}
+		kind, name := owner.Kind, owner.Name
+		if kind == replicaSetKind {
+			rs, err := kube.GetClient().K8s.AppsV1().ReplicaSets(sg.ObjectMeta.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if rsOwner := getController(rs); rsOwner != nil && rsOwner.Kind == deploymentKind {
+				kind, name = deploymentKind, rsOwner.Name
+			}
+		}
+		if _, ok := found[kind+"/"+name]; ok {
+			continue
+		}
+		w, err := getWorkload(sg.ObjectMeta.Namespace, kind, name)
+		if err != nil {
+			return nil, err
+		}
+		found[kind+"/"+name] = w
+	}
+	return sortWorkloads(found), nil
+}
+
+// findQuiescedWorkloads returns the workloads that Gemini scaled down to restore the PVC of the SnapshotGroup.
+// These are found by their labels and annotations, so that a restore can be resumed after the controller restarts.
+func findQuiescedWorkloads(sg *snapshotgroup.SnapshotGroup) ([]workload, error) {
+	client := kube.GetClient()
+	namespace := sg.ObjectMeta.Namespace
+	listOptions := metav1.ListOptions{}
+	if hasQuiescedByLabel(sg) {
+		listOptions.LabelSelector = labels.SelectorFromSet(labels.Set{QuiescedByLabel: sg.ObjectMeta.Name}).String()
+	}
+	objects := []metav1.Object{}
+	deployments, err := client.K8s.AppsV1().Deployments(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range deployments.Items {
+		objects = append(objects, &deployments.Items[idx])
+	}
+	statefulSets, err := client.K8s.AppsV1().StatefulSets(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range statefulSets.Items {
+		objects = append(objects, &statefulSets.Items[idx])
+	}
+	replicaSets, err := client.K8s.AppsV1().ReplicaSets(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range replicaSets.Items {
+		objects = append(objects, &replicaSets.Items[idx])
+	}
+
+	found := map[string]workload{}
+	for _, obj := range objects {
+		if obj.GetAnnotations()[QuiescedByAnnotation] != sg.ObjectMeta.Name {
+			continue
+		}
+		w, err := newWorkload(obj)
+		if err != nil {
+			return nil, err
+		}
+		found[w.Kind+"/"+w.Name] = w
+	}
+	return sortWorkloads(found), nil
+}
+
+// hasQuiescedByLabel returns true if the workloads scaled down for the SnapshotGroup are labelled with its name
+func hasQuiescedByLabel(sg *snapshotgroup.SnapshotGroup) bool {
+	return len(validation.IsValidLabelValue(sg.ObjectMeta.Name)) == 0
+}
+
+func sortWorkloads(found map[string]workload) []workload {
+	workloads := []workload{}
+	for _, w := range found {
+		workloads = append(workloads, w)
+	}
+	sort.Slice(workloads, func(i, j int) bool {
+		return workloads[i].String() < workloads[j].String()
+	})
+	return workloads
+}
+
+func getWorkload(namespace, kind, name string) (workload, error) {
+	client := kube.GetClient()
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case deploymentKind:
+		obj, err = client.K8s.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case statefulSetKind:
+		obj, err = client.K8s.AppsV1().StatefulSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case replicaSetKind:
+		obj, err = client.K8s.AppsV1().ReplicaSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	default:
+		err = fmt.Errorf("cannot scale %s %s", kind, name)
+	}
+	if err != nil {
+		return workload{}, err
+	}
+	return newWorkload(obj)
+}
+
+func newWorkload(obj metav1.Object) (workload, error) {
+	w := workload{
+		Name:             obj.GetName(),
+		Replicas:         1,
+		OriginalReplicas: -1,
+		QuiescedBy:       obj.GetAnnotations()[QuiescedByAnnotation],
+	}
+	var replicas *int32
+	switch typed := obj.(type) {
+	case *appsv1.Deployment:
+		w.Kind, replicas = deploymentKind, typed.Spec.Replicas
+	case *appsv1.StatefulSet:
+		w.Kind, replicas = statefulSetKind, typed.Spec.Replicas
+	case *appsv1.ReplicaSet:
+		w.Kind, replicas = replicaSetKind, typed.Spec.Replicas
+	default:
+		return w, fmt.Errorf("cannot scale %T %s", obj, obj.GetName())
+	}
+	if replicas != nil {
+		w.Replicas = *replicas
+	}
+	if original, ok := obj.GetAnnotations()[OriginalReplicasAnnotation]; ok {
+		parsed, err := strconv.ParseInt(original, 10, 32)
+		if err != nil {
+			return w, fmt.Errorf("%s has an invalid %s annotation %q", w, OriginalReplicasAnnotation, original)
+		}
+		w.OriginalReplicas = int32(parsed)
+	}
+	return w, nil
+}
+
+// quiesceWorkloads scales the workloads that mount the PVC of the SnapshotGroup to zero, recording their replica
+// counts in annotations so that they can be scaled back up even if the controller restarts mid-restore. The status of
+// the SnapshotGroup is marked before any workload is scaled down, so that an interrupted restore knows to resume them.
+func quiesceWorkloads(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	workloads, err := findMountingWorkloads(sg)
+	if err != nil {
+		return err
+	}
+	if len(workloads) == 0 {
+		return nil
+	}
+	err = updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+		status.WorkloadsQuiesced = true
+	})
+	if err != nil {
+		return err
+	}
+	quiescedBy := map[string]interface{}{}
+	if hasQuiescedByLabel(sg) {
+		quiescedBy[QuiescedByLabel] = sg.ObjectMeta.Name
+	}
+	for _, w := range workloads {
+		if w.QuiescedBy != "" {
+			// Never overwrite the recorded replica count with zero
+			klog.V(5).Infof("%s/%s: %s was already scaled down by %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, w, w.QuiescedBy)
+			continue
+		}
+		klog.V(3).Infof("%s/%s: scaling down %s from %d replicas", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, w, w.Replicas)
+		err := patchWorkload(sg.ObjectMeta.Namespace, w, 0, quiescedBy, map[string]interface{}{
+			QuiescedByAnnotation:       sg.ObjectMeta.Name,
+			OriginalReplicasAnnotation: strconv.Itoa(int(w.Replicas)),
+		})
+		if err != nil {
+			return err
+		}
+		recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonWorkloadScaledDown, "Scaled down %s from %d replicas to restore PVC %s", w, w.Replicas, GetPVCName(sg))
+	}
+	return nil
+}
+
+// waitForPodsToTerminate waits until no Pods mount the PVC of the SnapshotGroup
+func waitForPodsToTerminate(sg *snapshotgroup.SnapshotGroup, timeout time.Duration) error {
+	return wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		pods, err := getMountingPods(sg)
+		if err != nil {
+			return false, err
+		}
+		if len(pods) > 0 {
+			klog.V(5).Infof("%s/%s: waiting for %d pods using PVC %s to terminate", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, len(pods), GetPVCName(sg))
+		}
+		return len(pods) == 0, nil
+	})
+}
+
+// resumeWorkloads scales the workloads that were quiesced for a restore back to their original replica counts, and
+// clears the mark in the status of the SnapshotGroup once they all are
+func resumeWorkloads(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	workloads, err := findQuiescedWorkloads(sg)
+	if err != nil {
+		return err
+	}
+	for _, w := range workloads {
+		replicas := w.OriginalReplicas
+		if replicas < 0 {
+			replicas = w.Replicas
+		}
+		klog.V(3).Infof("%s/%s: scaling %s back up to %d replicas", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, w, replicas)
+		err := patchWorkload(sg.ObjectMeta.Namespace, w, replicas, map[string]interface{}{
+			QuiescedByLabel: nil,
+		}, map[string]interface{}{
+			QuiescedByAnnotation:       nil,
+			OriginalReplicasAnnotation: nil,
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonWorkloadScaledUp, "Scaled %s back up to %d replicas", w, replicas)
+	}
+	return updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+		status.WorkloadsQuiesced = false
+	})
+}
+
+// resumeWorkloadsIfPVCExists scales quiesced workloads back up after a failed restore, unless the PVC was already
+// deleted, in which case they are left scaled down until the restore is retried
+func resumeWorkloadsIfPVCExists(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) {
+	pvc, err := getPVC(sg)
+	if err != nil || pvc.ObjectMeta.DeletionTimestamp != nil {
+		klog.Warningf("%s/%s: leaving workloads scaled down, because PVC %s is missing", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, GetPVCName(sg))
+		return
+	}
+	if err := resumeWorkloads(sg, recorder); err != nil {
+		klog.Warningf("%s/%s: failed to scale workloads back up - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+}
+
+// patchWorkload sets the replica count of a workload, along with its labels and annotations. A nil value is removed.
+func patchWorkload(namespace string, w workload, replicas int32, workloadLabels, workloadAnnotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      workloadLabels,
+			"annotations": workloadAnnotations,
+		},
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	client := kube.GetClient()
+	switch w.Kind {
+	case deploymentKind:
+		_, err = client.K8s.AppsV1().Deployments(namespace).Patch(context.TODO(), w.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case statefulSetKind:
+		_, err = client.K8s.AppsV1().StatefulSets(namespace).Patch(context.TODO(), w.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case replicaSetKind:
+		_, err = client.K8s.AppsV1().ReplicaSets(namespace).Patch(context.TODO(), w.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("cannot scale %s", w)
+	}
+	return err
+}
+
+// resumeInterruptedRestore scales workloads back up if a restore of the SnapshotGroup's PVC finished without doing so,
+// such as when the controller restarted mid-restore. Nothing is done unless the status says that workloads were scaled
+// down, or while a restore is still in progress.
+func resumeInterruptedRestore(sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder) error {
+	if !sg.Status.WorkloadsQuiesced {
+		return nil
+	}
+	restoring := meta.FindStatusCondition(sg.Status.Conditions, snapshotgroup.ConditionRestoring)
+	if restoring != nil && restoring.Status == metav1.ConditionTrue {
+		return nil
+	}
+	active, err := getFirstReplacingRestore(sg)
+	if err != nil || active != nil {
+		return err
+	}
+	return resumeWorkloads(sg, recorder)
+}
+
+// IsRestoreInterrupted returns true if a restore requested with the restore annotation was started but never
+// finished, such as when the controller restarted mid-restore. The cache can lag behind the end of a restore, so the
+// SnapshotGroup is read from the API before saying so
+func IsRestoreInterrupted(sg *snapshotgroup.SnapshotGroup) (bool, error) {
+	if !isRestoring(sg) {
+		return false, nil
+	}
+	latest, err := kube.GetClient().SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace).Get(context.TODO(), sg.ObjectMeta.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isRestoring(latest), nil
+}
+
+// isRestoring returns true if the status of sg says that a restore requested with the restore annotation is in progress
+func isRestoring(sg *snapshotgroup.SnapshotGroup) bool {
+	restoring := meta.FindStatusCondition(sg.Status.Conditions, snapshotgroup.ConditionRestoring)
+	return sg.ObjectMeta.Annotations[RestoreAnnotation] != "" && restoring != nil && restoring.Status == metav1.ConditionTrue
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func newMountingPod(name, claim, ownerKind, ownerName string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+				},
+			}},
+		},
+	}
+	if ownerKind != "" {
+		isController := true
+		pod.ObjectMeta.OwnerReferences = []metav1.OwnerReference{{Kind: ownerKind, Name: ownerName, Controller: &isController}}
+	}
+	return pod
+}
+
+func TestQuiesceWorkloads(t *testing.T) {
+	client := kube.SetFakeClient()
+	recorder := record.NewFakeRecorder(100)
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}
+	_, err := client.SnapshotGroupClient.SnapshotGroups("default").Create(context.TODO(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	isQuiesced := func() bool {
+		latest, err := client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return latest.Status.WorkloadsQuiesced
+	}
+	apps := client.K8s.AppsV1()
+	isController := true
+	three, two := int32(3), int32(2)
+	_, err = apps.Deployments("default").Create(context.TODO(), &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &three},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = apps.ReplicaSets("default").Create(context.TODO(), &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-abc",
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &isController}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Replicas: &three},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = apps.StatefulSets("default").Create(context.TODO(), &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &two},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	for _, pod := range []*corev1.Pod{
+		newMountingPod("web-abc-1", "foo", "ReplicaSet", "web-abc"),
+		newMountingPod("web-abc-2", "foo", "ReplicaSet", "web-abc"),
+		newMountingPod("db-0", "foo", "StatefulSet", "db"),
+		newMountingPod("other", "bar", "", ""),
+	} {
+		_, err := client.K8s.CoreV1().Pods("default").Create(context.TODO(), pod, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+
+	workloads, err := findMountingWorkloads(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Deployment web", "StatefulSet db"}, []string{workloads[0].String(), workloads[1].String()})
+
+	assert.NoError(t, quiesceWorkloads(sg, recorder))
+	deployment, err := apps.Deployments("default").Get(context.TODO(), "web", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+	assert.Equal(t, "3", deployment.ObjectMeta.Annotations[OriginalReplicasAnnotation])
+	assert.Equal(t, "foo", deployment.ObjectMeta.Annotations[QuiescedByAnnotation])
+	assert.Equal(t, "foo", deployment.ObjectMeta.Labels[QuiescedByLabel])
+	assert.True(t, isQuiesced())
+	statefulSet, err := apps.StatefulSets("default").Get(context.TODO(), "db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), *statefulSet.Spec.Replicas)
+	assert.Equal(t, "2", statefulSet.ObjectMeta.Annotations[OriginalReplicasAnnotation])
+
+	assert.NoError(t, quiesceWorkloads(sg, recorder), "pods that are still terminating are skipped")
+	deployment, err = apps.Deployments("default").Get(context.TODO(), "web", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "3", deployment.ObjectMeta.Annotations[OriginalReplicasAnnotation], "the original count is never overwritten")
+
+	assert.NoError(t, resumeWorkloads(sg, recorder))
+	deployment, err = apps.Deployments("default").Get(context.TODO(), "web", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), *deployment.Spec.Replicas)
+	assert.NotContains(t, deployment.ObjectMeta.Annotations, OriginalReplicasAnnotation)
+	assert.NotContains(t, deployment.ObjectMeta.Annotations, QuiescedByAnnotation)
+	assert.NotContains(t, deployment.ObjectMeta.Labels, QuiescedByLabel)
+	assert.False(t, isQuiesced())
+	statefulSet, err = apps.StatefulSets("default").Get(context.TODO(), "db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), *statefulSet.Spec.Replicas)
+	assert.Contains(t, <-recorder.Events, "Normal WorkloadScaledDown Scaled down Deployment web from 3 replicas to restore PVC foo")
+
+	_, err = client.K8s.CoreV1().Pods("default").Create(context.TODO(), newMountingPod("bare", "foo", "", ""), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, quiesceWorkloads(sg, recorder), "pods that can't be scaled down fail the restore")
+}
+
+func TestResumeInterruptedRestore(t *testing.T) {
+	client := kube.SetFakeClient()
+	recorder := record.NewFakeRecorder(100)
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}
+	zero := int32(0)
+	_, err := client.K8s.AppsV1().Deployments("default").Create(context.TODO(), &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Labels:      map[string]string{QuiescedByLabel: "foo"},
+			Annotations: map[string]string{QuiescedByAnnotation: "foo", OriginalReplicasAnnotation: "4"},
+		},
+		Spec: appsv1.DeploymentSpec{Replicas: &zero},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	getReplicas := func() int32 {
+		deployment, err := client.K8s.AppsV1().Deployments("default").Get(context.TODO(), "web", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return *deployment.Spec.Replicas
+	}
+
+	assert.NoError(t, resumeInterruptedRestore(sg, recorder))
+	assert.Equal(t, int32(0), getReplicas(), "groups that were never restored are left alone")
+
+	sg.Status.Conditions = []metav1.Condition{{Type: snapshotgroup.ConditionRestoring, Status: metav1.ConditionTrue}}
+	sg.ObjectMeta.Annotations = map[string]string{RestoreAnnotation: "1585945609"}
+	sg.Status.WorkloadsQuiesced = true
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").Create(context.TODO(), sg, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	interrupted, err := IsRestoreInterrupted(sg)
+	assert.NoError(t, err)
+	assert.True(t, interrupted)
+	assert.NoError(t, resumeInterruptedRestore(sg, recorder))
+	assert.Equal(t, int32(0), getReplicas(), "workloads stay down until the restore finishes")
+
+	// The restore finished, but the cache hasn't seen it yet
+	finished := sg.DeepCopy()
+	finished.Status.Conditions[0].Status = metav1.ConditionFalse
+	_, err = client.SnapshotGroupClient.SnapshotGroups("default").UpdateStatus(context.TODO(), finished, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	interrupted, err = IsRestoreInterrupted(sg)
+	assert.NoError(t, err)
+	assert.False(t, interrupted, "the status is read from the API")
+
+	interrupted, err = IsRestoreInterrupted(finished)
+	assert.NoError(t, err)
+	assert.False(t, interrupted)
+	resumed := finished.DeepCopy()
+	resumed.Status.WorkloadsQuiesced = false
+	assert.NoError(t, resumeInterruptedRestore(resumed, recorder))
+	assert.Equal(t, int32(0), getReplicas(), "workloads are only looked up while the status says they are scaled down")
+
+	assert.NoError(t, resumeInterruptedRestore(finished, recorder))
+	assert.Equal(t, int32(4), getReplicas())
+	latest, err := client.SnapshotGroupClient.SnapshotGroups("default").Get(context.TODO(), "foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, latest.Status.WorkloadsQuiesced, "the mark is cleared once the workloads are scaled back up")
+}
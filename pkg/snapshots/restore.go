@@ -0,0 +1,368 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	snapshotsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// parseRestoreTarget returns the namespace and name of the PVC to restore into.
+// The target is either a name in the namespace of the SnapshotGroup, or namespace/name.
+func parseRestoreTarget(sg *snapshotgroup.SnapshotGroup, target string) (string, string, error) {
+	namespace, name := sg.ObjectMeta.Namespace, target
+	if parts := strings.SplitN(target, "/", 2); len(parts) == 2 {
+		namespace, name = parts[0], parts[1]
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid restore target namespace %q: %s", namespace, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid restore target name %q: %s", name, strings.Join(errs, ", "))
+	}
+	if namespace == sg.ObjectMeta.Namespace && name == GetPVCName(sg) {
+		return "", "", fmt.Errorf("restore target %s is the PVC being backed up", target)
+	}
+	return namespace, name, nil
+}
+
+// checkRestoreTargetNamespace returns an error unless sg may restore into namespace. Restoring into another namespace
+// requires it to be watched, and to allow the namespace of sg with the allow-restore-from annotation
+func checkRestoreTargetNamespace(sg *snapshotgroup.SnapshotGroup, namespace string) error {
+	if namespace == sg.ObjectMeta.Namespace {
+		return nil
+	}
+	client := kube.GetClient()
+	if client.GetSnapshotInformer(namespace) == nil || !client.IsWatched(namespace) {
+		return fmt.Errorf("namespace %s is not watched", namespace)
+	}
+	ns, err := client.K8s.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, allowed := range strings.Split(ns.ObjectMeta.Annotations[AllowRestoreFromAnnotation], ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == sg.ObjectMeta.Namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("namespace %s does not allow restores from %s with the %s annotation", namespace, sg.ObjectMeta.Namespace, AllowRestoreFromAnnotation)
+}
+
+// restoreToNewPVC creates a new PVC from a snapshot, leaving the PVC being backed up untouched
+func restoreToNewPVC(sg *snapshotgroup.SnapshotGroup, restorePoint, target string, recorder record.EventRecorder) error {
+	klog.V(3).Infof("%s/%s: restoring %s into new PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, restorePoint, target)
+	if err := setRestoringStatus(sg, nil, false); err != nil {
+		return err
+	}
+	recordEvent(recorder, sg, nil, corev1.EventTypeNormal, ReasonRestoreStarted, "Restoring %s into new PVC %s", restorePoint, target)
+	pvc, err := createRestoredPVC(sg, restorePoint, target)
+	if err != nil {
+		klog.Warningf("%s/%s: failed to restore into new PVC %s - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, target, err)
+		setRestoreFailedStatus(sg, err)
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+		recordEvent(recorder, sg, nil, corev1.EventTypeWarning, ReasonRestoreFailed, "Failed to restore %s into new PVC %s: %v", restorePoint, target, err)
+		return err
+	}
+	// Retrying finds the PVC already restored, so it only records the status again
+	if err := setRestoringStatus(sg, nil, true); err != nil {
+		return err
+	}
+	metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "success").Inc()
+	recordEvent(recorder, sg, pvc, corev1.EventTypeNormal, ReasonRestoreCompleted, "Restored %s into new PVC %s/%s", restorePoint, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+	return nil
+}
+
+func createRestoredPVC(sg *snapshotgroup.SnapshotGroup, restorePoint, target string) (*corev1.PersistentVolumeClaim, error) {
+	namespace, name, err := parseRestoreTarget(sg, target)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRestoreTargetNamespace(sg, namespace); err != nil {
+		return nil, err
+	}
+	snapshot, err := GetSnapshot(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name+"-"+restorePoint)
+	if err != nil {
+		return nil, err
+	}
+	restoredFrom := snapshot.Namespace + "/" + snapshot.Name
+
+	client := kube.GetClient()
+	pvcClient := client.K8s.CoreV1().PersistentVolumeClaims(namespace)
+	existing, err := pvcClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err == nil {
+		if existing.ObjectMeta.Annotations[RestoredFromAnnotation] == restoredFrom {
+			klog.V(5).Infof("%s/%s: PVC %s/%s was already restored from %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, namespace, name, restoredFrom)
+			return existing, nil
+		}
+		return nil, fmt.Errorf("PVC %s/%s already exists", namespace, name)
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	annotations := map[string]string{
+		managedByAnnotation:    managerName,
+		RestoreAnnotation:      restorePoint,
+		RestoredFromAnnotation: restoredFrom,
+	}
+	snapshotName := snapshot.Name
+	if namespace != snapshot.Namespace {
+		snapshotName, err = copySnapshotToNamespace(sg, snapshot, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		annotations[RestoredForAnnotation] = getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	}
+	spec := getRestoreClaimSpec(sg)
+	apiGroup := kube.VolumeSnapshotGroupName
+	spec.DataSource = &corev1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     kube.VolumeSnapshotKind,
+		Name:     snapshotName,
+	}
+	spec.DataSourceRef = nil
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+	klog.V(3).Infof("%s/%s: creating PVC %s/%s from snapshot %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, namespace, name, snapshotName)
+	return pvcClient.Create(context.TODO(), pvc, metav1.CreateOptions{})
+}
+
+// copySnapshotToNamespace makes a snapshot available in another namespace, by creating a VolumeSnapshotContent
+// for the same underlying snapshot and binding a new VolumeSnapshot to it. It returns the name of the new VolumeSnapshot.
+// The copy is deleted by cleanupSnapshotCopies once the PVC restored from it is bound.
+func copySnapshotToNamespace(sg *snapshotgroup.SnapshotGroup, snapshot *GeminiSnapshot, namespace, claim string) (string, error) {
+	client := kube.GetClient()
+	if strings.HasSuffix(client.VolumeSnapshotVersion, "v1alpha1") {
+		return "", fmt.Errorf("restoring into another namespace is not supported for %s", client.VolumeSnapshotVersion)
+	}
+	restoredFrom := snapshot.Namespace + "/" + snapshot.Name
+	snapClient := client.SnapshotClient.Namespace(namespace)
+	existing, err := snapClient.Get(context.TODO(), snapshot.Name, metav1.GetOptions{})
+	if err == nil {
+		if existing.GetAnnotations()[RestoredFromAnnotation] == restoredFrom {
+			return snapshot.Name, nil
+		}
+		return "", fmt.Errorf("VolumeSnapshot %s/%s already exists", namespace, snapshot.Name)
+	}
+	if !errors.IsNotFound(err) {
+		return "", err
+	}
+
+	vs := snapshot.VolumeSnapshot
+	if vs == nil || vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil || vs.Status.ReadyToUse == nil || !*vs.Status.ReadyToUse {
+		return "", fmt.Errorf("snapshot %s is not ready to use", restoredFrom)
+	}
+	contentUnst, err := client.SnapshotContentClient.Get(context.TODO(), *vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	source := snapshotsv1.VolumeSnapshotContent{}
+	if err := fromUnstructured(contentUnst, &source); err != nil {
+		return "", err
+	}
+	if source.Status == nil || source.Status.SnapshotHandle == nil {
+		return "", fmt.Errorf("VolumeSnapshotContent %s has no snapshot handle", source.ObjectMeta.Name)
+	}
+
+	annotations := map[string]string{
+		managedByAnnotation:     managerName,
+		RestoredFromAnnotation:  restoredFrom,
+		RestoredForAnnotation:   getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name),
+		RestoreTargetAnnotation: claim,
+	}
+	contentName := getCopiedContentName(restoredFrom, namespace)
+	content := snapshotsv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        contentName,
+			Annotations: annotations,
+		},
+		Spec: snapshotsv1.VolumeSnapshotContentSpec{
+			VolumeSnapshotRef: corev1.ObjectReference{
+				Namespace: namespace,
+				Name:      snapshot.Name,
+			},
+			// The underlying snapshot is shared with the original, so it must outlive the copy
+			DeletionPolicy:          snapshotsv1.VolumeSnapshotContentRetain,
+			Driver:                  source.Spec.Driver,
+			VolumeSnapshotClassName: source.Spec.VolumeSnapshotClassName,
+			Source: snapshotsv1.VolumeSnapshotContentSource{
+				SnapshotHandle: source.Status.SnapshotHandle,
+			},
+		},
+	}
+	contentCopy, err := toUnstructured(content, kube.VolumeSnapshotContentKind)
+	if err != nil {
+		return "", err
+	}
+	klog.V(3).Infof("%s: creating VolumeSnapshotContent %s for namespace %s", restoredFrom, contentName, namespace)
+	if _, err := client.SnapshotContentClient.Create(context.TODO(), contentCopy, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	snapshotCopy := snapshotsv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        snapshot.Name,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: snapshotsv1.VolumeSnapshotSpec{
+			Source: snapshotsv1.VolumeSnapshotSource{
+				VolumeSnapshotContentName: &contentName,
+			},
+			VolumeSnapshotClassName: vs.Spec.VolumeSnapshotClassName,
+		},
+	}
+	snapshotUnst, err := toUnstructured(snapshotCopy, kube.VolumeSnapshotKind)
+	if err != nil {
+		return "", err
+	}
+	klog.V(3).Infof("%s: creating VolumeSnapshot %s/%s", restoredFrom, namespace, snapshot.Name)
+	if _, err := snapClient.Create(context.TODO(), snapshotUnst, metav1.CreateOptions{}); err != nil {
+		return "", err
+	}
+	return snapshot.Name, nil
+}
+
+// indexBySnapshotCopy indexes copies of VolumeSnapshots by the SnapshotGroup that restored from them
+func indexBySnapshotCopy(obj interface{}) ([]string, error) {
+	snapshotMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	group := snapshotMeta.GetAnnotations()[RestoredForAnnotation]
+	if group == "" {
+		return nil, nil
+	}
+	return []string{group}, nil
+}
+
+// cleanupSnapshotCopies deletes the copies of snapshots that sg made to restore into other namespaces, once the PVC
+// restored from a copy is bound and no longer needs it, or the PVC is gone
+func cleanupSnapshotCopies(sg *snapshotgroup.SnapshotGroup) error {
+	client := kube.GetClient()
+	key := getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	for _, informer := range client.SnapshotInformers {
+		objs, err := informer.GetIndexer().ByIndex(snapshotCopyIndex, key)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			snapshotCopy, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			needed, err := isSnapshotCopyNeeded(snapshotCopy)
+			if err != nil {
+				return err
+			}
+			if needed {
+				continue
+			}
+			if err := deleteSnapshotCopy(snapshotCopy); err != nil {
+				return err
+			}
+			klog.V(3).Infof("%s/%s: deleted copy %s/%s of snapshot %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, snapshotCopy.GetNamespace(), snapshotCopy.GetName(), snapshotCopy.GetAnnotations()[RestoredFromAnnotation])
+		}
+	}
+	return nil
+}
+
+// isSnapshotCopyNeeded returns true until the PVC restored from a copy of a snapshot is bound. A copy whose PVC
+// doesn't exist is kept for a while, as the PVC is created right after the copy
+func isSnapshotCopyNeeded(snapshotCopy *unstructured.Unstructured) (bool, error) {
+	pvc, err := kube.GetClient().GetPVC(snapshotCopy.GetNamespace(), snapshotCopy.GetAnnotations()[RestoreTargetAnnotation])
+	if errors.IsNotFound(err) {
+		return time.Since(snapshotCopy.GetCreationTimestamp().Time) < snapshotChangesTimeout, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pvc.Status.Phase != corev1.ClaimBound, nil
+}
+
+// deleteSnapshotCopy deletes a copy of a snapshot and its VolumeSnapshotContent. The content has a Retain deletion
+// policy, so the underlying snapshot is kept for the original VolumeSnapshot
+func deleteSnapshotCopy(snapshotCopy *unstructured.Unstructured) error {
+	client := kube.GetClient()
+	contentName := getCopiedContentName(snapshotCopy.GetAnnotations()[RestoredFromAnnotation], snapshotCopy.GetNamespace())
+	content, err := client.SnapshotContentClient.Get(context.TODO(), contentName, metav1.GetOptions{})
+	if err == nil && content.GetAnnotations()[RestoredFromAnnotation] == snapshotCopy.GetAnnotations()[RestoredFromAnnotation] {
+		err = client.SnapshotContentClient.Delete(context.TODO(), contentName, metav1.DeleteOptions{})
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	err = client.SnapshotClient.Namespace(snapshotCopy.GetNamespace()).Delete(context.TODO(), snapshotCopy.GetName(), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// getCopiedContentName returns a stable name for the VolumeSnapshotContent that copies a snapshot into namespace
+func getCopiedContentName(restoredFrom, namespace string) string {
+	hash := sha256.Sum256([]byte(restoredFrom + "/" + namespace))
+	return "gemini-" + hex.EncodeToString(hash[:])[:20]
+}
+
+func toUnstructured(obj interface{}, kind string) (*unstructured.Unstructured, error) {
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	unst := &unstructured.Unstructured{
+		Object: map[string]interface{}{},
+	}
+	if err := json.Unmarshal(marshaled, &unst.Object); err != nil {
+		return nil, err
+	}
+	unst.Object["kind"] = kind
+	unst.Object["apiVersion"] = kube.GetClient().VolumeSnapshotVersion
+	return unst, nil
+}
+
+func fromUnstructured(unst *unstructured.Unstructured, obj interface{}) error {
+	marshaled, err := json.Marshal(unst)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(marshaled, obj)
+}
@@ -21,6 +21,8 @@ import (
 	"time"
 
 	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 )
 
@@ -28,31 +30,162 @@ var durations = map[string]time.Duration{
 	"second": time.Second,
 	"minute": time.Minute,
 	"hour":   time.Hour,
-	"day":    time.Hour * 24,
-	"week":   time.Hour * 24 * 7,
-	// TODO: get more accurate on month/year
+	// These are nominal lengths. Snapshots are scheduled by calendar period, see calendarSchedule
+	"day":   time.Hour * 24,
+	"week":  time.Hour * 24 * 7,
 	"month": time.Hour * 24 * 30,
 	"year":  time.Hour * 24 * 365,
 }
 
-func getSnapshotChanges(schedules []snapshotgroup.SnapshotSchedule, snapshots []*GeminiSnapshot) ([]string, []*GeminiSnapshot, error) {
+// calendarUnits lists the units which are scheduled by calendar period rather than by duration
+var calendarUnits = map[string]bool{
+	"day":   true,
+	"week":  true,
+	"month": true,
+	"year":  true,
+}
+
+// zonedCalendarUnits lists the calendar units which are only scheduled by calendar period when the SnapshotGroup sets
+// a time zone. Without one, they remain fixed durations, so existing schedules don't shift when upgrading
+var zonedCalendarUnits = map[string]bool{
+	"day":  true,
+	"week": true,
+}
+
+// intervalSchedule fires a fixed duration after the previous snapshot
+type intervalSchedule struct {
+	duration time.Duration
+}
+
+// Next returns the time at which the next snapshot is due
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.duration)
+}
+
+// calendarSchedule fires at the start of the calendar period following the one containing the previous snapshot.
+// Periods begin at midnight in the given location, and weeks begin on Monday.
+type calendarSchedule struct {
+	unit     string
+	amount   int
+	location *time.Location
+}
+
+// Next returns the time at which the next snapshot is due
+func (s calendarSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.location)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.location)
+	switch s.unit {
+	case "week":
+		daysSinceMonday := (int(start.Weekday()) + 6) % 7
+		return start.AddDate(0, 0, 7*s.amount-daysSinceMonday)
+	case "month":
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, s.location)
+		return start.AddDate(0, s.amount, 0)
+	case "year":
+		start = time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, s.location)
+		return start.AddDate(s.amount, 0, 0)
+	}
+	return start.AddDate(0, 0, s.amount)
+}
+
+// cronSchedule evaluates a cron expression in the given location
+type cronSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+// Next returns the time at which the next snapshot is due
+func (s cronSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.location))
+}
+
+// getLocation returns the time zone used to schedule snapshots for a SnapshotGroup. It returns nil if the SnapshotGroup
+// doesn't set one, in which case schedules are evaluated in UTC, and days and weeks are fixed durations
+func getLocation(sg *snapshotgroup.SnapshotGroup) (*time.Location, error) {
+	if sg.Spec.TimeZone == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(sg.Spec.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load time zone %s: %v", sg.Spec.TimeZone, err)
+	}
+	return location, nil
+}
+
+// getScheduleName returns the name recorded in IntervalsAnnotation for snapshots taken on this schedule
+func getScheduleName(schedule snapshotgroup.SnapshotSchedule) (string, error) {
+	if schedule.Every != "" && schedule.Cron != "" {
+		return "", fmt.Errorf("Schedule cannot specify both every (%s) and cron (%s)", schedule.Every, schedule.Cron)
+	}
+	if schedule.Cron != "" {
+		if strings.Contains(schedule.Cron, intervalsSeparator) {
+			return "", fmt.Errorf("Could not parse cron expression %s", schedule.Cron)
+		}
+		return schedule.Cron, nil
+	}
+	if schedule.Every != "" {
+		return schedule.Every, nil
+	}
+	return "", fmt.Errorf("Schedule must specify either every or cron")
+}
+
+// parseSchedule parses a schedule name, which is either a gemini interval or a cron expression.
+// location is nil if the SnapshotGroup doesn't set a time zone, see getLocation
+func parseSchedule(str string, location *time.Location) (cron.Schedule, error) {
+	zoned := location != nil
+	if location == nil {
+		location = time.UTC
+	}
+	amt, unit, err := parseIntervalParts(str)
+	if err == nil {
+		if calendarUnits[unit] && (zoned || !zonedCalendarUnits[unit]) {
+			return calendarSchedule{unit: unit, amount: amt, location: location}, nil
+		}
+		return intervalSchedule{duration: time.Duration(amt) * durations[unit]}, nil
+	}
+	schedule, cronErr := cron.ParseStandard(str)
+	if cronErr != nil {
+		return nil, fmt.Errorf("Could not parse %s as an interval or cron expression", str)
+	}
+	return cronSchedule{schedule: schedule, location: location}, nil
+}
+
+// getFirstSnapshotTime returns when the first snapshot of a schedule is due, given the time the SnapshotGroup was created.
+// Cron schedules wait for their first match, so that snapshots are aligned with it, while intervals are due immediately
+func getFirstSnapshotTime(schedule cron.Schedule, created time.Time) time.Time {
+	if _, ok := schedule.(cronSchedule); ok {
+		return schedule.Next(created)
+	}
+	return created
+}
+
+func getSnapshotChanges(schedules []snapshotgroup.SnapshotSchedule, snapshots []*GeminiSnapshot, location *time.Location, created time.Time) ([]string, []*GeminiSnapshot, error) {
 	numToKeepByInterval := map[string]int{}
 	numSnapshotsByInterval := map[string]int{}
+	scheduleNames := []string{}
 	for _, schedule := range schedules {
+		name, err := getScheduleName(schedule)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := parseSchedule(name, location); err != nil {
+			return nil, nil, err
+		}
+		scheduleNames = append(scheduleNames, name)
 		// Note - we have to keep an "extra" snapshot to cover the whole range
 		// e.g. With "every 1 year, keep 2", on 1/1/2020, we would have snapshots for
 		// - 1/1/2020
 		// - 1/1/2019
 		// - 1/1/2018
 		// So we're convered with 2 full years of backups.
-		numToKeepByInterval[schedule.Every] = schedule.Keep + 1
+		numToKeepByInterval[name] = schedule.Keep + 1
 	}
 	now := time.Now().UTC()
 
 	toDelete := []*GeminiSnapshot{}
 	needsCreation := map[string]bool{}
-	for _, schedule := range schedules {
-		needsCreation[schedule.Every] = true
+	for _, name := range scheduleNames {
+		needsCreation[name] = true
 	}
 	for _, snapshot := range snapshots {
 		klog.V(5).Infof("Checking snapshot %s/%s", snapshot.Namespace, snapshot.Name)
@@ -60,15 +193,19 @@ func getSnapshotChanges(schedules []snapshotgroup.SnapshotSchedule, snapshots []
 			klog.V(5).Infof("Skipping restore snapshot %s/%s", snapshot.Namespace, snapshot.Name)
 			continue
 		}
+		if snapshot.Manual != "" {
+			klog.V(5).Infof("Skipping manual snapshot %s/%s", snapshot.Namespace, snapshot.Name)
+			continue
+		}
 		keep := false
 		for _, interval := range snapshot.Intervals {
 			if numSnapshotsByInterval[interval] == 0 {
-				parsed, err := ParseInterval(interval)
+				parsed, err := parseSchedule(interval, location)
 				if err != nil {
 					return nil, nil, err
 				}
 				// This is the latest snapshot
-				nextSnapshotTime := snapshot.Timestamp.Add(parsed)
+				nextSnapshotTime := parsed.Next(snapshot.Timestamp)
 				if nextSnapshotTime.Before(now) {
 					klog.V(5).Infof("  stale for interval %s", interval)
 					numSnapshotsByInterval[interval]++
@@ -86,6 +223,20 @@ func getSnapshotChanges(schedules []snapshotgroup.SnapshotSchedule, snapshots []
 		}
 	}
 
+	for _, name := range scheduleNames {
+		if numSnapshotsByInterval[name] > 0 {
+			continue
+		}
+		parsed, err := parseSchedule(name, location)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first := getFirstSnapshotTime(parsed, created); first.After(now) {
+			klog.V(5).Infof("  first snapshot for interval %s is due at %v", name, first)
+			needsCreation[name] = false
+		}
+	}
+
 	toCreate := []string{}
 	for k, v := range needsCreation {
 		klog.V(5).Infof("need creation %v %v", k, v)
@@ -97,8 +248,63 @@ func getSnapshotChanges(schedules []snapshotgroup.SnapshotSchedule, snapshots []
 	return toCreate, toDelete, nil
 }
 
-// ParseInterval parses an interval string as defined by gemini
+// getNextSnapshots returns the time each schedule is next due. Schedules that have no snapshots yet are due at
+// getFirstSnapshotTime, and are omitted if that has already passed.
+func getNextSnapshots(schedules []snapshotgroup.SnapshotSchedule, snapshots []*GeminiSnapshot, location *time.Location, created time.Time) ([]snapshotgroup.ScheduledSnapshot, error) {
+	nextSnapshots := []snapshotgroup.ScheduledSnapshot{}
+	for _, schedule := range schedules {
+		name, err := getScheduleName(schedule)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseSchedule(name, location)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, snapshot := range snapshots {
+			if snapshot.Restore != "" || snapshot.Manual != "" || !hasInterval(snapshot, name) {
+				continue
+			}
+			nextSnapshots = append(nextSnapshots, snapshotgroup.ScheduledSnapshot{
+				Interval: name,
+				Time:     metav1.NewTime(parsed.Next(snapshot.Timestamp)),
+			})
+			found = true
+			break
+		}
+		if first := getFirstSnapshotTime(parsed, created); !found && first.After(time.Now()) {
+			nextSnapshots = append(nextSnapshots, snapshotgroup.ScheduledSnapshot{
+				Interval: name,
+				Time:     metav1.NewTime(first),
+			})
+		}
+	}
+	return nextSnapshots, nil
+}
+
+func hasInterval(snapshot *GeminiSnapshot, interval string) bool {
+	for _, i := range snapshot.Intervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseInterval parses an interval string as defined by gemini.
+// Days, weeks, months and years return their nominal length, e.g. 30 days for a month, but snapshots on those
+// schedules are taken once per calendar period, see calendarSchedule.
 func ParseInterval(str string) (time.Duration, error) {
+	amt, unit, err := parseIntervalParts(str)
+	if err != nil {
+		return time.Hour, err
+	}
+	ret := time.Duration(amt) * durations[unit]
+	return ret, nil
+}
+
+func parseIntervalParts(str string) (int, string, error) {
 	amt := 1
 	every := str
 	parts := strings.Split(str, " ")
@@ -107,14 +313,12 @@ func ParseInterval(str string) (time.Duration, error) {
 		var err error
 		amt, err = strconv.Atoi(parts[0])
 		if err != nil {
-			return time.Hour, fmt.Errorf("Could not parse interval %s", str)
+			return 0, "", fmt.Errorf("Could not parse interval %s", str)
 		}
 	}
 	every = strings.TrimSuffix(every, "s")
-	duration, ok := durations[every]
-	if !ok {
-		return time.Hour, fmt.Errorf("Could not find duration for interval %s", str)
+	if _, ok := durations[every]; !ok {
+		return 0, "", fmt.Errorf("Could not find duration for interval %s", str)
 	}
-	ret := time.Duration(amt) * duration
-	return ret, nil
+	return amt, every, nil
 }
@@ -51,13 +51,235 @@ func TestBasicSchedule(t *testing.T) {
 			Timestamp: start,
 		},
 	}
-	toCreate, toDelete, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, existing)
+	toCreate, toDelete, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, existing, time.UTC, time.Time{})
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(toDelete))
 	assert.Equal(t, existing[4], toDelete[0])
 	assert.Equal(t, toCreate, []string{"minute"})
 }
 
+func TestCronSchedule(t *testing.T) {
+	schedule := snapshotgroup.SnapshotSchedule{
+		Cron: "* * * * *",
+		Keep: 1,
+	}
+	start := time.Now().Add(time.Minute * -5)
+
+	existing := []*GeminiSnapshot{
+		&GeminiSnapshot{
+			Intervals: []string{"* * * * *"},
+			Timestamp: start.Add(time.Minute * 2),
+		},
+		&GeminiSnapshot{
+			Intervals: []string{"* * * * *"},
+			Timestamp: start.Add(time.Minute),
+		},
+		&GeminiSnapshot{
+			Intervals: []string{"* * * * *"},
+			Timestamp: start,
+		},
+	}
+	toCreate, toDelete, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, existing, time.UTC, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []*GeminiSnapshot{existing[1], existing[2]}, toDelete)
+	assert.Equal(t, []string{"* * * * *"}, toCreate)
+
+	schedule.Cron = "@yearly"
+	existing = []*GeminiSnapshot{
+		&GeminiSnapshot{
+			Manual:    "now",
+			Timestamp: time.Now(),
+		},
+		&GeminiSnapshot{
+			Intervals: []string{"@yearly"},
+			Timestamp: time.Now(),
+		},
+	}
+	toCreate, toDelete, err = getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, existing, time.UTC, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(toDelete), "manual snapshots are not deleted by the schedule")
+	assert.Equal(t, 0, len(toCreate))
+
+	// The first snapshot waits for the first match after the group was created
+	created := time.Now().Add(-time.Hour)
+	toCreate, _, err = getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, nil, time.UTC, created)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(toCreate))
+	next, err := getNextSnapshots([]snapshotgroup.SnapshotSchedule{schedule}, nil, time.UTC, created)
+	assert.NoError(t, err)
+	assert.Len(t, next, 1)
+	assert.Equal(t, time.Month(1), next[0].Time.Time.Month())
+	assert.Equal(t, 1, next[0].Time.Time.Day())
+
+	schedule.Cron = "* * * * *"
+	toCreate, _, err = getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, nil, time.UTC, created)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"* * * * *"}, toCreate, "the first match has passed")
+	toCreate, _, err = getSnapshotChanges([]snapshotgroup.SnapshotSchedule{{Every: "day", Keep: 1}}, nil, time.UTC, created)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"day"}, toCreate, "intervals are due immediately")
+}
+
+func TestCalendarSchedule(t *testing.T) {
+	testCases := []struct {
+		interval string
+		last     time.Time
+		next     time.Time
+	}{
+		{
+			interval: "month",
+			last:     time.Date(2020, time.January, 31, 23, 0, 0, 0, time.UTC),
+			next:     time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			interval: "month",
+			last:     time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+			next:     time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			interval: "3 months",
+			last:     time.Date(2020, time.November, 15, 0, 0, 0, 0, time.UTC),
+			next:     time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			interval: "year",
+			last:     time.Date(2020, time.February, 29, 12, 0, 0, 0, time.UTC),
+			next:     time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			interval: "2 years",
+			last:     time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+			next:     time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, testCase := range testCases {
+		schedule, err := parseSchedule(testCase.interval, time.UTC)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.next, schedule.Next(testCase.last), testCase.interval)
+	}
+
+	now := time.Now().UTC()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	existing := []*GeminiSnapshot{
+		&GeminiSnapshot{
+			Intervals: []string{"month"},
+			Timestamp: startOfMonth,
+		},
+		&GeminiSnapshot{
+			Intervals: []string{"month"},
+			Timestamp: startOfMonth.AddDate(0, -1, 0),
+		},
+		&GeminiSnapshot{
+			Intervals: []string{"month"},
+			Timestamp: startOfMonth.AddDate(0, -2, 0),
+		},
+	}
+	schedule := snapshotgroup.SnapshotSchedule{
+		Every: "month",
+		Keep:  1,
+	}
+	toCreate, toDelete, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, existing, time.UTC, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(toCreate))
+	assert.Equal(t, []*GeminiSnapshot{existing[2]}, toDelete)
+}
+
+func TestTimeZoneSchedule(t *testing.T) {
+	eastern, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	testCases := []struct {
+		interval string
+		last     time.Time
+		next     time.Time
+	}{
+		{
+			// The day before DST starts is 23 hours long
+			interval: "day",
+			last:     time.Date(2021, time.March, 13, 10, 0, 0, 0, eastern),
+			next:     time.Date(2021, time.March, 14, 0, 0, 0, 0, eastern),
+		},
+		{
+			interval: "day",
+			last:     time.Date(2021, time.March, 14, 10, 0, 0, 0, eastern),
+			next:     time.Date(2021, time.March, 15, 0, 0, 0, 0, eastern),
+		},
+		{
+			// Midnight Eastern is still the previous day in UTC
+			interval: "day",
+			last:     time.Date(2021, time.March, 16, 2, 0, 0, 0, time.UTC),
+			next:     time.Date(2021, time.March, 16, 0, 0, 0, 0, eastern),
+		},
+		{
+			interval: "week",
+			last:     time.Date(2021, time.March, 10, 10, 0, 0, 0, eastern),
+			next:     time.Date(2021, time.March, 15, 0, 0, 0, 0, eastern),
+		},
+		{
+			interval: "2 weeks",
+			last:     time.Date(2021, time.March, 15, 0, 0, 0, 0, eastern),
+			next:     time.Date(2021, time.March, 29, 0, 0, 0, 0, eastern),
+		},
+		{
+			interval: "month",
+			last:     time.Date(2021, time.March, 1, 3, 0, 0, 0, time.UTC),
+			next:     time.Date(2021, time.March, 1, 0, 0, 0, 0, eastern),
+		},
+		{
+			// DST ends on 11/7/2021
+			interval: "0 2 * * *",
+			last:     time.Date(2021, time.November, 6, 3, 0, 0, 0, eastern),
+			next:     time.Date(2021, time.November, 7, 2, 0, 0, 0, eastern),
+		},
+		{
+			interval: "hour",
+			last:     time.Date(2021, time.November, 7, 1, 30, 0, 0, eastern),
+			next:     time.Date(2021, time.November, 7, 1, 30, 0, 0, eastern).Add(time.Hour),
+		},
+	}
+	for _, testCase := range testCases {
+		schedule, err := parseSchedule(testCase.interval, eastern)
+		assert.NoError(t, err)
+		assert.True(t, testCase.next.Equal(schedule.Next(testCase.last)), "%s: expected %v, got %v", testCase.interval, testCase.next, schedule.Next(testCase.last))
+	}
+
+	sg := &snapshotgroup.SnapshotGroup{}
+	location, err := getLocation(sg)
+	assert.NoError(t, err)
+	assert.Nil(t, location)
+	// Without a time zone, days and weeks are fixed durations, as they were before time zones were supported
+	last := time.Date(2021, time.March, 13, 10, 0, 0, 0, time.UTC)
+	for interval, next := range map[string]time.Time{
+		"day":       last.Add(24 * time.Hour),
+		"week":      last.Add(7 * 24 * time.Hour),
+		"month":     time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC),
+		"0 2 * * *": time.Date(2021, time.March, 14, 2, 0, 0, 0, time.UTC),
+	} {
+		schedule, err := parseSchedule(interval, location)
+		assert.NoError(t, err)
+		assert.Equal(t, next, schedule.Next(last), interval)
+	}
+	sg.Spec.TimeZone = "US/Eastern"
+	location, err = getLocation(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, "US/Eastern", location.String())
+	sg.Spec.TimeZone = "Mars/Olympus_Mons"
+	_, err = getLocation(sg)
+	assert.Error(t, err)
+}
+
+func TestInvalidSchedule(t *testing.T) {
+	testCases := []snapshotgroup.SnapshotSchedule{
+		{Keep: 1},
+		{Every: "hour", Cron: "@hourly", Keep: 1},
+		{Cron: "61 * * * *", Keep: 1},
+		{Every: "fortnight", Keep: 1},
+	}
+	for _, schedule := range testCases {
+		_, _, err := getSnapshotChanges([]snapshotgroup.SnapshotSchedule{schedule}, nil, time.UTC, time.Time{})
+		assert.Error(t, err)
+	}
+}
+
 func TestParseInterval(t *testing.T) {
 	testCases := []struct {
 		input  string
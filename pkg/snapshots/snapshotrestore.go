@@ -0,0 +1,446 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// restorePollInterval is how often a SnapshotRestore is reconciled while it waits for a snapshot or PVC
+const restorePollInterval = 5 * time.Second
+
+// isRestoreFinished returns true if the SnapshotRestore has completed or failed, and will not be reconciled again
+func isRestoreFinished(sr *snapshotgroup.SnapshotRestore) bool {
+	return sr.Status.Phase == snapshotgroup.RestorePhaseCompleted || sr.Status.Phase == snapshotgroup.RestorePhaseFailed
+}
+
+// isQuiescingPhase returns true if workloads using the PVC may have been scaled down in this phase of a Replace restore
+func isQuiescingPhase(phase string) bool {
+	return phase == snapshotgroup.RestorePhaseFailsafeSnapshotting || phase == snapshotgroup.RestorePhaseDeletingPVC || phase == snapshotgroup.RestorePhaseRestoring
+}
+
+// getRestoreStrategy returns the strategy of the SnapshotRestore, defaulting to Replace
+func getRestoreStrategy(sr *snapshotgroup.SnapshotRestore) (string, error) {
+	switch sr.Spec.Strategy {
+	case "", snapshotgroup.RestoreStrategyReplace:
+		return snapshotgroup.RestoreStrategyReplace, nil
+	case snapshotgroup.RestoreStrategyNewPVC:
+		return snapshotgroup.RestoreStrategyNewPVC, nil
+	}
+	return "", fmt.Errorf("unknown restore strategy %q", sr.Spec.Strategy)
+}
+
+// ReconcileSnapshotRestore moves a SnapshotRestore through its phases, until it has to wait for a snapshot or PVC.
+// It returns how long to wait before reconciling it again, which is zero once the restore has finished.
+func ReconcileSnapshotRestore(sr *snapshotgroup.SnapshotRestore, failsafeTimeoutSeconds int, recorder record.EventRecorder) (time.Duration, error) {
+	client := kube.GetClient()
+	latest, err := client.SnapshotGroupClient.SnapshotRestores(sr.ObjectMeta.Namespace).Get(context.TODO(), sr.ObjectMeta.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		klog.V(5).Infof("%s/%s: skipping deleted SnapshotRestore", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	sr = latest.DeepCopy()
+	for !isRestoreFinished(sr) {
+		phase := sr.Status.Phase
+		requeue, err := advanceRestore(sr, time.Duration(failsafeTimeoutSeconds)*time.Second, recorder)
+		if err != nil || requeue > 0 {
+			return requeue, err
+		}
+		if sr.Status.Phase == phase {
+			return 0, fmt.Errorf("%s/%s: SnapshotRestore is stuck in phase %s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, phase)
+		}
+	}
+	return 0, nil
+}
+
+// advanceRestore performs the work of the current phase. Errors from the restore itself move it to the Failed phase,
+// while errors updating the SnapshotRestore are returned so that it is retried.
+func advanceRestore(sr *snapshotgroup.SnapshotRestore, failsafeTimeout time.Duration, recorder record.EventRecorder) (time.Duration, error) {
+	if sr.Status.Phase == "" {
+		now := metav1.Now()
+		return 0, setRestorePhase(sr, snapshotgroup.RestorePhasePending, "Restore requested", func(status *snapshotgroup.SnapshotRestoreStatus) {
+			status.StartTime = &now
+		})
+	}
+
+	strategy, err := getRestoreStrategy(sr)
+	if err != nil {
+		return 0, failRestore(sr, nil, recorder, err)
+	}
+	client := kube.GetClient()
+	sg, err := client.SnapshotGroupClient.SnapshotGroups(sr.ObjectMeta.Namespace).Get(context.TODO(), sr.Spec.SnapshotGroup, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return 0, failRestore(sr, nil, recorder, fmt.Errorf("SnapshotGroup %s not found", sr.Spec.SnapshotGroup))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	switch sr.Status.Phase {
+	case snapshotgroup.RestorePhasePending:
+		return startRestore(sr, sg, strategy, recorder)
+	case snapshotgroup.RestorePhaseFailsafeSnapshotting:
+		return takeFailsafeSnapshot(sr, sg, failsafeTimeout, recorder)
+	case snapshotgroup.RestorePhaseDeletingPVC:
+		return deletePVCForRestore(sr, sg)
+	case snapshotgroup.RestorePhaseRestoring:
+		return 0, createPVCForRestore(sr, sg, strategy, recorder)
+	}
+	return 0, failRestore(sr, sg, recorder, fmt.Errorf("unknown phase %q", sr.Status.Phase))
+}
+
+// startRestore resolves the snapshot to restore, and waits for any earlier restore replacing the same PVC
+func startRestore(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup, strategy string, recorder record.EventRecorder) (time.Duration, error) {
+	if HasMultipleClaims(sg) {
+		return 0, failRestore(sr, sg, recorder, errMultipleClaimsRestore)
+	}
+	target := ""
+	if strategy == snapshotgroup.RestoreStrategyNewPVC {
+		if sr.Spec.Target == "" {
+			return 0, failRestore(sr, sg, recorder, fmt.Errorf("a target is required for the %s strategy", strategy))
+		}
+		namespace, name, err := parseRestoreTarget(sg, sr.Spec.Target)
+		if err != nil {
+			return 0, failRestore(sr, sg, recorder, err)
+		}
+		target = namespace + "/" + name
+	}
+	snapshot, restorePoint, err := resolveRestoreSnapshot(sr, sg)
+	if err != nil {
+		return 0, failRestore(sr, sg, recorder, err)
+	}
+
+	next := snapshotgroup.RestorePhaseRestoring
+	if strategy == snapshotgroup.RestoreStrategyReplace {
+		first, err := getFirstReplacingRestore(sg)
+		if err != nil {
+			return 0, err
+		}
+		if first != nil && first.ObjectMeta.Name != sr.ObjectMeta.Name {
+			klog.V(3).Infof("%s/%s: waiting for SnapshotRestore %s to finish", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, first.ObjectMeta.Name)
+			return restorePollInterval, nil
+		}
+		next = snapshotgroup.RestorePhaseFailsafeSnapshotting
+		target = sg.ObjectMeta.Namespace + "/" + GetPVCName(sg)
+	}
+	recordRestoreEvent(recorder, sr, sg, corev1.EventTypeNormal, ReasonRestoreStarted, "Restoring %s into PVC %s", snapshot.Name, target)
+	return 0, setRestorePhase(sr, next, fmt.Sprintf("Restoring %s into PVC %s", snapshot.Name, target), func(status *snapshotgroup.SnapshotRestoreStatus) {
+		status.Snapshot = snapshot.Name
+		status.RestorePoint = restorePoint
+		status.PersistentVolumeClaim = target
+	})
+}
+
+// resolveRestoreSnapshot returns the snapshot selected by the SnapshotRestore and its restore point,
+// defaulting to the newest backup that is ready to use. Failsafe snapshots taken by earlier restores are only
+// restored if they are selected
+func resolveRestoreSnapshot(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup) (*GeminiSnapshot, string, error) {
+	prefix := sg.ObjectMeta.Name + "-"
+	name := sr.Spec.Snapshot.Name
+	if sr.Spec.Snapshot.RestorePoint != "" {
+		if name != "" && name != prefix+sr.Spec.Snapshot.RestorePoint {
+			return nil, "", fmt.Errorf("snapshot %s does not match restore point %s", name, sr.Spec.Snapshot.RestorePoint)
+		}
+		name = prefix + sr.Spec.Snapshot.RestorePoint
+	}
+	if name != "" {
+		snapshot, err := GetSnapshot(sr.ObjectMeta.Namespace, name)
+		if errors.IsNotFound(err) {
+			return nil, "", fmt.Errorf("snapshot %s not found", name)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(name, prefix) || GetSnapshotGroupName(snapshot.VolumeSnapshot) != sg.ObjectMeta.Name {
+			return nil, "", fmt.Errorf("snapshot %s does not belong to SnapshotGroup %s", name, sg.ObjectMeta.Name)
+		}
+		return snapshot, strings.TrimPrefix(name, prefix), nil
+	}
+	snapshots, err := ListSnapshots(sg)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Restore != "" {
+			continue
+		}
+		if getSnapshotStatus(snapshot).ReadyToUse && strings.HasPrefix(snapshot.Name, prefix) {
+			return snapshot, strings.TrimPrefix(snapshot.Name, prefix), nil
+		}
+	}
+	return nil, "", fmt.Errorf("SnapshotGroup %s has no backups that are ready to use", sg.ObjectMeta.Name)
+}
+
+// takeFailsafeSnapshot snapshots the PVC before it is replaced, and waits for the snapshot to be ready to use.
+// If it is not ready in time, the restore proceeds anyway.
+func takeFailsafeSnapshot(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup, failsafeTimeout time.Duration, recorder record.EventRecorder) (time.Duration, error) {
+	if sr.Status.FailsafeSnapshot == "" {
+		// Scale down anything using the PVC first, so that the failsafe snapshot is consistent
+		if err := quiesceWorkloads(sg, recorder); err != nil {
+			return 0, failRestore(sr, sg, recorder, fmt.Errorf("could not scale down workloads: %w", err))
+		}
+		pods, err := getMountingPods(sg)
+		if err != nil {
+			return 0, err
+		}
+		if len(pods) > 0 {
+			if time.Since(getPhaseStartTime(sr)) > quiesceTimeout {
+				return 0, failRestore(sr, sg, recorder, fmt.Errorf("%d pods using PVC %s did not terminate after %s", len(pods), GetPVCName(sg), quiesceTimeout))
+			}
+			klog.V(5).Infof("%s/%s: waiting for %d pods using PVC %s to terminate", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, len(pods), GetPVCName(sg))
+			return restorePollInterval, nil
+		}
+		if _, err := getPVC(sg); errors.IsNotFound(err) {
+			return 0, setRestorePhase(sr, snapshotgroup.RestorePhaseDeletingPVC, fmt.Sprintf("PVC %s not found, skipping failsafe snapshot", GetPVCName(sg)), nil)
+		}
+		klog.V(5).Infof("%s/%s: creating failsafe snapshot of PVC %s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, GetPVCName(sg))
+		snapshot, err := createSnapshot(sg, map[string]string{
+			RestoreAnnotation: sr.Status.RestorePoint,
+		})
+		if err != nil {
+			return 0, failRestore(sr, sg, recorder, fmt.Errorf("could not create failsafe snapshot: %w", err))
+		}
+		err = updateRestoreStatus(sr, func(status *snapshotgroup.SnapshotRestoreStatus) {
+			status.FailsafeSnapshot = snapshot.Name
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	snapshot, err := GetSnapshot(sr.ObjectMeta.Namespace, sr.Status.FailsafeSnapshot)
+	if err != nil && !errors.IsNotFound(err) {
+		return 0, err
+	}
+	if err == nil && getSnapshotStatus(snapshot).ReadyToUse {
+		return 0, setRestorePhase(sr, snapshotgroup.RestorePhaseDeletingPVC, fmt.Sprintf("Failsafe snapshot %s is ready", sr.Status.FailsafeSnapshot), nil)
+	}
+	if waited := time.Since(getPhaseStartTime(sr)); waited < failsafeTimeout {
+		klog.V(5).Infof("%s/%s: waiting for failsafe snapshot %s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, sr.Status.FailsafeSnapshot)
+		return restorePollInterval, nil
+	}
+	klog.Warningf("%s/%s: failsafe snapshot %s was not ready, proceeding with restore anyway", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, sr.Status.FailsafeSnapshot)
+	message := fmt.Sprintf("Failsafe snapshot %s was not ready after %s, proceeding with restore anyway", sr.Status.FailsafeSnapshot, failsafeTimeout)
+	recordRestoreEvent(recorder, sr, sg, corev1.EventTypeWarning, ReasonFailsafeSnapshotTimedOut, "%s", message)
+	return 0, setRestorePhase(sr, snapshotgroup.RestorePhaseDeletingPVC, message, nil)
+}
+
+// deletePVCForRestore deletes the PVC of the SnapshotGroup, and waits for it to be gone
+func deletePVCForRestore(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup) (time.Duration, error) {
+	pvc, err := getPVC(sg)
+	if errors.IsNotFound(err) {
+		return 0, setRestorePhase(sr, snapshotgroup.RestorePhaseRestoring, fmt.Sprintf("Deleted PVC %s", GetPVCName(sg)), nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if pvc.ObjectMeta.DeletionTimestamp == nil {
+		if err := deletePVC(sg); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	klog.V(5).Infof("%s/%s: waiting for PVC %s to be deleted", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, pvc.ObjectMeta.Name)
+	return restorePollInterval, nil
+}
+
+// createPVCForRestore creates the restored PVC and completes the restore
+func createPVCForRestore(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup, strategy string, recorder record.EventRecorder) error {
+	var pvc *corev1.PersistentVolumeClaim
+	var err error
+	if strategy == snapshotgroup.RestoreStrategyNewPVC {
+		pvc, err = createRestoredPVC(sg, sr.Status.RestorePoint, sr.Spec.Target)
+	} else {
+		pvc, err = createPVCFromSnapshot(sg, sr.Status.RestorePoint)
+		if errors.IsAlreadyExists(err) {
+			pvc, err = getPVC(sg)
+			if err == nil && pvc.ObjectMeta.Annotations[RestoreAnnotation] != sr.Status.RestorePoint {
+				err = fmt.Errorf("PVC %s was recreated before it could be restored", pvc.ObjectMeta.Name)
+			}
+		}
+	}
+	if err != nil {
+		return failRestore(sr, sg, recorder, err)
+	}
+	klog.V(3).Infof("%s/%s: restored %s into PVC %s/%s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, sr.Status.Snapshot, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+	if strategy == snapshotgroup.RestoreStrategyReplace {
+		if err := resumeWorkloads(sg, recorder); err != nil {
+			return err
+		}
+	}
+	metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "success").Inc()
+	recordRestoreEvent(recorder, sr, sg, corev1.EventTypeNormal, ReasonRestoreCompleted, "Restored %s into PVC %s/%s", sr.Status.Snapshot, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+	now := metav1.Now()
+	return setRestorePhase(sr, snapshotgroup.RestorePhaseCompleted, fmt.Sprintf("Restored %s into PVC %s/%s", sr.Status.Snapshot, pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name), func(status *snapshotgroup.SnapshotRestoreStatus) {
+		status.PersistentVolumeClaim = pvc.ObjectMeta.Namespace + "/" + pvc.ObjectMeta.Name
+		status.CompletionTime = &now
+	})
+}
+
+// failRestore moves the SnapshotRestore to the Failed phase. sg is nil if the SnapshotGroup could not be found
+func failRestore(sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup, recorder record.EventRecorder, restoreErr error) error {
+	klog.Warningf("%s/%s: restore failed - %v", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, restoreErr)
+	if sg != nil {
+		metrics.Restores.WithLabelValues(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, "failure").Inc()
+	}
+	recordRestoreEvent(recorder, sr, sg, corev1.EventTypeWarning, ReasonRestoreFailed, "Restore failed: %v", restoreErr)
+	if sg != nil && isQuiescingPhase(sr.Status.Phase) {
+		resumeWorkloadsIfPVCExists(sg, recorder)
+	}
+	now := metav1.Now()
+	return setRestorePhase(sr, snapshotgroup.RestorePhaseFailed, restoreErr.Error(), func(status *snapshotgroup.SnapshotRestoreStatus) {
+		status.CompletionTime = &now
+	})
+}
+
+// setRestorePhase moves the SnapshotRestore to a new phase, recording the transition in its history
+func setRestorePhase(sr *snapshotgroup.SnapshotRestore, phase, message string, mutate func(*snapshotgroup.SnapshotRestoreStatus)) error {
+	klog.V(3).Infof("%s/%s: restore is %s - %s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, phase, message)
+	now := metav1.Now()
+	return updateRestoreStatus(sr, func(status *snapshotgroup.SnapshotRestoreStatus) {
+		if mutate != nil {
+			mutate(status)
+		}
+		status.Phase = phase
+		status.Message = message
+		status.History = append(status.History, snapshotgroup.SnapshotRestoreTransition{
+			Phase:   phase,
+			Time:    now,
+			Message: message,
+		})
+	})
+}
+
+// updateRestoreStatus applies mutate to the latest status of the SnapshotRestore, and writes it if anything changed.
+// sr is updated with the result.
+func updateRestoreStatus(sr *snapshotgroup.SnapshotRestore, mutate func(*snapshotgroup.SnapshotRestoreStatus)) error {
+	client := kube.GetClient()
+	srClient := client.SnapshotGroupClient.SnapshotRestores(sr.ObjectMeta.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := srClient.Get(context.TODO(), sr.ObjectMeta.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if isRestoreFinished(latest) {
+			return fmt.Errorf("%s/%s: SnapshotRestore already %s", sr.ObjectMeta.Namespace, sr.ObjectMeta.Name, latest.Status.Phase)
+		}
+		status := latest.Status.DeepCopy()
+		mutate(status)
+		if equality.Semantic.DeepEqual(*status, latest.Status) {
+			sr.Status = *status
+			return nil
+		}
+		latest.Status = *status
+		updated, err := srClient.UpdateStatus(context.TODO(), latest, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		sr.Status = updated.Status
+		return nil
+	})
+}
+
+// getPhaseStartTime returns when the SnapshotRestore entered its current phase
+func getPhaseStartTime(sr *snapshotgroup.SnapshotRestore) time.Time {
+	for idx := len(sr.Status.History) - 1; idx >= 0; idx-- {
+		if sr.Status.History[idx].Phase == sr.Status.Phase {
+			return sr.Status.History[idx].Time.Time
+		}
+	}
+	return time.Now()
+}
+
+// getFirstReplacingRestore returns the oldest unfinished SnapshotRestore that replaces the PVC of the SnapshotGroup.
+// Only this one is allowed to proceed, so that restores of the same PVC run one at a time, in the order they were created.
+func getFirstReplacingRestore(sg *snapshotgroup.SnapshotGroup) (*snapshotgroup.SnapshotRestore, error) {
+	restores, err := kube.GetClient().ListSnapshotRestores(sg.ObjectMeta.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	replacing := []*snapshotgroup.SnapshotRestore{}
+	for _, sr := range restores {
+		strategy, err := getRestoreStrategy(sr)
+		if err != nil || strategy != snapshotgroup.RestoreStrategyReplace || sr.Spec.SnapshotGroup != sg.ObjectMeta.Name || isRestoreFinished(sr) {
+			continue
+		}
+		replacing = append(replacing, sr)
+	}
+	if len(replacing) == 0 {
+		return nil, nil
+	}
+	sort.Slice(replacing, func(i, j int) bool {
+		left, right := replacing[i].ObjectMeta.CreationTimestamp, replacing[j].ObjectMeta.CreationTimestamp
+		if !left.Equal(&right) {
+			return left.Before(&right)
+		}
+		return replacing[i].ObjectMeta.Name < replacing[j].ObjectMeta.Name
+	})
+	return replacing[0], nil
+}
+
+// getReplacingRestore returns the name of a SnapshotRestore that has deleted, or is about to delete,
+// the PVC of the SnapshotGroup, or an empty string if there is none. The phase of each SnapshotRestore is read from
+// the API rather than the cache, which may not have seen it change yet
+func getReplacingRestore(sg *snapshotgroup.SnapshotGroup) (string, error) {
+	client := kube.GetClient()
+	restores, err := client.ListSnapshotRestores(sg.ObjectMeta.Namespace)
+	if err != nil {
+		return "", err
+	}
+	for _, cached := range restores {
+		if cached.Spec.SnapshotGroup != sg.ObjectMeta.Name {
+			continue
+		}
+		sr, err := client.SnapshotGroupClient.SnapshotRestores(sg.ObjectMeta.Namespace).Get(context.TODO(), cached.ObjectMeta.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if strategy, err := getRestoreStrategy(sr); err != nil || strategy != snapshotgroup.RestoreStrategyReplace {
+			continue
+		}
+		if sr.Status.Phase == snapshotgroup.RestorePhaseDeletingPVC || sr.Status.Phase == snapshotgroup.RestorePhaseRestoring {
+			return sr.ObjectMeta.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// recordRestoreEvent records an event on the SnapshotRestore, and on the SnapshotGroup if it exists
+func recordRestoreEvent(recorder record.EventRecorder, sr *snapshotgroup.SnapshotRestore, sg *snapshotgroup.SnapshotGroup, eventType, reason, messageFmt string, args ...interface{}) {
+	recorder.Eventf(sr, eventType, reason, messageFmt, args...)
+	if sg != nil {
+		recorder.Eventf(sg, eventType, reason, "SnapshotRestore %s: "+messageFmt, append([]interface{}{sr.ObjectMeta.Name}, args...)...)
+	}
+}
@@ -21,15 +21,22 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fairwindsops/gemini/pkg/kube"
 	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
 
 	snapshotsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -40,30 +47,77 @@ type GeminiSnapshot struct {
 	Intervals      []string
 	Timestamp      time.Time
 	Restore        string
+	Manual         string
+	Set            string
+	Claim          string
+	GroupSnapshot  string
+	Hooks          []snapshotgroup.HookResult
 	VolumeSnapshot *snapshotsv1.VolumeSnapshot
 }
 
-// ListSnapshots returns all snapshots associated with a particular SnapshotGroup
+func init() {
+	kube.AddSnapshotIndexers(cache.Indexers{
+		snapshotGroupIndex: indexBySnapshotGroup,
+		snapshotCopyIndex:  indexBySnapshotCopy,
+		groupSnapshotIndex: indexByGroupSnapshot,
+	})
+}
+
+// indexBySnapshotGroup indexes VolumeSnapshots managed by Gemini by namespace and SnapshotGroup name
+func indexBySnapshotGroup(obj interface{}) ([]string, error) {
+	snapshotMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	group := GetSnapshotGroupName(snapshotMeta)
+	if group == "" {
+		return nil, nil
+	}
+	return []string{getSnapshotGroupKey(snapshotMeta.GetNamespace(), group)}, nil
+}
+
+func getSnapshotGroupKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// GetSnapshotGroupName returns the name of the SnapshotGroup a VolumeSnapshot belongs to, or an empty string if
+// it is not managed by Gemini. VolumeSnapshots created by older versions of Gemini only have annotations
+func GetSnapshotGroupName(snapshotMeta metav1.Object) string {
+	annotations := snapshotMeta.GetAnnotations()
+	if annotations[managedByAnnotation] != managerName {
+		return ""
+	}
+	return annotations[GroupNameAnnotation]
+}
+
+// getSnapshotLabels returns the labels to set on VolumeSnapshots belonging to sg
+func getSnapshotLabels(sg *snapshotgroup.SnapshotGroup) map[string]string {
+	snapshotLabels := map[string]string{
+		managedByLabel: managerName,
+	}
+	if len(validation.IsValidLabelValue(sg.ObjectMeta.Name)) == 0 {
+		snapshotLabels[GroupNameLabel] = sg.ObjectMeta.Name
+	}
+	return snapshotLabels
+}
+
+// ListSnapshots returns all snapshots associated with a particular SnapshotGroup.
+// They are read from the VolumeSnapshot informer, or from the API if it is not up to date, see listSnapshotObjects.
 func ListSnapshots(sg *snapshotgroup.SnapshotGroup) ([]*GeminiSnapshot, error) {
-	client := kube.GetClient()
-	snapshots, err := client.SnapshotClient.Namespace(sg.ObjectMeta.Namespace).List(context.TODO(), metav1.ListOptions{})
+	snapshots, err := listSnapshotObjects(sg)
 	if err != nil {
 		return nil, err
 	}
 	geminiSnapshots := []*GeminiSnapshot{}
-	for _, snapshotUnst := range snapshots.Items {
-		snapshotMeta, err := meta.Accessor(&snapshotUnst)
+	for _, snapshotUnst := range snapshots {
+		snapshotMeta, err := meta.Accessor(snapshotUnst)
 		if err != nil {
 			return nil, err
 		}
-		annotations := snapshotMeta.GetAnnotations()
-		if managedBy, ok := annotations[managedByAnnotation]; !ok || managedBy != managerName {
-			continue
-		}
-		if annotations[GroupNameAnnotation] != sg.ObjectMeta.Name {
+		if GetSnapshotGroupName(snapshotMeta) != sg.ObjectMeta.Name || !isOwnedBy(snapshotMeta, sg) {
 			continue
 		}
-		snapshot, err := parseSnapshot(&snapshotUnst)
+		snapshot, err := parseSnapshot(snapshotUnst)
 		if err != nil {
 			return nil, err
 		}
@@ -75,6 +129,205 @@ func ListSnapshots(sg *snapshotgroup.SnapshotGroup) ([]*GeminiSnapshot, error) {
 	return geminiSnapshots, nil
 }
 
+// listSnapshotObjects returns the VolumeSnapshots in the namespace of sg that may belong to it. They are read from the
+// informer cache, unless it hasn't synced or hasn't seen the changes the last reconcile of sg made yet
+func listSnapshotObjects(sg *snapshotgroup.SnapshotGroup) ([]*unstructured.Unstructured, error) {
+	client := kube.GetClient()
+	key := getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	informer := client.GetSnapshotInformer(sg.ObjectMeta.Namespace)
+	if informer != nil && informer.HasSynced() && isSnapshotCacheCurrent(key, informer.GetIndexer()) {
+		objs, err := informer.GetIndexer().ByIndex(snapshotGroupIndex, key)
+		if err != nil {
+			return nil, err
+		}
+		snapshots := []*unstructured.Unstructured{}
+		for _, obj := range objs {
+			if snapshotUnst, ok := obj.(*unstructured.Unstructured); ok {
+				snapshots = append(snapshots, snapshotUnst)
+			}
+		}
+		return snapshots, nil
+	}
+
+	klog.V(5).Infof("%s/%s: VolumeSnapshot cache is not up to date, listing snapshots from the API", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+	listOptions := metav1.ListOptions{}
+	snapshotLabels := getSnapshotLabels(sg)
+	// VolumeSnapshots created by older versions of Gemini aren't labelled, so the whole namespace is listed until
+	// updateSnapshotMetadata has labelled them
+	if _, labelled := labelledSnapshotGroups.Load(key); labelled && snapshotLabels[GroupNameLabel] != "" {
+		listOptions.LabelSelector = labels.SelectorFromSet(snapshotLabels).String()
+	}
+	list, err := client.SnapshotClient.Namespace(sg.ObjectMeta.Namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []*unstructured.Unstructured{}
+	for i := range list.Items {
+		snapshots = append(snapshots, &list.Items[i])
+	}
+	return snapshots, nil
+}
+
+// snapshotChangesTimeout is how long the VolumeSnapshot cache has to catch up with the changes made by a reconcile,
+// after which they are forgotten, in case a created snapshot was deleted before the cache saw it
+const snapshotChangesTimeout = time.Minute
+
+// snapshotChanges are the VolumeSnapshots created and deleted by the last reconcile of a SnapshotGroup
+type snapshotChanges struct {
+	created []string
+	deleted []string
+	time    time.Time
+}
+
+// pendingSnapshotChanges holds the snapshotChanges that the VolumeSnapshot cache hasn't seen yet, by SnapshotGroup key
+var pendingSnapshotChanges sync.Map
+
+// expectSnapshotChanges records the VolumeSnapshots that a reconcile created and deleted, so that snapshots are
+// listed from the API until the cache has seen them, rather than acting on stale data
+func expectSnapshotChanges(sg *snapshotgroup.SnapshotGroup, created, deleted []*GeminiSnapshot) {
+	if len(created) == 0 && len(deleted) == 0 {
+		return
+	}
+	changes := snapshotChanges{time: time.Now()}
+	for _, snapshot := range created {
+		changes.created = append(changes.created, snapshot.Namespace+"/"+snapshot.Name)
+	}
+	for _, snapshot := range deleted {
+		changes.deleted = append(changes.deleted, snapshot.Namespace+"/"+snapshot.Name)
+	}
+	pendingSnapshotChanges.Store(getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name), changes)
+}
+
+// isSnapshotCacheCurrent returns true if the VolumeSnapshot cache has seen the changes made by the last reconcile
+// of the SnapshotGroup
+func isSnapshotCacheCurrent(key string, indexer cache.Indexer) bool {
+	value, ok := pendingSnapshotChanges.Load(key)
+	if !ok {
+		return true
+	}
+	changes := value.(snapshotChanges)
+	if time.Since(changes.time) > snapshotChangesTimeout {
+		klog.Warningf("%s: VolumeSnapshot cache did not catch up after %s", key, snapshotChangesTimeout)
+		pendingSnapshotChanges.Delete(key)
+		return true
+	}
+	for _, name := range changes.created {
+		if _, exists, _ := indexer.GetByKey(name); !exists {
+			return false
+		}
+	}
+	for _, name := range changes.deleted {
+		if _, exists, _ := indexer.GetByKey(name); exists {
+			return false
+		}
+	}
+	pendingSnapshotChanges.Delete(key)
+	return true
+}
+
+// labelledSnapshotGroups holds the keys of the SnapshotGroups whose VolumeSnapshots all have the labels to select them by
+var labelledSnapshotGroups sync.Map
+
+// applySnapshotChanges returns snapshots without the deleted ones and with the created ones, newest first, so that
+// the status of a SnapshotGroup can be updated without listing its snapshots again
+func applySnapshotChanges(snapshots, created, deleted []*GeminiSnapshot) []*GeminiSnapshot {
+	isDeleted := map[string]bool{}
+	for _, snapshot := range deleted {
+		isDeleted[snapshot.Namespace+"/"+snapshot.Name] = true
+	}
+	current := []*GeminiSnapshot{}
+	for _, snapshot := range snapshots {
+		if !isDeleted[snapshot.Namespace+"/"+snapshot.Name] {
+			current = append(current, snapshot)
+		}
+	}
+	current = append(current, created...)
+	sort.SliceStable(current, func(i, j int) bool {
+		return current[j].Timestamp.Before(current[i].Timestamp)
+	})
+	return current
+}
+
+// updateSnapshotMetadata adds labels and the group UID to VolumeSnapshots created by older versions of Gemini, which
+// didn't have them, and adds or removes owner references when the deletion policy changes
+func updateSnapshotMetadata(sg *snapshotgroup.SnapshotGroup, snapshots []*GeminiSnapshot) error {
+	client := kube.GetClient()
+	expected := getSnapshotLabels(sg)
+	for _, snapshot := range snapshots {
+		if snapshot.VolumeSnapshot == nil {
+			continue
+		}
+		metadata := map[string]interface{}{}
+		missing := map[string]string{}
+		for key, value := range expected {
+			if snapshot.VolumeSnapshot.ObjectMeta.Labels[key] != value {
+				missing[key] = value
+			}
+		}
+		if len(missing) > 0 {
+			metadata["labels"] = missing
+		}
+		if sg.ObjectMeta.UID != "" && snapshot.VolumeSnapshot.ObjectMeta.Annotations[GroupUIDAnnotation] == "" {
+			metadata["annotations"] = map[string]string{GroupUIDAnnotation: string(sg.ObjectMeta.UID)}
+		}
+		// VolumeSnapshots created by a VolumeGroupSnapshot are already controlled by it
+		if refs, changed := syncOwnerReferences(sg, snapshot.VolumeSnapshot.ObjectMeta.OwnerReferences); changed && snapshot.GroupSnapshot == "" {
+			metadata["ownerReferences"] = refs
+		}
+		if len(metadata) == 0 {
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": metadata,
+		})
+		if err != nil {
+			return err
+		}
+		klog.V(3).Infof("%s/%s: updating metadata of snapshot %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, snapshot.Name)
+		snapClient := client.SnapshotClient.Namespace(snapshot.Namespace)
+		if _, err := snapClient.Patch(context.TODO(), snapshot.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+	}
+	labelledSnapshotGroups.Store(getSnapshotGroupKey(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name), true)
+	return nil
+}
+
+// getSnapshotError returns the error the CSI driver reported for a VolumeSnapshot, or an empty string
+func getSnapshotError(snapshot *GeminiSnapshot) string {
+	vs := snapshot.VolumeSnapshot
+	if vs == nil || vs.Status == nil || vs.Status.Error == nil || vs.Status.Error.Message == nil {
+		return ""
+	}
+	return *vs.Status.Error.Message
+}
+
+// reportSnapshotErrors records a Warning Event for each VolumeSnapshot with an error. The error is recorded in an
+// annotation on the VolumeSnapshot first, so that it's only reported once, even if the controller restarts
+func reportSnapshotErrors(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim, snapshots []*GeminiSnapshot, recorder record.EventRecorder) error {
+	client := kube.GetClient()
+	for _, snapshot := range snapshots {
+		snapshotErr := getSnapshotError(snapshot)
+		if snapshotErr == "" || snapshot.VolumeSnapshot.ObjectMeta.Annotations[ReportedErrorAnnotation] == snapshotErr {
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{ReportedErrorAnnotation: snapshotErr},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		snapClient := client.SnapshotClient.Namespace(snapshot.Namespace)
+		if _, err := snapClient.Patch(context.TODO(), snapshot.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+		recordEvent(recorder, sg, pvc, corev1.EventTypeWarning, ReasonSnapshotFailed, "Snapshot %s failed: %s", snapshot.Name, snapshotErr)
+	}
+	return nil
+}
+
 // GetSnapshot returns a VolumeSnapshot
 func GetSnapshot(namespace, name string) (*GeminiSnapshot, error) {
 	client := kube.GetClient()
@@ -113,26 +366,69 @@ func parseSnapshot(unst *unstructured.Unstructured) (*GeminiSnapshot, error) {
 		Timestamp:      time.Unix(int64(timestamp), 0),
 		Intervals:      intervals,
 		Restore:        snap.ObjectMeta.Annotations[RestoreAnnotation],
+		Manual:         snap.ObjectMeta.Annotations[ManualAnnotation],
+		Set:            snap.ObjectMeta.Annotations[SnapshotSetAnnotation],
+		Claim:          snap.ObjectMeta.Annotations[ClaimAnnotation],
+		GroupSnapshot:  snap.ObjectMeta.Annotations[GroupSnapshotAnnotation],
+		Hooks:          parseHookResults(&snap.ObjectMeta),
 		VolumeSnapshot: &snap,
 	}, nil
 }
 
-// createSnapshot creates a new snappshot for a given SnapshotGroup
-func createSnapshot(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) (*GeminiSnapshot, error) {
-	timestamp := strconv.Itoa(int(time.Now().Unix()))
-	annotations[TimestampAnnotation] = timestamp
+// setSnapshotAnnotations adds the timestamp and the annotations that mark a snapshot as belonging to the SnapshotGroup
+func setSnapshotAnnotations(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) map[string]string {
+	annotations[TimestampAnnotation] = strconv.Itoa(int(time.Now().Unix()))
 	annotations[managedByAnnotation] = managerName
 	annotations[GroupNameAnnotation] = sg.ObjectMeta.Name
+	if sg.ObjectMeta.UID != "" {
+		annotations[GroupUIDAnnotation] = string(sg.ObjectMeta.UID)
+	}
+	return annotations
+}
+
+// getSnapshotName returns the name of a snapshot of a single PVC, which is also the ID of a snapshot set
+func getSnapshotName(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) string {
+	snapshotName := sg.ObjectMeta.Name + "-" + annotations[TimestampAnnotation]
+	if annotations[ManualAnnotation] != "" {
+		// Manual snapshots can be taken in the same second as a scheduled one
+		snapshotName += manualSuffix
+	} else if annotations[RestoreAnnotation] != "" {
+		// So can failsafe snapshots, when a restore is requested right after a backup
+		snapshotName += failsafeSuffix
+	}
+	return snapshotName
+}
 
+// createSnapshot creates a new snappshot for a given SnapshotGroup
+func createSnapshot(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) (*GeminiSnapshot, error) {
+	annotations = setSnapshotAnnotations(sg, annotations)
+	return createVolumeSnapshot(sg, getSnapshotName(sg, annotations), GetPVCName(sg), annotations)
+}
+
+// createSnapshots creates a snapshot of the PVC, or a snapshot set if the SnapshotGroup has multiple claims
+func createSnapshots(sg *snapshotgroup.SnapshotGroup, annotations map[string]string) ([]*GeminiSnapshot, error) {
+	if HasMultipleClaims(sg) {
+		return createSnapshotSet(sg, annotations)
+	}
+	snapshot, err := createSnapshot(sg, annotations)
+	if err != nil {
+		return nil, err
+	}
+	return []*GeminiSnapshot{snapshot}, nil
+}
+
+// createVolumeSnapshot creates a VolumeSnapshot of the named PVC
+func createVolumeSnapshot(sg *snapshotgroup.SnapshotGroup, snapshotName, name string, annotations map[string]string) (*GeminiSnapshot, error) {
 	snapshot := snapshotsv1.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace:   sg.ObjectMeta.Namespace,
-			Name:        sg.ObjectMeta.Name + "-" + timestamp,
-			Annotations: annotations,
+			Namespace:       sg.ObjectMeta.Namespace,
+			Name:            snapshotName,
+			Labels:          getSnapshotLabels(sg),
+			Annotations:     annotations,
+			OwnerReferences: getOwnerReferences(sg),
 		},
 		Spec: sg.Spec.Template.Spec,
 	}
-	name := getPVCName(sg)
 	klog.V(3).Infof("%s/%s: creating snapshot for PVC %s", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, name)
 	snapshot.Spec.Source.PersistentVolumeClaimName = &name
 
@@ -170,7 +466,7 @@ func createSnapshot(sg *snapshotgroup.SnapshotGroup, annotations map[string]stri
 	return parseSnapshot(snap)
 }
 
-func createSnapshotForIntervals(sg *snapshotgroup.SnapshotGroup, intervals []string) (*GeminiSnapshot, error) {
+func createSnapshotForIntervals(sg *snapshotgroup.SnapshotGroup, intervals []string) ([]*GeminiSnapshot, error) {
 	if len(intervals) == 0 {
 		return nil, nil
 	}
@@ -178,11 +474,10 @@ func createSnapshotForIntervals(sg *snapshotgroup.SnapshotGroup, intervals []str
 	annotations := map[string]string{
 		IntervalsAnnotation: strings.Join(intervals, intervalsSeparator),
 	}
-	return createSnapshot(sg, annotations)
+	return createSnapshots(sg, annotations)
 }
 
-func createSnapshotForRestore(sg *snapshotgroup.SnapshotGroup) (*GeminiSnapshot, error) {
-	restore := sg.ObjectMeta.Annotations[RestoreAnnotation]
+func createSnapshotForRestore(sg *snapshotgroup.SnapshotGroup, restore string) (*GeminiSnapshot, error) {
 	existing, err := ListSnapshots(sg)
 	if err != nil {
 		return nil, err
@@ -203,7 +498,19 @@ func createSnapshotForRestore(sg *snapshotgroup.SnapshotGroup) (*GeminiSnapshot,
 func deleteSnapshots(toDelete []*GeminiSnapshot) error {
 	klog.V(5).Infof("Deleting %d expired snapshots", len(toDelete))
 	client := kube.GetClient()
+	deletedGroups := map[string]bool{}
 	for _, snapshot := range toDelete {
+		if snapshot.GroupSnapshot != "" && client.GroupSnapshotClient != nil {
+			// VolumeSnapshots created by a VolumeGroupSnapshot are deleted along with it
+			key := snapshot.Namespace + "/" + snapshot.GroupSnapshot
+			if !deletedGroups[key] {
+				if err := deleteGroupSnapshot(snapshot.Namespace, snapshot.GroupSnapshot); err != nil {
+					return err
+				}
+				deletedGroups[key] = true
+			}
+			continue
+		}
 		snapClient := client.SnapshotClient.Namespace(snapshot.Namespace)
 		err := snapClient.Delete(context.TODO(), snapshot.Name, metav1.DeleteOptions{})
 		if err != nil {
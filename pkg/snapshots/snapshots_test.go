@@ -0,0 +1,217 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	snapshotsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+func TestListSnapshotsFromCache(t *testing.T) {
+	client := kube.SetFakeClient()
+	labelledSnapshotGroups.Delete("default/foo")
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}
+	snapClient := client.SnapshotClient.Namespace("default")
+
+	created, err := createSnapshotForIntervals(sg, []string{"1 hour"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{GroupNameLabel: "foo", managedByLabel: managerName}, created[0].VolumeSnapshot.ObjectMeta.Labels)
+
+	legacy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      "foo-1",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				GroupNameAnnotation: "foo",
+				managedByAnnotation: managerName,
+				TimestampAnnotation: "1",
+			},
+		},
+	}}
+	_, err = snapClient.Create(context.TODO(), legacy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	snapshots, err := ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snapshots), "unlabelled snapshots are listed from the API")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer := client.GetSnapshotInformer("default")
+	go informer.Run(stopCh)
+	assert.True(t, cache.WaitForCacheSync(stopCh, informer.HasSynced))
+
+	snapshots, err = ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snapshots), "all snapshots are listed from the cache")
+	assert.Equal(t, created[0].Name, snapshots[0].Name)
+	assert.Equal(t, "foo-1", snapshots[1].Name)
+
+	assert.NoError(t, updateSnapshotMetadata(sg, snapshots))
+	labelled, err := snapClient.Get(context.TODO(), "foo-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", labelled.GetLabels()[GroupNameLabel])
+	assert.Equal(t, managerName, labelled.GetLabels()[managedByLabel])
+
+	// Once they are all labelled, only the snapshots with the group's labels are listed from the API
+	unlabelled := legacy.DeepCopy()
+	unlabelled.SetName("foo-2")
+	_, err = snapClient.Create(context.TODO(), unlabelled, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	expectSnapshotChanges(sg, []*GeminiSnapshot{{Namespace: "default", Name: "foo-missing"}}, nil)
+	defer pendingSnapshotChanges.Delete("default/foo")
+	snapshots, err = ListSnapshots(sg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snapshots), "unlabelled snapshots are not listed again")
+}
+
+func TestResolveRestoreSnapshot(t *testing.T) {
+	client := kube.SetFakeClient()
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"},
+	}
+	newSnapshot := func(timestamp, restore string) {
+		annotations := map[string]interface{}{
+			GroupNameAnnotation: "bar",
+			managedByAnnotation: managerName,
+			TimestampAnnotation: timestamp,
+		}
+		if restore != "" {
+			annotations[RestoreAnnotation] = restore
+		}
+		snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]interface{}{
+				"name":        "bar-" + timestamp,
+				"namespace":   "default",
+				"labels":      map[string]interface{}{GroupNameLabel: "bar", managedByLabel: managerName},
+				"annotations": annotations,
+			},
+			"status": map[string]interface{}{"readyToUse": true},
+		}}
+		_, err := client.SnapshotClient.Namespace("default").Create(context.TODO(), snapshot, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	newSnapshot("1000", "")
+	newSnapshot("2000", "1000")
+
+	sr := &snapshotgroup.SnapshotRestore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"}}
+	snapshot, restorePoint, err := resolveRestoreSnapshot(sr, sg)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar-1000", snapshot.Name, "the failsafe snapshot of an earlier restore is not a backup")
+	assert.Equal(t, "1000", restorePoint)
+
+	sr.Spec.Snapshot.RestorePoint = "2000"
+	snapshot, _, err = resolveRestoreSnapshot(sr, sg)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar-2000", snapshot.Name, "failsafe snapshots can still be restored by name")
+}
+
+func TestApplySnapshotChanges(t *testing.T) {
+	now := time.Now()
+	snapshots := []*GeminiSnapshot{
+		{Namespace: "default", Name: "foo-2", Timestamp: now.Add(-time.Hour)},
+		{Namespace: "default", Name: "foo-1", Timestamp: now.Add(-2 * time.Hour)},
+	}
+	created := []*GeminiSnapshot{{Namespace: "default", Name: "foo-3", Timestamp: now}}
+	current := applySnapshotChanges(snapshots, created, snapshots[1:])
+	assert.Len(t, current, 2)
+	assert.Equal(t, "foo-3", current[0].Name, "the newest snapshot is first")
+	assert.Equal(t, "foo-2", current[1].Name)
+}
+
+func TestReportSnapshotErrors(t *testing.T) {
+	client := kube.SetFakeClient()
+	recorder := record.NewFakeRecorder(10)
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}
+	created, err := createSnapshotForIntervals(sg, []string{"1 hour"})
+	assert.NoError(t, err)
+	snapClient := client.SnapshotClient.Namespace("default")
+	failed, err := snapClient.Get(context.TODO(), created[0].Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(failed.Object, "volume is busy", "status", "error", "message"))
+	_, err = snapClient.Update(context.TODO(), failed, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		snapshots, err := ListSnapshots(sg)
+		assert.NoError(t, err)
+		assert.NoError(t, reportSnapshotErrors(sg, nil, snapshots, recorder))
+	}
+	assert.Equal(t, "Warning SnapshotFailed Snapshot "+created[0].Name+" failed: volume is busy", <-recorder.Events)
+	assert.Len(t, recorder.Events, 0, "each error is only reported once")
+}
+
+func TestGetNewestReadyBackup(t *testing.T) {
+	ready := true
+	newSnapshot := func(timestamp time.Time, restore string) *GeminiSnapshot {
+		return &GeminiSnapshot{
+			Timestamp: timestamp,
+			Restore:   restore,
+			VolumeSnapshot: &snapshotsv1.VolumeSnapshot{
+				Status: &snapshotsv1.VolumeSnapshotStatus{ReadyToUse: &ready},
+			},
+		}
+	}
+	backup := time.Now().Add(-time.Hour)
+	snapshots := []*GeminiSnapshot{
+		newSnapshot(time.Now(), "1234"),
+		newSnapshot(backup, ""),
+	}
+	assert.Equal(t, backup, getNewestReadyBackup(snapshots), "failsafe snapshots are not backups")
+	assert.True(t, getNewestReadyBackup(snapshots[:1]).IsZero())
+}
+
+func TestSnapshotCacheIsCurrent(t *testing.T) {
+	sg := &snapshotgroup.SnapshotGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	old := &unstructured.Unstructured{}
+	old.SetNamespace("default")
+	old.SetName("foo-1")
+	assert.NoError(t, indexer.Add(old))
+	assert.True(t, isSnapshotCacheCurrent("default/foo", indexer))
+
+	expectSnapshotChanges(sg, []*GeminiSnapshot{{Namespace: "default", Name: "foo-2"}}, []*GeminiSnapshot{{Namespace: "default", Name: "foo-1"}})
+	assert.False(t, isSnapshotCacheCurrent("default/foo", indexer))
+	created := old.DeepCopy()
+	created.SetName("foo-2")
+	assert.NoError(t, indexer.Add(created))
+	assert.False(t, isSnapshotCacheCurrent("default/foo", indexer), "the deleted snapshot is still cached")
+	assert.NoError(t, indexer.Delete(old))
+	assert.True(t, isSnapshotCacheCurrent("default/foo", indexer))
+
+	pendingSnapshotChanges.Store("default/foo", snapshotChanges{created: []string{"default/lost"}, time: time.Now().Add(-2 * snapshotChangesTimeout)})
+	assert.True(t, isSnapshotCacheCurrent("default/foo", indexer), "changes the cache never sees are forgotten")
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/gemini/pkg/kube"
+	"github.com/fairwindsops/gemini/pkg/metrics"
+	snapshotgroup "github.com/fairwindsops/gemini/pkg/types/snapshotgroup/v1"
+)
+
+// updateStatus applies mutate to the latest status of the SnapshotGroup, and writes it if anything changed
+func updateStatus(sg *snapshotgroup.SnapshotGroup, mutate func(*snapshotgroup.SnapshotGroupStatus)) error {
+	client := kube.GetClient()
+	sgClient := client.SnapshotGroupClient.SnapshotGroups(sg.ObjectMeta.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := sgClient.Get(context.TODO(), sg.ObjectMeta.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			klog.V(5).Infof("%s/%s: not updating status of deleted SnapshotGroup", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		status := latest.Status.DeepCopy()
+		mutate(status)
+		if equality.Semantic.DeepEqual(*status, latest.Status) {
+			return nil
+		}
+		klog.V(5).Infof("%s/%s: updating status", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name)
+		latest.Status = *status
+		_, err = sgClient.UpdateStatus(context.TODO(), latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// updateBackupStatus records the snapshots of the SnapshotGroup and the result of reconciling it in its status, and
+// returns when the next snapshots are due. snapshots are listed if they are nil
+func updateBackupStatus(sg *snapshotgroup.SnapshotGroup, pvc *corev1.PersistentVolumeClaim, snapshots []*GeminiSnapshot, reconcileErr error) ([]snapshotgroup.ScheduledSnapshot, error) {
+	if snapshots == nil {
+		var err error
+		snapshots, err = ListSnapshots(sg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	nextSnapshots := []snapshotgroup.ScheduledSnapshot{}
+	location, err := getLocation(sg)
+	if err == nil && !sg.Spec.Suspend {
+		nextSnapshots, err = getNextSnapshots(sg.Spec.Schedule, getSnapshotSets(snapshots), location, sg.ObjectMeta.CreationTimestamp.Time)
+		if err == nil {
+			nextSnapshots, err = deferNextSnapshots(sg, nextSnapshots, location)
+		}
+	}
+	if err != nil {
+		klog.V(3).Infof("%s/%s: could not determine next snapshot times - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+	setGroupMetrics(sg, snapshots, nextSnapshots)
+	return nextSnapshots, updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+		setBackupStatus(status, sg, snapshots, nextSnapshots, reconcileErr)
+		if isPreHookFailure(reconcileErr) {
+			status.LastHookFailureTime = sg.Status.LastHookFailureTime
+		}
+		if pvc != nil {
+			status.ClaimSpec = getObservedClaimSpec(pvc)
+		}
+	})
+}
+
+func setBackupStatus(status *snapshotgroup.SnapshotGroupStatus, sg *snapshotgroup.SnapshotGroup, snapshots []*GeminiSnapshot, nextSnapshots []snapshotgroup.ScheduledSnapshot, reconcileErr error) {
+	status.ObservedGeneration = sg.ObjectMeta.Generation
+	status.NextSnapshots = nextSnapshots
+	status.Snapshots = []snapshotgroup.SnapshotStatus{}
+	var latest, failed *snapshotgroup.SnapshotStatus
+	latestReady := false
+	for _, snapshot := range snapshots {
+		snapshotStatus := getSnapshotStatus(snapshot)
+		status.Snapshots = append(status.Snapshots, snapshotStatus)
+		if snapshot.Restore != "" {
+			continue
+		}
+		if latest == nil {
+			latest = &snapshotStatus
+			latestReady = isSetReady(snapshot, snapshots)
+		}
+		if failed == nil && snapshotStatus.Error != "" {
+			failed = &snapshotStatus
+		}
+		if isSetReady(snapshot, snapshots) && (status.LastSnapshotTime == nil || status.LastSnapshotTime.Before(&snapshotStatus.Timestamp)) {
+			status.LastSnapshotTime = snapshotStatus.Timestamp.DeepCopy()
+		}
+	}
+
+	ready := metav1.Condition{
+		Type:               snapshotgroup.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "SnapshotReady",
+		ObservedGeneration: sg.ObjectMeta.Generation,
+	}
+	failing := metav1.Condition{
+		Type:               snapshotgroup.ConditionSnapshotFailing,
+		Status:             metav1.ConditionFalse,
+		Reason:             "SnapshotsHealthy",
+		ObservedGeneration: sg.ObjectMeta.Generation,
+	}
+	if reconcileErr != nil {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "ReconcileFailed"
+		ready.Message = reconcileErr.Error()
+		failing.Status = metav1.ConditionTrue
+		failing.Reason = "ReconcileFailed"
+		failing.Message = reconcileErr.Error()
+	} else if failed != nil {
+		failing.Status = metav1.ConditionTrue
+		failing.Reason = "SnapshotError"
+		failing.Message = fmt.Sprintf("%s: %s", failed.Name, failed.Error)
+	}
+	if reconcileErr == nil {
+		if latest == nil {
+			ready.Status = metav1.ConditionFalse
+			ready.Reason = "NoSnapshots"
+		} else if !latestReady {
+			ready.Status = metav1.ConditionFalse
+			ready.Reason = "SnapshotNotReady"
+			ready.Message = fmt.Sprintf("waiting for %s to be ready to use", getStatusSetName(latest))
+		} else {
+			ready.Message = fmt.Sprintf("%s is ready to use", getStatusSetName(latest))
+		}
+	}
+	suspended := metav1.Condition{
+		Type:               snapshotgroup.ConditionSuspended,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Active",
+		ObservedGeneration: sg.ObjectMeta.Generation,
+	}
+	if sg.Spec.Suspend {
+		suspended.Status = metav1.ConditionTrue
+		suspended.Reason = "Suspended"
+		suspended.Message = "snapshots are not being created or deleted"
+	}
+	meta.SetStatusCondition(&status.Conditions, ready)
+	meta.SetStatusCondition(&status.Conditions, failing)
+	meta.SetStatusCondition(&status.Conditions, suspended)
+}
+
+// getStatusSetName returns the name of a snapshot, or of the set it belongs to
+func getStatusSetName(status *snapshotgroup.SnapshotStatus) string {
+	if status.Set != "" {
+		return "snapshot set " + status.Set
+	}
+	return status.Name
+}
+
+// setRestoringStatus records the progress of a restore requested with the restore annotation in the Restoring condition
+func setRestoringStatus(sg *snapshotgroup.SnapshotGroup, restoreErr error, done bool) error {
+	restorePoint := sg.ObjectMeta.Annotations[RestoreAnnotation]
+	if target := sg.ObjectMeta.Annotations[RestoreTargetAnnotation]; target != "" {
+		restorePoint = fmt.Sprintf("%s in new PVC %s", restorePoint, target)
+	}
+	condition := metav1.Condition{
+		Type:               snapshotgroup.ConditionRestoring,
+		Status:             metav1.ConditionTrue,
+		Reason:             "RestoreInProgress",
+		Message:            fmt.Sprintf("restoring to %s", restorePoint),
+		ObservedGeneration: sg.ObjectMeta.Generation,
+	}
+	if restoreErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "RestoreFailed"
+		condition.Message = fmt.Sprintf("failed to restore to %s: %v", restorePoint, restoreErr)
+	} else if done {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "RestoreSucceeded"
+		condition.Message = fmt.Sprintf("restored to %s", restorePoint)
+	}
+	return updateStatus(sg, func(status *snapshotgroup.SnapshotGroupStatus) {
+		meta.SetStatusCondition(&status.Conditions, condition)
+	})
+}
+
+// setRestoreFailedStatus records that a restore failed. The restore error is returned either way, so failing to
+// record it is only logged
+func setRestoreFailedStatus(sg *snapshotgroup.SnapshotGroup, restoreErr error) {
+	if err := setRestoringStatus(sg, restoreErr, true); err != nil {
+		klog.Warningf("%s/%s: failed to record restore failure - %v", sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, err)
+	}
+}
+
+func setGroupMetrics(sg *snapshotgroup.SnapshotGroup, snapshots []*GeminiSnapshot, nextSnapshots []snapshotgroup.ScheduledSnapshot) {
+	state := metrics.GroupState{
+		Snapshots:           len(snapshots),
+		NewestReadySnapshot: getNewestReadyBackup(snapshots),
+		NextSnapshots:       map[string]time.Time{},
+	}
+	for _, next := range nextSnapshots {
+		state.NextSnapshots[next.Interval] = next.Time.Time
+	}
+	metrics.SetGroupState(sg.ObjectMeta.Namespace, sg.ObjectMeta.Name, state)
+}
+
+// getNewestReadyBackup returns the time of the newest backup that is ready to use. Failsafe snapshots taken before
+// a restore are not backups, so they are ignored
+func getNewestReadyBackup(snapshots []*GeminiSnapshot) time.Time {
+	newest := time.Time{}
+	for _, snapshot := range snapshots {
+		if snapshot.Restore == "" && getSnapshotStatus(snapshot).ReadyToUse && snapshot.Timestamp.After(newest) {
+			newest = snapshot.Timestamp
+		}
+	}
+	return newest
+}
+
+func getSnapshotStatus(snapshot *GeminiSnapshot) snapshotgroup.SnapshotStatus {
+	status := snapshotgroup.SnapshotStatus{
+		Name:      snapshot.Name,
+		Timestamp: metav1.NewTime(snapshot.Timestamp),
+		Intervals: snapshot.Intervals,
+		Restore:   snapshot.Restore,
+		Manual:    snapshot.Manual,
+		Set:       snapshot.Set,
+		Claim:     snapshot.Claim,
+		Hooks:     snapshot.Hooks,
+	}
+	if snapshot.VolumeSnapshot != nil && snapshot.VolumeSnapshot.Status != nil {
+		vsStatus := snapshot.VolumeSnapshot.Status
+		status.ReadyToUse = vsStatus.ReadyToUse != nil && *vsStatus.ReadyToUse
+		if vsStatus.Error != nil && vsStatus.Error.Message != nil {
+			status.Error = *vsStatus.Error.Message
+		}
+	}
+	return status
+}
@@ -102,6 +102,18 @@ func (c *FakeSnapshotGroups) Update(ctx context.Context, snapshotGroup *v1.Snaps
 	return obj.(*v1.SnapshotGroup), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeSnapshotGroups) UpdateStatus(ctx context.Context, snapshotGroup *v1.SnapshotGroup, opts metav1.UpdateOptions) (*v1.SnapshotGroup, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(snapshotgroupsResource, "status", c.ns, snapshotGroup), &v1.SnapshotGroup{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1.SnapshotGroup), err
+}
+
 // Delete takes name of the snapshotGroup and deletes it. Returns an error if one occurs.
 func (c *FakeSnapshotGroups) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	_, err := c.Fake.
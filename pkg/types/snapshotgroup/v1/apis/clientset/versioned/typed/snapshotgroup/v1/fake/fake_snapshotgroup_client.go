@@ -32,6 +32,14 @@ func (c *FakeSnapshotgroupV1) SnapshotGroups(namespace string) v1.SnapshotGroupI
 	return &FakeSnapshotGroups{c, namespace}
 }
 
+func (c *FakeSnapshotgroupV1) SnapshotPolicies() v1.SnapshotPolicyInterface {
+	return &FakeSnapshotPolicies{c}
+}
+
+func (c *FakeSnapshotgroupV1) SnapshotRestores(namespace string) v1.SnapshotRestoreInterface {
+	return &FakeSnapshotRestores{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeSnapshotgroupV1) RESTClient() rest.Interface {
@@ -19,3 +19,7 @@ limitations under the License.
 package v1
 
 type SnapshotGroupExpansion interface{}
+
+type SnapshotPolicyExpansion interface{}
+
+type SnapshotRestoreExpansion interface{}
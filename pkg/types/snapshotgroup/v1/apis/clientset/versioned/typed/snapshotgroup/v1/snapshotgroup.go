@@ -40,6 +40,7 @@ type SnapshotGroupsGetter interface {
 type SnapshotGroupInterface interface {
 	Create(ctx context.Context, snapshotGroup *snapshotgroupv1.SnapshotGroup, opts metav1.CreateOptions) (*snapshotgroupv1.SnapshotGroup, error)
 	Update(ctx context.Context, snapshotGroup *snapshotgroupv1.SnapshotGroup, opts metav1.UpdateOptions) (*snapshotgroupv1.SnapshotGroup, error)
+	UpdateStatus(ctx context.Context, snapshotGroup *snapshotgroupv1.SnapshotGroup, opts metav1.UpdateOptions) (*snapshotgroupv1.SnapshotGroup, error)
 	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
 	DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error
 	Get(ctx context.Context, name string, opts metav1.GetOptions) (*snapshotgroupv1.SnapshotGroup, error)
@@ -135,6 +136,22 @@ func (c *snapshotGroups) Update(ctx context.Context, snapshotGroup *snapshotgrou
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *snapshotGroups) UpdateStatus(ctx context.Context, snapshotGroup *snapshotgroupv1.SnapshotGroup, opts metav1.UpdateOptions) (result *snapshotgroupv1.SnapshotGroup, err error) {
+	result = &snapshotgroupv1.SnapshotGroup{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("snapshotgroups").
+		Name(snapshotGroup.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(snapshotGroup).
+		Do(ctx).
+		Into(result)
+	return
+}
+
 // Delete takes name of the snapshotGroup and deletes it. Returns an error if one occurs.
 func (c *snapshotGroups) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	return c.client.Delete().
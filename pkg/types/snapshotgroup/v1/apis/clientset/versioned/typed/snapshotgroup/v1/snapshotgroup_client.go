@@ -27,6 +27,8 @@ import (
 type SnapshotgroupV1Interface interface {
 	RESTClient() rest.Interface
 	SnapshotGroupsGetter
+	SnapshotPoliciesGetter
+	SnapshotRestoresGetter
 }
 
 // SnapshotgroupV1Client is used to interact with features provided by the snapshotgroup group.
@@ -38,6 +40,14 @@ func (c *SnapshotgroupV1Client) SnapshotGroups(namespace string) SnapshotGroupIn
 	return newSnapshotGroups(c, namespace)
 }
 
+func (c *SnapshotgroupV1Client) SnapshotPolicies() SnapshotPolicyInterface {
+	return newSnapshotPolicies(c)
+}
+
+func (c *SnapshotgroupV1Client) SnapshotRestores(namespace string) SnapshotRestoreInterface {
+	return newSnapshotRestores(c, namespace)
+}
+
 // NewForConfig creates a new SnapshotgroupV1Client for the given config.
 func NewForConfig(c *rest.Config) (*SnapshotgroupV1Client, error) {
 	config := *c
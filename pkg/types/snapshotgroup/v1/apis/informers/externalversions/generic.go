@@ -55,6 +55,10 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 	// Group=snapshotgroup, Version=v1
 	case v1.SchemeGroupVersion.WithResource("snapshotgroups"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Snapshotgroup().V1().SnapshotGroups().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("snapshotpolicies"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Snapshotgroup().V1().SnapshotPolicies().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("snapshotrestores"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Snapshotgroup().V1().SnapshotRestores().Informer()}, nil
 
 	}
 
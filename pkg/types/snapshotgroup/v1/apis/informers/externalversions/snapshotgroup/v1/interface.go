@@ -26,6 +26,10 @@ import (
 type Interface interface {
 	// SnapshotGroups returns a SnapshotGroupInformer.
 	SnapshotGroups() SnapshotGroupInformer
+	// SnapshotPolicies returns a SnapshotPolicyInformer.
+	SnapshotPolicies() SnapshotPolicyInformer
+	// SnapshotRestores returns a SnapshotRestoreInformer.
+	SnapshotRestores() SnapshotRestoreInformer
 }
 
 type version struct {
@@ -43,3 +47,13 @@ func New(f internalinterfaces.SharedInformerFactory, namespace string, tweakList
 func (v *version) SnapshotGroups() SnapshotGroupInformer {
 	return &snapshotGroupInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// SnapshotPolicies returns a SnapshotPolicyInformer.
+func (v *version) SnapshotPolicies() SnapshotPolicyInformer {
+	return &snapshotPolicyInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
+// SnapshotRestores returns a SnapshotRestoreInformer.
+func (v *version) SnapshotRestores() SnapshotRestoreInformer {
+	return &snapshotRestoreInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
@@ -25,3 +25,15 @@ type SnapshotGroupListerExpansion interface{}
 // SnapshotGroupNamespaceListerExpansion allows custom methods to be added to
 // SnapshotGroupNamespaceLister.
 type SnapshotGroupNamespaceListerExpansion interface{}
+
+// SnapshotPolicyListerExpansion allows custom methods to be added to
+// SnapshotPolicyLister.
+type SnapshotPolicyListerExpansion interface{}
+
+// SnapshotRestoreListerExpansion allows custom methods to be added to
+// SnapshotRestoreLister.
+type SnapshotRestoreListerExpansion interface{}
+
+// SnapshotRestoreNamespaceListerExpansion allows custom methods to be added to
+// SnapshotRestoreNamespaceLister.
+type SnapshotRestoreNamespaceListerExpansion interface{}
@@ -1,11 +1,11 @@
 package v1
 
 import (
-	"os"
 	"context"
+	_ "embed"
 	"fmt"
+	"os"
 	"time"
-	_ "embed"
 
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
@@ -23,14 +23,34 @@ var crdYAML string
 //go:embed crd-with-beta1.yaml
 var crdWithBeta1YAML string
 
-// CreateCustomResourceDefinition creates the CRD and add it into Kubernetes. If there is error,
-// it will do some clean up.
+//go:embed snapshotrestore-crd.yaml
+var snapshotRestoreCRDYAML string
+
+//go:embed snapshotpolicy-crd.yaml
+var snapshotPolicyCRDYAML string
+
+// CreateCustomResourceDefinition creates the SnapshotGroup, SnapshotRestore and SnapshotPolicy CRDs and add them into Kubernetes.
+// If there is error, it will do some clean up.
 func CreateCustomResourceDefinition(namespace string, clientSet apiextensionsclientset.Interface) (*apiextensionsv1.CustomResourceDefinition, error) {
-	crd := &apiextensionsv1.CustomResourceDefinition{}
 	yamlToParse := crdYAML
 	if os.Getenv("INCLUDE_GEMINI_BETA_CRD") != "" {
 		yamlToParse = crdWithBeta1YAML
 	}
+	crd, err := createCRD(clientSet, yamlToParse, CRDName, Kind)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := createCRD(clientSet, snapshotRestoreCRDYAML, SnapshotRestoreCRDName, SnapshotRestoreKind); err != nil {
+		return nil, err
+	}
+	if _, err := createCRD(clientSet, snapshotPolicyCRDYAML, SnapshotPolicyCRDName, SnapshotPolicyKind); err != nil {
+		return nil, err
+	}
+	return crd, nil
+}
+
+func createCRD(clientSet apiextensionsclientset.Interface, yamlToParse, crdName, kind string) (*apiextensionsv1.CustomResourceDefinition, error) {
+	crd := &apiextensionsv1.CustomResourceDefinition{}
 	fmt.Println("CRD yaml", yamlToParse)
 	err := yaml.Unmarshal([]byte(yamlToParse), crd)
 	if err != nil {
@@ -40,21 +60,21 @@ func CreateCustomResourceDefinition(namespace string, clientSet apiextensionscli
 
 	_, err = clientSet.ApiextensionsV1().CustomResourceDefinitions().Create(context.TODO(), crd, metav1.CreateOptions{})
 	if err == nil {
-		fmt.Println("CRD SnapshotGroup is created")
+		fmt.Printf("CRD %s is created\n", kind)
 	} else if apierrors.IsAlreadyExists(err) {
-		fmt.Println("CRD SnapshotGroup already exists, trying update")
+		fmt.Printf("CRD %s already exists, trying update\n", kind)
 		_, err = clientSet.ApiextensionsV1().CustomResourceDefinitions().Update(context.TODO(), crd, metav1.UpdateOptions{})
 	}
 	if err != nil {
-		fmt.Printf("Failed to create CRD SnapshotGroup: %+v\n", err)
+		fmt.Printf("Failed to create CRD %s: %+v\n", kind, err)
 		return nil, err
 	}
 
 	// Wait for CRD creation.
 	err = wait.Poll(5*time.Second, 60*time.Second, func() (bool, error) {
-		crd, err = clientSet.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), CRDName, metav1.GetOptions{})
+		crd, err = clientSet.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), crdName, metav1.GetOptions{})
 		if err != nil {
-			fmt.Printf("Fail to wait for CRD SnapshotGroup creation: %+v\n", err)
+			fmt.Printf("Fail to wait for CRD %s creation: %+v\n", kind, err)
 
 			return false, err
 		}
@@ -66,7 +86,7 @@ func CreateCustomResourceDefinition(namespace string, clientSet apiextensionscli
 				}
 			case apiextensionsv1.NamesAccepted:
 				if cond.Status == apiextensionsv1.ConditionFalse {
-					fmt.Printf("Name conflict while wait for CRD SnapshotGroup creation: %s, %+v\n", cond.Reason, err)
+					fmt.Printf("Name conflict while wait for CRD %s creation: %s, %+v\n", kind, cond.Reason, err)
 				}
 			}
 		}
@@ -77,9 +97,9 @@ func CreateCustomResourceDefinition(namespace string, clientSet apiextensionscli
 	// If there is an error, delete the object to keep it clean.
 	if err != nil {
 		fmt.Println("Try to cleanup")
-		deleteErr := clientSet.ApiextensionsV1().CustomResourceDefinitions().Delete(context.TODO(), CRDName, metav1.DeleteOptions{})
+		deleteErr := clientSet.ApiextensionsV1().CustomResourceDefinitions().Delete(context.TODO(), crdName, metav1.DeleteOptions{})
 		if deleteErr != nil {
-			fmt.Printf("Fail to delete CRD SnapshotGroup: %+v\n", deleteErr)
+			fmt.Printf("Fail to delete CRD %s: %+v\n", kind, deleteErr)
 
 			return nil, errors.NewAggregate([]error{err, deleteErr})
 		}
@@ -14,6 +14,14 @@ const (
 	Plural       string = "snapshotgroups"
 	Singular     string = "snapshotgroup"
 	CRDName      string = Plural + "." + GroupName
+
+	SnapshotRestoreKind    string = "SnapshotRestore"
+	SnapshotRestorePlural  string = "snapshotrestores"
+	SnapshotRestoreCRDName string = SnapshotRestorePlural + "." + GroupName
+
+	SnapshotPolicyKind    string = "SnapshotPolicy"
+	SnapshotPolicyPlural  string = "snapshotpolicies"
+	SnapshotPolicyCRDName string = SnapshotPolicyPlural + "." + GroupName
 )
 
 var (
@@ -36,6 +44,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&SnapshotGroup{},
 		&SnapshotGroupList{},
+		&SnapshotRestore{},
+		&SnapshotRestoreList{},
+		&SnapshotPolicy{},
+		&SnapshotPolicyList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
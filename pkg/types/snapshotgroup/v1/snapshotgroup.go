@@ -7,7 +7,6 @@ import (
 )
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=snapshotgroup
 
@@ -23,23 +22,144 @@ type SnapshotGroupSpec struct {
 	Claim    SnapshotClaim      `json:"persistentVolumeClaim"`
 	Template SnapshotTemplate   `json:"template"`
 	Schedule []SnapshotSchedule `json:"schedule"`
+	TimeZone string             `json:"timeZone,omitempty"`
+	// DeletionPolicy determines what happens to the VolumeSnapshots and PVC when the SnapshotGroup is deleted
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// KeepManual is the number of manual snapshots to keep. Defaults to 3
+	KeepManual int `json:"keepManual,omitempty"`
+	// Suspend stops Gemini from creating and deleting snapshots, without affecting existing ones
+	Suspend bool `json:"suspend,omitempty"`
+	// Hooks run commands in Pods before and after each snapshot, so that snapshots are application-consistent
+	Hooks *SnapshotHooks `json:"hooks,omitempty"`
 }
 
+// Deletion policies for SnapshotGroupSpec
+const (
+	// DeletionPolicyRetain keeps all VolumeSnapshots and the PVC. This is the default
+	DeletionPolicyRetain string = "Retain"
+	// DeletionPolicyDelete deletes all VolumeSnapshots, and the PVC if Gemini created it
+	DeletionPolicyDelete string = "Delete"
+	// DeletionPolicyRetainLatest keeps the PVC and the newest VolumeSnapshot that is ready to use, and deletes the other VolumeSnapshots
+	DeletionPolicyRetainLatest string = "RetainLatest"
+)
+
 type SnapshotClaim struct {
 	Spec corev1.PersistentVolumeClaimSpec `json:"spec"`
 	Name string                           `json:"claimName"`
+	// Selector backs up every PVC with matching labels, instead of a single claim
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// StatefulSet backs up the PVCs created from the volumeClaimTemplates of the named StatefulSet
+	StatefulSet string `json:"statefulSet,omitempty"`
 }
 
 type SnapshotTemplate struct {
 	Spec snapshotsv1.VolumeSnapshotSpec `json:"spec"`
+	// VolumeGroupSnapshotClassName takes a single VolumeGroupSnapshot of all the PVCs matching the claim selector,
+	// using this VolumeGroupSnapshotClass, when the cluster supports them
+	VolumeGroupSnapshotClassName string `json:"volumeGroupSnapshotClassName,omitempty"`
 }
 
 type SnapshotSchedule struct {
-	Every string `json:"every"`
+	Every string `json:"every,omitempty"`
+	Cron  string `json:"cron,omitempty"`
 	Keep  int    `json:"keep"`
 }
 
-type SnapshotGroupStatus struct{}
+// SnapshotHooks are the commands run around each snapshot. Post hooks run once the snapshot has been cut,
+// and also if a pre hook or the snapshot fails, so that anything the pre hooks did can be undone
+type SnapshotHooks struct {
+	Pre  []SnapshotHook `json:"pre,omitempty"`
+	Post []SnapshotHook `json:"post,omitempty"`
+}
+
+// SnapshotHook runs a command in each of the selected Pods
+type SnapshotHook struct {
+	Name string `json:"name"`
+	// PodSelector selects the Pods to run the command in. Defaults to the Pods mounting the PVC
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// Container to run the command in. Defaults to the first container in the Pod
+	Container string   `json:"container,omitempty"`
+	Command   []string `json:"command"`
+	// TimeoutSeconds is how long the command may run in each Pod. Defaults to 30
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// OnFailure is what to do when the command fails. Defaults to Abort
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// Failure policies for SnapshotHook
+const (
+	// HookOnFailureAbort stops running hooks. If a pre hook fails, no snapshot is taken. This is the default
+	HookOnFailureAbort string = "Abort"
+	// HookOnFailureContinue carries on with the remaining hooks and the snapshot
+	HookOnFailureContinue string = "Continue"
+)
+
+// Hook phases reported in HookResult
+const (
+	HookPhasePre  string = "Pre"
+	HookPhasePost string = "Post"
+)
+
+// HookResult records the outcome of running a hook in a Pod
+type HookResult struct {
+	Name  string      `json:"name"`
+	Phase string      `json:"phase"`
+	Pod   string      `json:"pod"`
+	Time  metav1.Time `json:"time"`
+	// Error is the reason the command failed, including its stderr. It is empty if the command succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Condition types reported in SnapshotGroupStatus
+const (
+	// ConditionReady indicates that the SnapshotGroup was reconciled and its latest snapshot is ready to use
+	ConditionReady string = "Ready"
+	// ConditionSnapshotFailing indicates that snapshots could not be created, deleted or provisioned
+	ConditionSnapshotFailing string = "SnapshotFailing"
+	// ConditionRestoring indicates that the PVC is being restored from a snapshot
+	ConditionRestoring string = "Restoring"
+	// ConditionSuspended indicates that snapshots are not being created or deleted because the SnapshotGroup is suspended
+	ConditionSuspended string = "Suspended"
+)
+
+type SnapshotGroupStatus struct {
+	ObservedGeneration int64                             `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition                `json:"conditions,omitempty"`
+	LastSnapshotTime   *metav1.Time                      `json:"lastSnapshotTime,omitempty"`
+	ClaimSpec          *corev1.PersistentVolumeClaimSpec `json:"claimSpec,omitempty"`
+	// LastManualSnapshot is the most recent snapshot-now token that was handled
+	LastManualSnapshot string `json:"lastManualSnapshot,omitempty"`
+	// LastHookFailureTime is when a pre hook last aborted a snapshot. Scheduled snapshots are retried the next time
+	// their schedule is due after it
+	LastHookFailureTime *metav1.Time `json:"lastHookFailureTime,omitempty"`
+	// WorkloadsQuiesced is true while workloads that Gemini scaled down for a restore haven't been scaled back up
+	WorkloadsQuiesced bool                `json:"workloadsQuiesced,omitempty"`
+	NextSnapshots     []ScheduledSnapshot `json:"nextSnapshots,omitempty"`
+	Snapshots         []SnapshotStatus    `json:"snapshots,omitempty"`
+}
+
+// ScheduledSnapshot is the next time a snapshot is due for one of the group's schedules
+type ScheduledSnapshot struct {
+	Interval string      `json:"interval"`
+	Time     metav1.Time `json:"time"`
+}
+
+// SnapshotStatus describes a VolumeSnapshot managed by the SnapshotGroup
+type SnapshotStatus struct {
+	Name       string      `json:"name"`
+	Timestamp  metav1.Time `json:"timestamp"`
+	Intervals  []string    `json:"intervals,omitempty"`
+	Restore    string      `json:"restore,omitempty"`
+	Manual     string      `json:"manual,omitempty"`
+	ReadyToUse bool        `json:"readyToUse"`
+	Error      string      `json:"error,omitempty"`
+	// Set is the ID of the snapshot set, when the SnapshotGroup backs up more than one PVC
+	Set string `json:"set,omitempty"`
+	// Claim is the PVC the snapshot was taken of, when it is part of a set
+	Claim string `json:"claim,omitempty"`
+	// Hooks are the results of the hooks run around this snapshot
+	Hooks []HookResult `json:"hooks,omitempty"`
+}
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=snapshotgroup
@@ -0,0 +1,50 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=snapshotpolicy
+
+// SnapshotPolicy is a cluster-wide policy that backs up every matching PVC with a SnapshotGroup of its own
+type SnapshotPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              SnapshotPolicySpec   `json:"spec"`
+	Status            SnapshotPolicyStatus `json:"status"`
+}
+
+type SnapshotPolicySpec struct {
+	// NamespaceSelector selects the namespaces to look for PVCs in. Defaults to all namespaces
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Selector selects the PVCs to back up
+	Selector *metav1.LabelSelector `json:"selector"`
+	// The fields below are copied to the SnapshotGroup generated for each PVC
+	Template       SnapshotTemplate   `json:"template"`
+	Schedule       []SnapshotSchedule `json:"schedule"`
+	TimeZone       string             `json:"timeZone,omitempty"`
+	DeletionPolicy string             `json:"deletionPolicy,omitempty"`
+	KeepManual     int                `json:"keepManual,omitempty"`
+	Suspend        bool               `json:"suspend,omitempty"`
+	Hooks          *SnapshotHooks     `json:"hooks,omitempty"`
+}
+
+type SnapshotPolicyStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	// SnapshotGroups is the number of SnapshotGroups generated from the policy
+	SnapshotGroups int `json:"snapshotGroups"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=snapshotpolicy
+
+// SnapshotPolicyList is the list of SnapshotPolicies.
+type SnapshotPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []SnapshotPolicy `json:"items"`
+}
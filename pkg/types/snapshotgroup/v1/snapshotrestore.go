@@ -0,0 +1,86 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=snapshotrestore
+
+// SnapshotRestore restores a snapshot of a SnapshotGroup, and records the outcome
+type SnapshotRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              SnapshotRestoreSpec   `json:"spec"`
+	Status            SnapshotRestoreStatus `json:"status"`
+}
+
+type SnapshotRestoreSpec struct {
+	// SnapshotGroup is the name of the SnapshotGroup to restore, in the same namespace
+	SnapshotGroup string `json:"snapshotGroup"`
+	// Snapshot selects the snapshot to restore. Defaults to the newest snapshot that is ready to use, other than failsafe snapshots
+	Snapshot SnapshotSelector `json:"snapshot,omitempty"`
+	// Strategy is how the snapshot is restored. Defaults to Replace
+	Strategy string `json:"strategy,omitempty"`
+	// Target is the name, or namespace/name, of the PVC to create with the NewPVC strategy
+	Target string `json:"target,omitempty"`
+}
+
+// SnapshotSelector selects one of the snapshots of a SnapshotGroup, by name or by restore point
+type SnapshotSelector struct {
+	Name         string `json:"name,omitempty"`
+	RestorePoint string `json:"restorePoint,omitempty"`
+}
+
+// Restore strategies for SnapshotRestoreSpec
+const (
+	// RestoreStrategyReplace takes a failsafe snapshot, then replaces the PVC of the SnapshotGroup
+	RestoreStrategyReplace string = "Replace"
+	// RestoreStrategyNewPVC creates a new PVC from the snapshot, leaving the PVC of the SnapshotGroup untouched
+	RestoreStrategyNewPVC string = "NewPVC"
+)
+
+// Phases of a SnapshotRestore
+const (
+	RestorePhasePending              string = "Pending"
+	RestorePhaseFailsafeSnapshotting string = "FailsafeSnapshotting"
+	RestorePhaseDeletingPVC          string = "DeletingPVC"
+	RestorePhaseRestoring            string = "Restoring"
+	RestorePhaseCompleted            string = "Completed"
+	RestorePhaseFailed               string = "Failed"
+)
+
+type SnapshotRestoreStatus struct {
+	Phase string `json:"phase,omitempty"`
+	// Snapshot is the name of the VolumeSnapshot being restored
+	Snapshot string `json:"snapshot,omitempty"`
+	// RestorePoint is the restore point of the snapshot being restored
+	RestorePoint string `json:"restorePoint,omitempty"`
+	// FailsafeSnapshot is the name of the VolumeSnapshot taken before replacing the PVC
+	FailsafeSnapshot string `json:"failsafeSnapshot,omitempty"`
+	// PersistentVolumeClaim is the namespace/name of the restored PVC
+	PersistentVolumeClaim string       `json:"persistentVolumeClaim,omitempty"`
+	StartTime             *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime        *metav1.Time `json:"completionTime,omitempty"`
+	Message               string       `json:"message,omitempty"`
+	// History records every phase the restore went through
+	History []SnapshotRestoreTransition `json:"history,omitempty"`
+}
+
+// SnapshotRestoreTransition records when a SnapshotRestore entered a phase
+type SnapshotRestoreTransition struct {
+	Phase   string      `json:"phase"`
+	Time    metav1.Time `json:"time"`
+	Message string      `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=snapshotrestore
+
+// SnapshotRestoreList is the list of SnapshotRestores.
+type SnapshotRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []SnapshotRestore `json:"items"`
+}